@@ -2,7 +2,10 @@ module askh.at/jig/v2
 
 go 1.23
 
-require github.com/urfave/cli/v2 v2.27.2
+require (
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/urfave/cli/v2 v2.27.2
+)
 
 require (
 	github.com/Azure/go-ansiterm v0.0.0-20210617225240-d185dfc1b5a1 // indirect
@@ -20,7 +23,6 @@ require (
 	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/goccy/go-yaml v1.19.2 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
-	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/gorilla/mux v1.8.1 // indirect
 	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
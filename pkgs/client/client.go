@@ -9,11 +9,16 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
+	"time"
 
 	"embed"
 
@@ -26,14 +31,43 @@ import (
 var config, _ = client_config.InitConfig()
 var ui = newCLIOutput()
 
-var httpClient = &http.Client{}
+var httpClient = &http.Client{Transport: &serverTransport{transports: map[string]*http.Transport{}}}
+
+// serverTransport presents the client certificate of the server requests go
+// to, every request is made against config.Endpoint.
+type serverTransport struct {
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func (t *serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	transport, found := t.transports[config.Endpoint]
+	if !found {
+		tlsConfig, err := config.TLSConfig()
+		if err != nil {
+			t.mu.Unlock()
+			return nil, err
+		}
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig
+		}
+		t.transports[config.Endpoint] = transport
+	}
+	t.mu.Unlock()
+	return transport.RoundTrip(req)
+}
 
 func createRequest(method, url string) (*http.Request, error) {
 	req, err := http.NewRequest(method, config.Endpoint+url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+config.Token)
+	// Servers with a client certificate configured may not need a token
+	if config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	}
 	return req, nil
 }
 
@@ -186,6 +220,9 @@ func loginCommand(c *cli.Context) error {
 			log.Fatal("Error using token: ", err)
 		}
 	}
+	if settings := serverTLSFlags(c); settings.CertFile != "" || settings.KeyFile != "" || settings.CAFile != "" {
+		config.SetServerTLS(config.Endpoint, settings)
+	}
 	req, _ := createRequest("GET", "/deployments")
 	loading := ui.startLoading("Connecting to server")
 	resp, err := httpClient.Do(req)
@@ -202,6 +239,28 @@ func loginCommand(c *cli.Context) error {
 	return nil
 }
 
+func serverTLSFlags(c *cli.Context) client_config.ServerTLS {
+	return client_config.ServerTLS{CertFile: absolutePath(c.String("cert")), KeyFile: absolutePath(c.String("key")), CAFile: absolutePath(c.String("ca"))}
+}
+
+// absolutePath keeps certificate paths working from other directories.
+func absolutePath(file string) string {
+	if file == "" {
+		return ""
+	}
+	absolute, err := filepath.Abs(file)
+	if err != nil {
+		return file
+	}
+	return absolute
+}
+
+var serverTLSCliFlags = []cli.Flag{
+	&cli.StringFlag{Name: "cert", Usage: "client certificate for servers that verify them"},
+	&cli.StringFlag{Name: "key", Usage: "key of the client certificate"},
+	&cli.StringFlag{Name: "ca", Usage: "CA that signed the server certificate, when it is not a public one"},
+}
+
 const DEFAULT_CONFIG = "./jig.json"
 
 //go:embed templates/*
@@ -237,10 +296,12 @@ func main() {
 				},
 			},
 			{
-				Name:   "login",
-				Usage:  "Login to the Jig server",
-				Args:   true,
-				Action: loginCommand,
+				Name:      "login",
+				Usage:     "Login to the Jig server",
+				Args:      true,
+				ArgsUsage: "<server>+<token>",
+				Flags:     serverTLSCliFlags,
+				Action:    loginCommand,
 			},
 			{
 				Name:  "ls",
@@ -396,6 +457,38 @@ func main() {
 							return nil
 						},
 					},
+					{
+						Name:      "restart",
+						Usage:     "Restart a deployment, stack or stack:service",
+						Flags:     []cli.Flag{tokenFlag},
+						Args:      true,
+						ArgsUsage: " name|stack:service",
+						Action:    lifecycleCommand("restart", "Restarting deployment", "Restarted deployment "),
+					},
+					{
+						Name:      "stop",
+						Usage:     "Stop a deployment, stack or stack:service",
+						Flags:     []cli.Flag{tokenFlag},
+						Args:      true,
+						ArgsUsage: " name|stack:service",
+						Action:    lifecycleCommand("stop", "Stopping deployment", "Stopped deployment "),
+					},
+					{
+						Name:      "start",
+						Usage:     "Start a stopped deployment, stack or stack:service",
+						Flags:     []cli.Flag{tokenFlag},
+						Args:      true,
+						ArgsUsage: " name|stack:service",
+						Action:    lifecycleCommand("start", "Starting deployment", "Started deployment "),
+					},
+					{
+						Name:      "redeploy",
+						Usage:     "Recreate a deployment from its current image, config and secrets, or a compose deployment from its kept project",
+						Flags:     []cli.Flag{tokenFlag},
+						Args:      true,
+						ArgsUsage: " name",
+						Action:    lifecycleCommand("redeploy", "Redeploying deployment", "Redeployed deployment "),
+					},
 					{
 						Name:  "logs",
 						Usage: "Get logs for a deployment or stack:service",
@@ -508,6 +601,159 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:  "env",
+				Usage: "Manage deployment environment variables",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "ls",
+						Aliases:   []string{"list"},
+						Usage:     "List environment variables of a deployment",
+						Args:      true,
+						ArgsUsage: " name",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    ListEnvs,
+					},
+					{
+						Name:      "set",
+						Usage:     "Set environment variables and recreate the deployment, compose deployments need jig deploy",
+						Args:      true,
+						ArgsUsage: " name KEY=VALUE [KEY=VALUE...]",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    SetEnvs,
+					},
+					{
+						Name:      "unset",
+						Usage:     "Remove environment variables and recreate the deployment, compose deployments need jig deploy",
+						Args:      true,
+						ArgsUsage: " name KEY [KEY...]",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    UnsetEnvs,
+					},
+				},
+			},
+			{
+				Name:  "volumes",
+				Usage: "Manage named Docker volumes",
+				Subcommands: []*cli.Command{
+					{
+						Name:    "ls",
+						Aliases: []string{"list"},
+						Usage:   "List volumes and the deployments using them",
+						Flags:   []cli.Flag{tokenFlag},
+						Action:  ListVolumes,
+					},
+					{
+						Name:      "create",
+						Usage:     "Create a named volume",
+						Args:      true,
+						ArgsUsage: " name",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "driver",
+								Usage: "Volume driver",
+							},
+							&cli.StringSliceFlag{
+								Name:    "opt",
+								Aliases: []string{"o"},
+								Usage:   "Driver option in the format key=value",
+							},
+							tokenFlag,
+						},
+						Action: CreateVolume,
+					},
+					{
+						Name:      "inspect",
+						Usage:     "Inspect a volume",
+						Args:      true,
+						ArgsUsage: " name",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    InspectVolume,
+					},
+					{
+						Name:      "rm",
+						Usage:     "Remove a volume that is not used by any deployment",
+						Args:      true,
+						ArgsUsage: " name",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    RemoveVolume,
+					},
+					{
+						Name:      "backup",
+						Usage:     "Download a gzipped tarball of the volume contents",
+						Args:      true,
+						ArgsUsage: " name",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "File to write the backup to, defaults to stdout",
+							},
+							tokenFlag,
+						},
+						Action: BackupVolume,
+					},
+					{
+						Name:      "restore",
+						Usage:     "Replace the volume contents with a backup, reads stdin when no file is given",
+						Args:      true,
+						ArgsUsage: " name [file]",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    RestoreVolume,
+					},
+				},
+			},
+			{
+				Name:  "admin",
+				Usage: "Export and import the server state",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "export",
+						Usage: "Download secrets, tokens and deployment configs as a gzipped tarball",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "File to write the export to, defaults to stdout",
+							},
+							&cli.BoolFlag{
+								Name:  "images",
+								Usage: "Include the images of stored deployments",
+							},
+							&cli.BoolFlag{
+								Name:  "volumes",
+								Usage: "Include the contents of Jig volumes",
+							},
+							&cli.BoolFlag{
+								Name:  "write-only-secrets",
+								Usage: "Include the values of write-only secrets, they are placeholders otherwise",
+							},
+							tokenFlag,
+						},
+						Action: ExportState,
+					},
+					{
+						Name:      "import",
+						Usage:     "Replay an export on this server, reads stdin when no file is given",
+						Args:      true,
+						ArgsUsage: " [file]",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    ImportState,
+					},
+					{
+						Name:   "schema",
+						Usage:  "Show the database schema version and migrations",
+						Flags:  []cli.Flag{tokenFlag},
+						Action: ShowSchema,
+					},
+					{
+						Name:   "rotate-master-key",
+						Usage:  "Re-encrypt all secrets with a new master key",
+						Flags:  []cli.Flag{tokenFlag},
+						Action: RotateMasterKey,
+					},
+				},
+			},
 			{
 				Name: "tokens",
 				Subcommands: []*cli.Command{
@@ -546,9 +792,17 @@ func main() {
 								ui.warning("No tokens configured")
 								return nil
 							}
-							ui.table([]string{"name"}, func(writer *tabwriter.Writer) {
+							ui.table([]string{"name", "prefix", "permissions", "scopes", "expires"}, func(writer *tabwriter.Writer) {
 								for _, token := range tokens.TokenNames {
-									fmt.Fprintf(writer, "%s\n", token)
+									scopes := "*"
+									if len(tokens.Scopes[token]) > 0 {
+										scopes = strings.Join(tokens.Scopes[token], ",")
+									}
+									prefix := "-"
+									if tokens.Prefixes[token] != "" {
+										prefix = tokens.Prefixes[token] + "..."
+									}
+									fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", token, prefix, strings.Join(tokens.Permissions[token], ","), scopes, formatTokenExpiry(tokens.Expires[token]))
 								}
 							})
 							return nil
@@ -559,13 +813,27 @@ func main() {
 						Usage: "Create a token",
 						Flags: []cli.Flag{
 							tokenFlag,
+							&cli.BoolFlag{Name: "reveal-secrets", Usage: "allow the token to read secret values back"},
+							&cli.StringSliceFlag{
+								Name:  "permissions",
+								Usage: "comma separated permissions out of read, deploy, delete, secrets:read, secrets:write, secrets:reveal, tokens:admin and cluster:admin",
+							},
+							&cli.StringSliceFlag{
+								Name:  "scope",
+								Usage: "only allow deployments matching this name glob, for example billing-*, can be repeated",
+							},
+							&cli.StringFlag{Name: "ttl", Usage: "expire the token after this long, for example 30d, 2w or 12h"},
 						},
 						Args: true,
 						Action: func(ctx *cli.Context) error {
 							name := ctx.Args().First()
 							req, _ := createRequest("POST", "/tokens")
 							bodyToSend := jigtypes.TokenCreateRequest{
-								Name: name,
+								Name:          name,
+								RevealSecrets: ctx.Bool("reveal-secrets"),
+								Permissions:   ctx.StringSlice("permissions"),
+								Scopes:        ctx.StringSlice("scope"),
+								TTL:           ctx.String("ttl"),
 							}
 							bodyBytes, _ := json.Marshal(bodyToSend)
 
@@ -577,7 +845,8 @@ func main() {
 								log.Fatal("Error making request: ", err)
 							}
 							if resp.StatusCode != 201 {
-								log.Fatal("Error creating token: ", resp.Status)
+								body, _ := io.ReadAll(resp.Body)
+								log.Fatalf("Error creating token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
 							}
 							var tokenCreateResponse jigtypes.TokenCreateResponse
 							err = json.NewDecoder(resp.Body).Decode(&tokenCreateResponse)
@@ -588,6 +857,60 @@ func main() {
 							ui.section("Token Created", "Store this value now; it will not be shown again")
 							ui.line("name", tokenCreateResponse.Name)
 							ui.line("token", config.SelectedServer+"+"+tokenCreateResponse.Token)
+							if tokenCreateResponse.ExpiresAt != "" {
+								ui.line("expires", formatTokenExpiry(tokenCreateResponse.ExpiresAt))
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "rotate",
+						Usage:     "Issue a new secret for a token",
+						ArgsUsage: "<name>",
+						Flags: []cli.Flag{
+							tokenFlag,
+							&cli.StringFlag{Name: "grace", Usage: "keep the old secret working for this long, for example 1h"},
+						},
+						Args: true,
+						Action: func(ctx *cli.Context) error {
+							if ctx.String("token") != "" {
+								config.UseTempToken(ctx.String("token"))
+							}
+							name := ctx.Args().First()
+							if name == "" {
+								log.Fatal("Name is required")
+							}
+							req, _ := createRequest("POST", "/tokens/"+name+"/rotate")
+							bodyBytes, _ := json.Marshal(jigtypes.TokenRotateRequest{Grace: ctx.String("grace")})
+							req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+							req.ContentLength = int64(len(bodyBytes))
+							loading := ui.startLoading("Rotating token")
+							resp, err := httpClient.Do(req)
+							loading.stop()
+							if err != nil {
+								log.Fatal("Error making request: ", err)
+							}
+							defer resp.Body.Close()
+							if resp.StatusCode != http.StatusOK {
+								body, _ := io.ReadAll(resp.Body)
+								log.Fatalf("Error rotating token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+							}
+							var rotated jigtypes.TokenCreateResponse
+							if err := json.NewDecoder(resp.Body).Decode(&rotated); err != nil {
+								log.Fatal("Error reading response: ", err)
+							}
+
+							ui.section("Token Rotated", "Store this value now; it will not be shown again")
+							ui.line("name", rotated.Name)
+							ui.line("token", config.SelectedServer+"+"+rotated.Token)
+							if grace := ctx.String("grace"); grace != "" {
+								ui.line("old token", "valid for another "+grace)
+							} else {
+								ui.line("old token", "revoked")
+							}
+							if rotated.ExpiresAt != "" {
+								ui.line("expires", formatTokenExpiry(rotated.ExpiresAt))
+							}
 							return nil
 						},
 					},
@@ -624,6 +947,19 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:  "audit",
+				Usage: "Show who changed what on the server, newest first",
+				Flags: []cli.Flag{
+					tokenFlag,
+					&cli.StringFlag{Name: "since", Usage: "only entries after this RFC3339 time or this long ago, for example 24h or 7d"},
+					&cli.StringFlag{Name: "actor", Usage: "only entries of this token"},
+					&cli.StringFlag{Name: "target", Usage: "only entries about this deployment, secret, volume or token"},
+					&cli.IntFlag{Name: "limit", Value: 100, Usage: "show at most this many entries"},
+					&cli.BoolFlag{Name: "json", Usage: "print the entries as JSON"},
+				},
+				Action: ListAudit,
+			},
 			{
 				Name: "servers",
 				Subcommands: []*cli.Command{
@@ -637,13 +973,13 @@ func main() {
 								ui.warning("No servers configured")
 								return nil
 							}
-							ui.table([]string{"server", "selected"}, func(writer *tabwriter.Writer) {
+							ui.table([]string{"server", "tls", "selected"}, func(writer *tabwriter.Writer) {
 								for _, server := range servers {
 									selected := ""
 									if config.SelectedServer == server {
 										selected = ui.cyan("current")
 									}
-									fmt.Fprintf(writer, "%s\t%s\n", server, selected)
+									fmt.Fprintf(writer, "%s\t%s\t%s\n", server, describeServerTLS(config.TLS[server]), selected)
 								}
 							})
 							return nil
@@ -663,6 +999,29 @@ func main() {
 							return nil
 						},
 					},
+					{
+						Name:      "tls",
+						Usage:     "Set the client certificate and CA of a server, no flags remove them",
+						Args:      true,
+						ArgsUsage: "<server>",
+						Flags:     serverTLSCliFlags,
+						Action: func(ctx *cli.Context) error {
+							server := ctx.Args().First()
+							if _, found := config.Servers[server]; !found {
+								log.Fatal("Server not found: ", server)
+							}
+							settings := serverTLSFlags(ctx)
+							if (settings.CertFile == "") != (settings.KeyFile == "") {
+								log.Fatal("--cert and --key have to be set together")
+							}
+							config.SetServerTLS(server, settings)
+							if err := config.Persist(); err != nil {
+								log.Fatal("Error saving config: ", err)
+							}
+							ui.success("Updated TLS settings of " + server + ": " + describeServerTLS(settings))
+							return nil
+						},
+					},
 					{
 						Name:  "rm",
 						Usage: "Remove a server",
@@ -673,6 +1032,7 @@ func main() {
 								log.Fatal("Server name is required")
 							}
 							delete(config.Servers, server)
+							config.SetServerTLS(server, client_config.ServerTLS{})
 							if config.SelectedServer == server {
 								config.SelectedServer = ""
 								config.Token = ""
@@ -835,13 +1195,76 @@ func main() {
 						Args:      true,
 						ArgsUsage: "name value",
 						Usage:     "add a secret",
+						Flags: []cli.Flag{
+							tokenFlag,
+							&cli.BoolFlag{Name: "write-only", Usage: "never allow reading the value back, deployments can still use it"},
+						},
+						Action: AddSecret,
+					},
+					{
+						Name:      "write-only",
+						ArgsUsage: "name",
+						Usage:     "stop allowing the value of a secret to be read back, this can not be undone",
 						Flags:     []cli.Flag{tokenFlag},
-						Action:    AddSecret,
+						Action:    MakeSecretWriteOnly,
 					},
 					{
-						Name:   "rm",
-						Usage:  "delete a secret",
-						Flags:  []cli.Flag{tokenFlag},
+						Name:      "import",
+						ArgsUsage: "file",
+						Usage:     "add every KEY=value of a dotenv file as a secret",
+						Flags: []cli.Flag{
+							tokenFlag,
+							&cli.StringFlag{Name: "prefix", Usage: "prepend to every secret name"},
+							&cli.BoolFlag{Name: "overwrite", Usage: "store a new version of secrets that already exist instead of skipping them"},
+						},
+						Action: ImportSecrets,
+					},
+					{
+						Name:  "export",
+						Usage: "print all secrets with their values to stdout",
+						Flags: []cli.Flag{
+							tokenFlag,
+							&cli.StringFlag{Name: "format", Value: "dotenv", Usage: "dotenv or json"},
+						},
+						Action: ExportSecrets,
+					},
+					{
+						Name:      "update",
+						Args:      true,
+						ArgsUsage: "name value",
+						Usage:     "store a new version of a secret",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    UpdateSecret,
+					},
+					{
+						Name:      "versions",
+						ArgsUsage: "name",
+						Usage:     "list the versions of a secret",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    ListSecretVersions,
+					},
+					{
+						Name:      "rollback",
+						Args:      true,
+						ArgsUsage: "name version",
+						Usage:     "make an earlier version of a secret current again",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    RollbackSecret,
+					},
+					{
+						Name:      "usage",
+						ArgsUsage: "name",
+						Usage:     "list the deployments that reference a secret",
+						Flags:     []cli.Flag{tokenFlag},
+						Action:    SecretUsage,
+					},
+					{
+						Name:  "rm",
+						Usage: "delete a secret",
+						Flags: []cli.Flag{
+							tokenFlag,
+							&cli.BoolFlag{Name: "force", Usage: "delete the secret even if deployments reference it"},
+						},
 						Action: DeleteSecret,
 					},
 				},
@@ -928,21 +1351,51 @@ func logsCommand(ctx *cli.Context) error {
 	return nil
 }
 
+func lifecycleCommand(action, progress, done string) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if ctx.String("token") != "" {
+			config.UseTempToken(ctx.String("token"))
+		}
+		name := ctx.Args().First()
+		if name == "" {
+			log.Fatal("Name is required")
+		}
+		req, _ := createRequest("POST", "/deployments/"+name+"/"+action)
+		loading := ui.startLoading(progress)
+		resp, err := httpClient.Do(req)
+		loading.stop()
+		if err != nil {
+			log.Fatal("Error making request: ", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			body, _ := io.ReadAll(resp.Body)
+			log.Fatalf("Error running %s: %s: %s", action, resp.Status, strings.TrimSpace(string(body)))
+		}
+		ui.success(done + name)
+		return nil
+	}
+}
+
 func printDeploymentRow(writer *tabwriter.Writer, deployment jigtypes.Deployment, prefix string, isRoot bool, isLast bool) {
 	replicas := ""
 	if deployment.Replicas > 0 {
 		replicas = fmt.Sprint(deployment.Replicas)
 	}
 	name := formatDeploymentName(prefix, deployment.Name, isRoot, isLast)
+	status := deployment.Status
+	if deployment.Drift != "" && deployment.Drift != deployment.Status {
+		status += " (" + deployment.Drift + ")"
+	}
 	if len(deployment.Children) > 0 {
-		fmt.Fprintf(writer, "%s\t%s\t%s\t\t\t%s\t%s\n", name, deployment.Kind, replicas, deployment.Status, yesOrNo(deployment.HasRollback))
+		fmt.Fprintf(writer, "%s\t%s\t%s\t\t\t%s\t%s\n", name, deployment.Kind, replicas, status, yesOrNo(deployment.HasRollback))
 		childPrefix := childDeploymentPrefix(prefix, isRoot, isLast)
 		for index, child := range deployment.Children {
 			printDeploymentRow(writer, child, childPrefix, false, index == len(deployment.Children)-1)
 		}
 		return
 	}
-	fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name, deployment.Kind, replicas, deployment.Rule, deployment.Lifetime, deployment.Status, yesOrNo(deployment.HasRollback))
+	fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name, deployment.Kind, replicas, deployment.Rule, deployment.Lifetime, status, yesOrNo(deployment.HasRollback))
 }
 
 func yesOrNo(b bool) string {
@@ -980,9 +1433,13 @@ func ListSecrets(ctx *cli.Context) error {
 		ui.warning("No secrets configured")
 		return nil
 	}
-	ui.table([]string{"name"}, func(writer *tabwriter.Writer) {
+	ui.table([]string{"name", "access"}, func(writer *tabwriter.Writer) {
 		for _, secret := range secretList.Secrets {
-			fmt.Fprintf(writer, "%s\n", secret)
+			access := "readable"
+			if slices.Contains(secretList.WriteOnly, secret) {
+				access = "write-only"
+			}
+			fmt.Fprintf(writer, "%s\t%s\n", secret, access)
 		}
 	})
 	return nil
@@ -999,7 +1456,11 @@ func DeleteSecret(ctx *cli.Context) error {
 		log.Fatal("Secret name is required")
 	}
 
-	req, _ := createRequest("DELETE", "/secrets/"+name)
+	path := "/secrets/" + name
+	if ctx.Bool("force") {
+		path += "?force=true"
+	}
+	req, _ := createRequest("DELETE", path)
 
 	loading := ui.startLoading("Removing secret")
 	resp, err := httpClient.Do(req)
@@ -1007,18 +1468,62 @@ func DeleteSecret(ctx *cli.Context) error {
 
 	if err != nil {
 		log.Fatal("Error making request: ", err)
-		log.Fatal("Error deleting secret: ", resp.Status)
-		println(io.ReadAll(resp.Body))
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 204 {
-		log.Fatal("Error deleting secret: ", resp.Status)
-		println(io.ReadAll(resp.Body))
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error deleting secret: %s: %s", resp.Status, strings.TrimSpace(string(body)))
 	}
 
 	ui.success("Removed secret " + name)
 	return nil
 }
 
+func SecretUsage(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+
+	name := ctx.Args().Get(0)
+	if name == "" {
+		log.Fatal("Secret name is required")
+	}
+
+	req, _ := createRequest("GET", "/secrets/"+name+"/usage")
+	loading := ui.startLoading("Loading secret usage")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error loading secret usage: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var usage jigtypes.SecretUsageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+
+	ui.section("Secret usage", usage.Name)
+	if len(usage.Usages) == 0 {
+		ui.warning("No deployments reference " + usage.Name)
+		return nil
+	}
+	ui.table([]string{"deployment", "service", "kind"}, func(writer *tabwriter.Writer) {
+		for _, entry := range usage.Usages {
+			service := entry.Service
+			if service == "" {
+				service = "-"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", entry.Deployment, service, entry.Kind)
+		}
+	})
+	return nil
+}
+
 func InspectSecret(ctx *cli.Context) error {
 	if ctx.String("token") != "" {
 		config.UseTempToken(ctx.String("token"))
@@ -1039,7 +1544,8 @@ func InspectSecret(ctx *cli.Context) error {
 		log.Fatal("Error reading secret: ", err.Error())
 	}
 	if resp.StatusCode != 200 {
-		log.Fatal("Error reading secret: ", resp.Status)
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error reading secret: %s: %s", resp.Status, strings.TrimSpace(string(body)))
 	}
 
 	var secret jigtypes.SecretInspect
@@ -1063,8 +1569,9 @@ func AddSecret(ctx *cli.Context) error {
 	}
 
 	bodyToSend := jigtypes.NewSecretBody{
-		Name:  ctx.Args().Get(0),
-		Value: ctx.Args().Get(1),
+		Name:      ctx.Args().Get(0),
+		Value:     ctx.Args().Get(1),
+		WriteOnly: ctx.Bool("write-only"),
 	}
 
 	if bodyToSend.Name == "" {
@@ -1098,3 +1605,845 @@ func AddSecret(ctx *cli.Context) error {
 	ui.success("Created secret " + bodyToSend.Name)
 	return nil
 }
+
+func MakeSecretWriteOnly(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+
+	name := ctx.Args().Get(0)
+	if name == "" {
+		log.Fatal("Secret name is required")
+	}
+
+	req, _ := createRequest("POST", "/secrets/"+name+"/write-only")
+	loading := ui.startLoading("Updating secret")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error updating secret: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	ui.success("Secret " + name + " is now write-only")
+	return nil
+}
+
+func UpdateSecret(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+
+	name := ctx.Args().Get(0)
+	bodyToSend := jigtypes.UpdateSecretBody{Value: ctx.Args().Get(1)}
+	if name == "" {
+		log.Fatal("Secret name is required")
+	}
+	if bodyToSend.Value == "" {
+		log.Fatal("Secret value is required")
+	}
+
+	bodyBytes, err := json.Marshal(bodyToSend)
+	if err != nil {
+		log.Fatal("Error marshalling body: ", err)
+	}
+	req, _ := createRequest("PUT", "/secrets/"+name)
+	req.Body = io.NopCloser(strings.NewReader(string(bodyBytes)))
+	loading := ui.startLoading("Updating secret")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error updating secret: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result jigtypes.SecretVersionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	ui.success(fmt.Sprintf("Updated secret %s to version %d", result.Name, result.Version))
+	printSecretRestarts(result)
+	return nil
+}
+
+func printSecretRestarts(result jigtypes.SecretVersionResponse) {
+	for _, name := range result.Restarted {
+		ui.success("Restarted " + name)
+	}
+	for _, message := range result.RestartErrors {
+		ui.warning("Failed to restart " + message)
+	}
+}
+
+func ListSecretVersions(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+
+	name := ctx.Args().Get(0)
+	if name == "" {
+		log.Fatal("Secret name is required")
+	}
+
+	req, _ := createRequest("GET", "/secrets/"+name+"/versions")
+	loading := ui.startLoading("Loading secret versions")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error listing secret versions: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var versionList jigtypes.SecretVersionList
+	if err := json.NewDecoder(resp.Body).Decode(&versionList); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+
+	ui.section("Secret versions", fmt.Sprintf("%s, current version %d", versionList.Name, versionList.Current))
+	ui.table([]string{"version", "created", "by"}, func(writer *tabwriter.Writer) {
+		for _, version := range versionList.Versions {
+			marker := ""
+			if version.Version == versionList.Current {
+				marker = " (current)"
+			}
+			createdBy := version.CreatedBy
+			if createdBy == "" {
+				createdBy = "-"
+			}
+			fmt.Fprintf(writer, "%d%s\t%s\t%s\n", version.Version, marker, version.CreatedAt, createdBy)
+		}
+	})
+	return nil
+}
+
+func RollbackSecret(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+
+	name := ctx.Args().Get(0)
+	if name == "" {
+		log.Fatal("Secret name is required")
+	}
+	version, err := strconv.Atoi(ctx.Args().Get(1))
+	if err != nil || version < 1 {
+		log.Fatal("Secret version must be a positive number")
+	}
+
+	bodyBytes, err := json.Marshal(jigtypes.SecretRollbackBody{Version: version})
+	if err != nil {
+		log.Fatal("Error marshalling body: ", err)
+	}
+	req, _ := createRequest("POST", "/secrets/"+name+"/rollback")
+	req.Body = io.NopCloser(strings.NewReader(string(bodyBytes)))
+	loading := ui.startLoading("Rolling back secret")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error rolling back secret: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result jigtypes.SecretVersionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	ui.success(fmt.Sprintf("Rolled back secret %s to version %d, now version %d", result.Name, version, result.Version))
+	printSecretRestarts(result)
+	return nil
+}
+
+func ImportSecrets(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+
+	path := ctx.Args().First()
+	if path == "" {
+		log.Fatal("Dotenv file is required")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal("Error opening dotenv file: ", err)
+	}
+	values, err := parseDotenv(file)
+	file.Close()
+	if err != nil {
+		log.Fatalf("Error parsing %s: %s", path, err)
+	}
+
+	request := jigtypes.SecretBatchRequest{Secrets: map[string]string{}, Overwrite: ctx.Bool("overwrite")}
+	for key, value := range values {
+		request.Secrets[ctx.String("prefix")+key] = value
+	}
+	bodyBytes, err := json.Marshal(request)
+	if err != nil {
+		log.Fatal("Error marshalling body: ", err)
+	}
+	req, _ := createRequest("POST", "/secrets/batch")
+	req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	loading := ui.startLoading(fmt.Sprintf("Importing %d secrets", len(request.Secrets)))
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error importing secrets: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result jigtypes.SecretBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	ui.section("Secrets imported", path)
+	ui.line("created", fmt.Sprint(result.Created))
+	ui.line("updated", fmt.Sprint(result.Updated))
+	ui.line("skipped", fmt.Sprint(result.Skipped))
+	if result.Skipped > 0 && !request.Overwrite {
+		ui.warning("Existing secrets were skipped, pass --overwrite to update them")
+	}
+	printSecretRestarts(jigtypes.SecretVersionResponse{Restarted: result.Restarted, RestartErrors: result.RestartErrors})
+	return nil
+}
+
+func ExportSecrets(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	format := ctx.String("format")
+	if format != "dotenv" && format != "json" {
+		log.Fatalf("Unknown format %q, use dotenv or json", format)
+	}
+
+	req, _ := createRequest("GET", "/secrets/export")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error exporting secrets: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var export jigtypes.SecretExport
+	if err := json.NewDecoder(resp.Body).Decode(&export); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+
+	// The secrets go to stdout so they can be redirected, nothing else may be
+	// printed there
+	if len(export.WriteOnly) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped write-only secrets: %s\n", strings.Join(export.WriteOnly, ", "))
+	}
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(export.Secrets)
+	}
+	_, err = os.Stdout.WriteString(formatDotenv(export.Secrets))
+	return err
+}
+
+func ListEnvs(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	name := ctx.Args().First()
+	if name == "" {
+		log.Fatal("Name is required")
+	}
+
+	req, _ := createRequest("GET", "/deployments/"+name+"/env")
+	loading := ui.startLoading("Loading environment")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error loading environment: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var envResponse jigtypes.DeploymentEnvResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envResponse); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	printEnvs(name, envResponse.Envs)
+	return nil
+}
+
+func SetEnvs(ctx *cli.Context) error {
+	name := ctx.Args().First()
+	if name == "" || ctx.Args().Len() < 2 {
+		log.Fatal("Name and at least one KEY=VALUE pair are required")
+	}
+	update := jigtypes.DeploymentEnvUpdateRequest{Set: map[string]string{}}
+	for _, pair := range ctx.Args().Slice()[1:] {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "" {
+			log.Fatalf("Invalid environment variable %q, expected KEY=VALUE", pair)
+		}
+		update.Set[key] = value
+	}
+	return updateEnvs(ctx, name, update)
+}
+
+func UnsetEnvs(ctx *cli.Context) error {
+	name := ctx.Args().First()
+	if name == "" || ctx.Args().Len() < 2 {
+		log.Fatal("Name and at least one KEY are required")
+	}
+	return updateEnvs(ctx, name, jigtypes.DeploymentEnvUpdateRequest{Unset: ctx.Args().Slice()[1:]})
+}
+
+func updateEnvs(ctx *cli.Context, name string, update jigtypes.DeploymentEnvUpdateRequest) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+
+	requestBody, err := json.Marshal(update)
+	if err != nil {
+		log.Fatal("Error marshaling env update: ", err)
+	}
+	req, _ := createRequest("PATCH", "/deployments/"+name+"/env")
+	req.Header.Set("Content-Type", "application/json")
+	req.Body = io.NopCloser(bytes.NewReader(requestBody))
+	loading := ui.startLoading("Updating environment")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error updating environment: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var envResponse jigtypes.DeploymentEnvResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envResponse); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	ui.success("Updated environment of " + name)
+	printEnvs(name, envResponse.Envs)
+	return nil
+}
+
+func printEnvs(name string, envs map[string]string) {
+	ui.section("Environment", name)
+	if len(envs) == 0 {
+		ui.warning("No environment variables configured")
+		return
+	}
+	keys := make([]string, 0, len(envs))
+	for key := range envs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ui.table([]string{"key", "value"}, func(writer *tabwriter.Writer) {
+		for _, key := range keys {
+			fmt.Fprintf(writer, "%s\t%s\n", key, envs[key])
+		}
+	})
+}
+
+func describeServerTLS(settings client_config.ServerTLS) string {
+	switch {
+	case settings.CertFile != "":
+		return "client certificate"
+	case settings.CAFile != "":
+		return "custom CA"
+	}
+	return "-"
+}
+
+// formatTokenExpiry shows an RFC3339 expiry in local time, marking tokens that
+// already expired.
+func formatTokenExpiry(expiresAt string) string {
+	if expiresAt == "" {
+		return "never"
+	}
+	expires, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return expiresAt
+	}
+	formatted := expires.Local().Format("2006-01-02 15:04")
+	if time.Now().After(expires) {
+		return formatted + " (expired)"
+	}
+	return formatted
+}
+
+func ListVolumes(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	req, _ := createRequest("GET", "/volumes")
+	loading := ui.startLoading("Loading volumes")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error listing volumes: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var volumes []jigtypes.Volume
+	if err := json.NewDecoder(resp.Body).Decode(&volumes); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+
+	ui.section("Volumes", fmt.Sprintf("%d total", len(volumes)))
+	if len(volumes) == 0 {
+		ui.warning("No volumes found")
+		return nil
+	}
+	ui.table([]string{"name", "driver", "used by"}, func(writer *tabwriter.Writer) {
+		for _, volume := range volumes {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", volume.Name, volume.Driver, strings.Join(volume.UsedBy, ", "))
+		}
+	})
+	return nil
+}
+
+func CreateVolume(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	request := jigtypes.VolumeCreateRequest{
+		Name:   ctx.Args().First(),
+		Driver: ctx.String("driver"),
+	}
+	if request.Name == "" {
+		log.Fatal("Volume name is required")
+	}
+	for _, option := range ctx.StringSlice("opt") {
+		key, value, found := strings.Cut(option, "=")
+		if !found || key == "" {
+			log.Fatalf("Invalid driver option %q, expected key=value", option)
+		}
+		if request.DriverOpts == nil {
+			request.DriverOpts = map[string]string{}
+		}
+		request.DriverOpts[key] = value
+	}
+
+	requestBody, err := json.Marshal(request)
+	if err != nil {
+		log.Fatal("Error marshaling volume request: ", err)
+	}
+	req, _ := createRequest("POST", "/volumes")
+	req.Header.Set("Content-Type", "application/json")
+	req.Body = io.NopCloser(bytes.NewReader(requestBody))
+	loading := ui.startLoading("Creating volume")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error creating volume: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	ui.success("Created volume " + request.Name)
+	return nil
+}
+
+func InspectVolume(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	name := ctx.Args().First()
+	if name == "" {
+		log.Fatal("Volume name is required")
+	}
+	req, _ := createRequest("GET", "/volumes/"+name)
+	loading := ui.startLoading("Loading volume")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error inspecting volume: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var volume jigtypes.Volume
+	if err := json.NewDecoder(resp.Body).Decode(&volume); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	ui.section("Volume", volume.Name)
+	ui.line("driver", volume.Driver)
+	ui.line("scope", volume.Scope)
+	ui.line("created", volume.CreatedAt)
+	ui.line("mountpoint", volume.Mountpoint)
+	for key, value := range volume.Options {
+		ui.line("option", key+"="+value)
+	}
+	if len(volume.UsedBy) == 0 {
+		ui.line("used by", "-")
+	} else {
+		ui.line("used by", strings.Join(volume.UsedBy, ", "))
+	}
+	return nil
+}
+
+func RemoveVolume(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	name := ctx.Args().First()
+	if name == "" {
+		log.Fatal("Volume name is required")
+	}
+	req, _ := createRequest("DELETE", "/volumes/"+name)
+	loading := ui.startLoading("Removing volume")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error removing volume: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	ui.success("Removed volume " + name)
+	return nil
+}
+
+func BackupVolume(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	name := ctx.Args().First()
+	if name == "" {
+		log.Fatal("Volume name is required")
+	}
+	outputPath := ctx.String("output")
+
+	req, _ := createRequest("GET", "/volumes/"+name+"/backup")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error backing up volume: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// The archive goes to stdout unless a file is given, so nothing else may
+	// be printed there
+	if outputPath == "" {
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			log.Fatal("Error writing backup: ", err)
+		}
+		return nil
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		log.Fatal("Error creating backup file: ", err)
+	}
+	loading := ui.startLoading("Downloading backup")
+	_, err = io.Copy(file, resp.Body)
+	loading.stop()
+	if err != nil {
+		file.Close()
+		os.Remove(outputPath)
+		log.Fatal("Error writing backup: ", err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatal("Error writing backup: ", err)
+	}
+	ui.success(fmt.Sprintf("Backed up volume %s to %s", name, outputPath))
+	return nil
+}
+
+func RestoreVolume(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	name := ctx.Args().First()
+	if name == "" {
+		log.Fatal("Volume name is required")
+	}
+
+	var backup io.Reader = os.Stdin
+	if inputPath := ctx.Args().Get(1); inputPath != "" && inputPath != "-" {
+		file, err := os.Open(inputPath)
+		if err != nil {
+			log.Fatal("Error opening backup file: ", err)
+		}
+		defer file.Close()
+		backup = file
+	}
+
+	req, _ := createRequest("POST", "/volumes/"+name+"/restore")
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Body = io.NopCloser(backup)
+	loading := ui.startLoading("Restoring volume")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error restoring volume: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	ui.success("Restored volume " + name)
+	return nil
+}
+
+func ExportState(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	query := url.Values{}
+	if ctx.Bool("images") {
+		query.Set("images", "true")
+	}
+	if ctx.Bool("volumes") {
+		query.Set("volumes", "true")
+	}
+	if ctx.Bool("write-only-secrets") {
+		query.Set("writeOnly", "true")
+	}
+	requestPath := "/admin/export"
+	if len(query) > 0 {
+		requestPath += "?" + query.Encode()
+	}
+	outputPath := ctx.String("output")
+
+	req, _ := createRequest("GET", requestPath)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error exporting server state: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// The archive goes to stdout unless a file is given, so nothing else may
+	// be printed there
+	if outputPath == "" {
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			log.Fatal("Error writing export: ", err)
+		}
+		return nil
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		log.Fatal("Error creating export file: ", err)
+	}
+	loading := ui.startLoading("Exporting server state")
+	_, err = io.Copy(file, resp.Body)
+	loading.stop()
+	if err != nil {
+		file.Close()
+		os.Remove(outputPath)
+		log.Fatal("Error writing export: ", err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatal("Error writing export: ", err)
+	}
+	ui.success("Exported server state to " + outputPath)
+	return nil
+}
+
+func ImportState(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	var export io.Reader = os.Stdin
+	if inputPath := ctx.Args().First(); inputPath != "" && inputPath != "-" {
+		file, err := os.Open(inputPath)
+		if err != nil {
+			log.Fatal("Error opening export file: ", err)
+		}
+		defer file.Close()
+		export = file
+	}
+
+	req, _ := createRequest("POST", "/admin/import")
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Body = io.NopCloser(export)
+	loading := ui.startLoading("Importing server state")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error importing server state: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result jigtypes.AdminImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	ui.section("Import", "")
+	ui.line("secrets", fmt.Sprint(result.Secrets))
+	ui.line("tokens", fmt.Sprint(result.Tokens))
+	ui.line("deployments", fmt.Sprint(result.Deployments))
+	ui.line("images", fmt.Sprint(result.Images))
+	ui.line("volumes", fmt.Sprint(result.Volumes))
+	for _, importError := range result.Errors {
+		ui.warning(importError)
+	}
+	if len(result.Errors) == 0 {
+		ui.success("Imported server state, deployments are recreated on the next reconcile")
+	}
+	return nil
+}
+
+func ListAudit(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	query := url.Values{}
+	for _, filter := range []string{"since", "actor", "target"} {
+		if value := ctx.String(filter); value != "" {
+			query.Set(filter, value)
+		}
+	}
+	query.Set("limit", strconv.Itoa(ctx.Int("limit")))
+
+	req, _ := createRequest("GET", "/audit?"+query.Encode())
+	loading := ui.startLoading("Loading audit log")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error loading audit log: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var audit jigtypes.AuditLogResponse
+	if err := json.NewDecoder(resp.Body).Decode(&audit); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	if ctx.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(audit.Entries)
+	}
+
+	ui.section("Audit log", fmt.Sprintf("%d entries", len(audit.Entries)))
+	if len(audit.Entries) == 0 {
+		ui.warning("No matching entries")
+		return nil
+	}
+	ui.table([]string{"time", "actor", "method", "route", "target", "status"}, func(writer *tabwriter.Writer) {
+		for _, entry := range audit.Entries {
+			timestamp := entry.Time
+			if parsed, err := time.Parse(time.RFC3339, entry.Time); err == nil {
+				timestamp = parsed.Local().Format("2006-01-02 15:04:05")
+			}
+			actor := entry.Actor
+			if actor == "" {
+				actor = "-"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%d\n", timestamp, actor, entry.Method, entry.Route, entry.Target, entry.Status)
+		}
+	})
+	return nil
+}
+
+func ShowSchema(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	req, _ := createRequest("GET", "/admin/schema")
+	loading := ui.startLoading("Loading schema")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error loading schema: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var status jigtypes.SchemaStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	ui.section("Schema", fmt.Sprintf("version %d of %d", status.Version, status.Latest))
+	ui.table([]string{"version", "name", "applied"}, func(writer *tabwriter.Writer) {
+		for _, migration := range status.Migrations {
+			applied := "pending"
+			if migration.Applied {
+				applied = migration.AppliedAt
+			}
+			fmt.Fprintf(writer, "%d\t%s\t%s\n", migration.Version, migration.Name, applied)
+		}
+	})
+	return nil
+}
+
+func RotateMasterKey(ctx *cli.Context) error {
+	if ctx.String("token") != "" {
+		config.UseTempToken(ctx.String("token"))
+	}
+	req, _ := createRequest("POST", "/admin/rotate-master-key")
+	loading := ui.startLoading("Rotating master key")
+	resp, err := httpClient.Do(req)
+	loading.stop()
+	if err != nil {
+		log.Fatal("Error making request: ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Error rotating master key: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result jigtypes.RotateMasterKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Fatal("Error decoding response: ", err)
+	}
+	ui.success(fmt.Sprintf("Rotated master key and re-encrypted %d secrets", result.Secrets))
+	return nil
+}
@@ -1,8 +1,11 @@
 package client_config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -13,11 +16,25 @@ type Config struct {
 	Token          string `json:"token"`
 	Servers        map[string]string
 	SelectedServer string
+	// TLS holds the client certificate and CA of servers that use them
+	TLS map[string]ServerTLS
+}
+
+// ServerTLS names the files used to talk to a server over mutual TLS.
+type ServerTLS struct {
+	CertFile string
+	KeyFile  string
+	// CAFile verifies servers whose certificate is not signed by a public CA
+	CAFile string
+}
+
+func (s ServerTLS) isSet() bool {
+	return s.CertFile != "" || s.KeyFile != "" || s.CAFile != ""
 }
 
 func (c *Config) IsReadyToDeploy() (bool, error) {
-	if c.Token == "" {
-		return false, errors.New("no token set")
+	if c.Token == "" && c.TLS[c.Endpoint].CertFile == "" {
+		return false, errors.New("no token or client certificate set")
 	}
 	if c.Endpoint == "" {
 		return false, errors.New("no endpoint set")
@@ -31,6 +48,7 @@ func InitConfig() (Config, error) {
 		Endpoint:       "",
 		Token:          "",
 		SelectedServer: "",
+		TLS:            make(map[string]ServerTLS),
 	}
 	newConfig.Servers = make(map[string]string)
 	return newConfig, nil
@@ -53,6 +71,44 @@ func (c *Config) ListServers() []string {
 	return servers
 }
 
+// SetServerTLS stores the certificate files of a server, empty settings remove
+// them.
+func (c *Config) SetServerTLS(endpoint string, settings ServerTLS) {
+	if !settings.isSet() {
+		delete(c.TLS, endpoint)
+		return
+	}
+	c.TLS[endpoint] = settings
+}
+
+// TLSConfig builds the TLS config for the current endpoint, nil means the
+// defaults.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	settings, found := c.TLS[c.Endpoint]
+	if !found {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if settings.CAFile != "" {
+		caBytes, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificates in %s", settings.CAFile)
+		}
+	}
+	return config, nil
+}
+
 var ErrWrongTokenFormat = errors.New("wrong token format")
 
 func (c *Config) UseTempToken(token string) error {
@@ -106,6 +162,7 @@ func (c *Config) ReadFromFile() error {
 
 	for _, server := range config.Servers {
 		c.Servers[server.Endpoint] = server.Token
+		c.SetServerTLS(server.Endpoint, ServerTLS{CertFile: server.CertFile, KeyFile: server.KeyFile, CAFile: server.CAFile})
 	}
 
 	token, ok := c.Servers[c.SelectedServer]
@@ -125,7 +182,14 @@ func (c *Config) Persist() error {
 	var persistableConfig ConfigfileJson
 	if c.Servers != nil {
 		for endpoint, token := range c.Servers {
-			persistableConfig.Servers = append(persistableConfig.Servers, ServerConfig{Endpoint: endpoint, Token: token})
+			settings := c.TLS[endpoint]
+			persistableConfig.Servers = append(persistableConfig.Servers, ServerConfig{
+				Endpoint: endpoint,
+				Token:    token,
+				CertFile: settings.CertFile,
+				KeyFile:  settings.KeyFile,
+				CAFile:   settings.CAFile,
+			})
 		}
 	}
 	persistableConfig.LastUsedServer = c.SelectedServer
@@ -150,6 +214,9 @@ func (c *Config) Persist() error {
 type ServerConfig struct {
 	Endpoint string `json:"endpoint"`
 	Token    string `json:"token"`
+	CertFile string `json:"cert,omitempty"`
+	KeyFile  string `json:"key,omitempty"`
+	CAFile   string `json:"ca,omitempty"`
 }
 
 type ConfigfileJson struct {
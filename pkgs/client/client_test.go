@@ -224,3 +224,51 @@ func TestPrintWorkerBootstrapCommand(t *testing.T) {
 		t.Fatalf("unexpected bootstrap command: %s", cmd)
 	}
 }
+
+func TestParseDotenv(t *testing.T) {
+	values, err := parseDotenv(strings.NewReader(`# production settings
+export API_TOKEN=abc123
+DATABASE_URL = postgres://app:pw@db/app # primary
+EMPTY=
+SINGLE='keep $HOME and \n as is'
+DOUBLE="line one\nsay \"hi\""
+MULTILINE="-----BEGIN KEY-----
+abc
+-----END KEY-----"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"API_TOKEN":    "abc123",
+		"DATABASE_URL": "postgres://app:pw@db/app",
+		"EMPTY":        "",
+		"SINGLE":       `keep $HOME and \n as is`,
+		"DOUBLE":       "line one\nsay \"hi\"",
+		"MULTILINE":    "-----BEGIN KEY-----\nabc\n-----END KEY-----",
+	}
+	if len(values) != len(expected) {
+		t.Fatalf("expected %d values, got %v", len(expected), values)
+	}
+	for key, want := range expected {
+		if values[key] != want {
+			t.Fatalf("expected %s to be %q, got %q", key, want, values[key])
+		}
+	}
+
+	for _, invalid := range []string{"NO_EQUALS", "BAD KEY=1", `OPEN="never closed`, "OPEN='never closed"} {
+		if _, err := parseDotenv(strings.NewReader(invalid)); err == nil {
+			t.Fatalf("expected %q to be rejected", invalid)
+		}
+	}
+
+	roundTrip, err := parseDotenv(strings.NewReader(formatDotenv(expected)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range expected {
+		if roundTrip[key] != want {
+			t.Fatalf("expected formatDotenv to round trip %s, got %q", key, roundTrip[key])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// parseDotenv reads KEY=value lines. Blank lines, comments and an export
+// prefix are ignored. Double quoted values may span lines and understand \n,
+// \t, \" and \\, single quoted values are taken literally and unquoted values
+// end at a " #" comment.
+func parseDotenv(reader io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: expected KEY=value", lineNumber)
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case strings.HasPrefix(value, `"`):
+			quoted := value[1:]
+			startLine := lineNumber
+			for !hasClosingQuote(quoted) {
+				if !scanner.Scan() {
+					return nil, fmt.Errorf("line %d: unterminated double quoted value", startLine)
+				}
+				lineNumber++
+				quoted += "\n" + scanner.Text()
+			}
+			value = unescapeDotenvValue(quoted[:closingQuoteIndex(quoted)])
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end == -1 {
+				return nil, fmt.Errorf("line %d: unterminated single quoted value", lineNumber)
+			}
+			value = value[1 : end+1]
+		default:
+			if comment := strings.Index(value, " #"); comment != -1 {
+				value = strings.TrimSpace(value[:comment])
+			}
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// closingQuoteIndex finds the first unescaped double quote, or -1.
+func closingQuoteIndex(value string) int {
+	escaped := false
+	for index, char := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case char == '\\':
+			escaped = true
+		case char == '"':
+			return index
+		}
+	}
+	return -1
+}
+
+func hasClosingQuote(value string) bool {
+	return closingQuoteIndex(value) != -1
+}
+
+func unescapeDotenvValue(value string) string {
+	var builder strings.Builder
+	escaped := false
+	for _, char := range value {
+		if !escaped {
+			if char == '\\' {
+				escaped = true
+				continue
+			}
+			builder.WriteRune(char)
+			continue
+		}
+		escaped = false
+		switch char {
+		case 'n':
+			builder.WriteByte('\n')
+		case 't':
+			builder.WriteByte('\t')
+		case 'r':
+			builder.WriteByte('\r')
+		case '"', '\\', '$':
+			builder.WriteRune(char)
+		default:
+			builder.WriteByte('\\')
+			builder.WriteRune(char)
+		}
+	}
+	return builder.String()
+}
+
+// formatDotenv writes values sorted by key, every value double quoted so that
+// parseDotenv reads back exactly the same map.
+func formatDotenv(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	var builder strings.Builder
+	for _, key := range keys {
+		builder.WriteString(key + `="` + replacer.Replace(values[key]) + "\"\n")
+	}
+	return builder.String()
+}
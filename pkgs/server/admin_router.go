@@ -0,0 +1,525 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/go-chi/chi/v5"
+)
+
+const exportFormatVersion = 1
+
+// AdminRouter exports and imports the whole server state so that Jig can be
+// moved to another host.
+type AdminRouter struct {
+	cli         *client.Client
+	db          *sql.DB
+	backend     deploymentBackend
+	secrets     SecretStore
+	tokens      *tokenStorage
+	deployments *deploymentStore
+}
+
+func (ar AdminRouter) Router() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/export", ar.exportState)
+	r.Post("/import", ar.importState)
+	r.Get("/schema", ar.getSchema)
+	r.Post("/rotate-master-key", ar.rotateMasterKey)
+	return r
+}
+
+type exportManifest struct {
+	Version   int              `json:"version"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Images    []string         `json:"images"`
+	Volumes   []exportedVolume `json:"volumes"`
+}
+
+type exportedVolume struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	DriverOpts map[string]string `json:"driverOpts,omitempty"`
+}
+
+type exportedSecret struct {
+	Name string `json:"name"`
+	// Value is the current value, exports of older versions only have this
+	Value     string `json:"value"`
+	WriteOnly bool   `json:"writeOnly,omitempty"`
+	// Versions is the whole history, so pinned references keep resolving
+	Versions []exportedSecretVersion `json:"versions,omitempty"`
+	// Placeholder marks a write-only secret exported without its value
+	Placeholder bool `json:"placeholder,omitempty"`
+}
+
+type exportedSecretVersion struct {
+	Version   int    `json:"version"`
+	Value     string `json:"value"`
+	CreatedAt string `json:"createdAt"`
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+type exportedToken struct {
+	// Token is the plaintext secret of exports made before tokens were hashed
+	Token       string    `json:"token,omitempty"`
+	Prefix      string    `json:"prefix,omitempty"`
+	Salt        string    `json:"salt,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
+	Name        string    `json:"name"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Permissions int       `json:"permissions"`
+	Scopes      []string  `json:"scopes,omitempty"`
+	ValidUntil  time.Time `json:"validUntil"`
+}
+
+type exportedDeployment struct {
+	Name         string                               `json:"name"`
+	Kind         string                               `json:"kind"`
+	Config       jigtypes.DeploymentConfig            `json:"config"`
+	Services     map[string]jigtypes.DeploymentConfig `json:"services,omitempty"`
+	Image        string                               `json:"image"`
+	DesiredState string                               `json:"desiredState"`
+}
+
+func writeTarJson(tw *tar.Writer, name string, data any) error {
+	contents, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(contents)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = tw.Write(contents)
+	return err
+}
+
+// writeTarFromProducer spools produce into a temporary file first, tar entries
+// need their size up front.
+func writeTarFromProducer(tw *tar.Writer, name string, produce func(io.Writer) error) error {
+	spool, err := os.CreateTemp("", "jig-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if err := produce(spool); err != nil {
+		return err
+	}
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, spool)
+	return err
+}
+
+// collectSecrets returns every secret with its history. Write-only secrets are
+// only placeholders unless includeWriteOnly asks for their values, nothing
+// else on the server hands them out.
+func (ar AdminRouter) collectSecrets(includeWriteOnly bool) ([]exportedSecret, error) {
+	names, err := ar.secrets.List()
+	if err != nil {
+		return nil, err
+	}
+	secrets := []exportedSecret{}
+	for _, name := range names {
+		writeOnly, err := ar.secrets.IsWriteOnly(name)
+		if err != nil {
+			return nil, err
+		}
+		if writeOnly && !includeWriteOnly {
+			secrets = append(secrets, exportedSecret{Name: name, WriteOnly: true, Placeholder: true})
+			continue
+		}
+		value, err := ar.secrets.GetValue(name)
+		if err != nil {
+			return nil, err
+		}
+		versions, err := ar.secrets.VersionValues(name)
+		if err != nil {
+			return nil, err
+		}
+		secret := exportedSecret{Name: name, Value: value, WriteOnly: writeOnly}
+		for _, version := range versions {
+			secret.Versions = append(secret.Versions, exportedSecretVersion{
+				Version:   version.Version,
+				Value:     version.Value,
+				CreatedAt: version.CreatedAt.Format(time.RFC3339),
+				CreatedBy: version.CreatedBy,
+			})
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+func (ar AdminRouter) collectTokens() ([]exportedToken, error) {
+	tokens, err := ar.tokens.List()
+	if err != nil {
+		return nil, err
+	}
+	exported := []exportedToken{}
+	for _, token := range tokens {
+		exported = append(exported, exportedToken{
+			Prefix:      token.Prefix,
+			Salt:        token.Salt,
+			Hash:        token.Hash,
+			Name:        token.Name,
+			CreatedAt:   token.CreatedAt,
+			Permissions: token.Permissions,
+			Scopes:      token.Scopes,
+			ValidUntil:  token.ValidUntil,
+		})
+	}
+	return exported, nil
+}
+
+func (ar AdminRouter) collectDeployments() ([]exportedDeployment, error) {
+	stored, err := ar.deployments.List()
+	if err != nil {
+		return nil, err
+	}
+	exported := []exportedDeployment{}
+	for _, deployment := range stored {
+		exported = append(exported, exportedDeployment{
+			Name:         deployment.Name,
+			Kind:         deployment.Kind,
+			Config:       deployment.Config,
+			Services:     deployment.Services,
+			Image:        deployment.Image,
+			DesiredState: deployment.DesiredState,
+		})
+	}
+	return exported, nil
+}
+
+// exportState streams a gzipped tarball of the server state. Images of stored
+// deployments and the contents of Jig volumes are only included when asked
+// for, they can be large.
+func (ar AdminRouter) exportState(w http.ResponseWriter, r *http.Request) {
+	includeImages := r.URL.Query().Get("images") == "true"
+	includeVolumes := r.URL.Query().Get("volumes") == "true"
+	includeWriteOnly := r.URL.Query().Get("writeOnly") == "true"
+
+	secrets, err := ar.collectSecrets(includeWriteOnly)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tokens, err := ar.collectTokens()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deployments, err := ar.collectDeployments()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	manifest := exportManifest{Version: exportFormatVersion, CreatedAt: time.Now().UTC(), Images: []string{}, Volumes: []exportedVolume{}}
+	if includeImages {
+		for _, deployment := range deployments {
+			if deployment.Image != "" {
+				manifest.Images = append(manifest.Images, deployment.Image)
+			}
+		}
+	}
+	if includeVolumes {
+		volumes, err := listJigVolumes(ar.cli, ar.backend, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, jigVolume := range volumes {
+			manifest.Volumes = append(manifest.Volumes, exportedVolume{Name: jigVolume.Name, Driver: jigVolume.Driver, DriverOpts: jigVolume.Options})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "jig-export.tar.gz"))
+	gzipWriter := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzipWriter)
+
+	err = func() error {
+		if err := writeTarJson(tw, "manifest.json", manifest); err != nil {
+			return err
+		}
+		if err := writeTarJson(tw, "secrets.json", secrets); err != nil {
+			return err
+		}
+		if err := writeTarJson(tw, "tokens.json", tokens); err != nil {
+			return err
+		}
+		if err := writeTarJson(tw, "deployments.json", deployments); err != nil {
+			return err
+		}
+		for index, image := range manifest.Images {
+			err := writeTarFromProducer(tw, fmt.Sprintf("images/%d.tar", index), func(out io.Writer) error {
+				saved, err := ar.cli.ImageSave(context.Background(), []string{image})
+				if err != nil {
+					return err
+				}
+				defer saved.Close()
+				_, err = io.Copy(out, saved)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("export image %s: %w", image, err)
+			}
+		}
+		for _, exported := range manifest.Volumes {
+			err := writeTarFromProducer(tw, "volumes/"+exported.Name+".tar.gz", func(out io.Writer) error {
+				return backupVolume(ar.cli, exported.Name, out)
+			})
+			if err != nil {
+				return fmt.Errorf("export volume %s: %w", exported.Name, err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gzipWriter.Close()
+	}()
+	if err != nil {
+		// The response is already streaming, all we can do is cut it short
+		log.Println("Failed to export server state", err)
+	}
+}
+
+func (ar AdminRouter) rotateMasterKey(w http.ResponseWriter, r *http.Request) {
+	count, err := ar.secrets.RotateMasterKey()
+	if err != nil {
+		log.Println("Failed to rotate master key:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJson(w, http.StatusOK, jigtypes.RotateMasterKeyResponse{Secrets: count})
+}
+
+func readTarJson(tr io.Reader, target any) error {
+	return json.NewDecoder(tr).Decode(target)
+}
+
+func (ar AdminRouter) importSecrets(secrets []exportedSecret, result *jigtypes.AdminImportResult) {
+	for _, secret := range secrets {
+		if secret.Placeholder {
+			// Without a value a write-only secret can only be kept as it is
+			if _, err := ar.secrets.IsWriteOnly(secret.Name); errors.Is(err, ErrSecretNotFound) {
+				result.Errors = append(result.Errors, fmt.Sprintf("secret %s: write-only, its value was not exported, set it again with jig secrets add", secret.Name))
+			}
+			continue
+		}
+		// The history replaces the one of a secret with the same name, version
+		// numbers have to match for pinned references
+		versions := []SecretVersionValue{{SecretVersion: SecretVersion{Version: 1}, Value: secret.Value}}
+		if len(secret.Versions) > 0 {
+			versions = versions[:0]
+		}
+		for _, version := range secret.Versions {
+			createdAt, _ := time.Parse(time.RFC3339, version.CreatedAt)
+			versions = append(versions, SecretVersionValue{
+				SecretVersion: SecretVersion{Version: version.Version, CreatedAt: createdAt, CreatedBy: version.CreatedBy},
+				Value:         version.Value,
+			})
+		}
+		err := ar.secrets.ReplaceHistory(secret.Name, versions, secret.WriteOnly)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("secret %s: %s", secret.Name, err))
+			continue
+		}
+		result.Secrets++
+	}
+}
+
+func (ar AdminRouter) importTokens(tokens []exportedToken, result *jigtypes.AdminImportResult) {
+	for _, exported := range tokens {
+		token := Token{Prefix: exported.Prefix, Salt: exported.Salt, Hash: exported.Hash, Name: exported.Name, CreatedAt: exported.CreatedAt, Permissions: exported.Permissions, Scopes: exported.Scopes, ValidUntil: exported.ValidUntil}
+		if exported.Token != "" {
+			token.setSecret(exported.Token)
+			if existing, err := ar.tokens.Get(exported.Token); err == nil && existing != nil {
+				continue
+			}
+		} else if exists, err := ar.tokens.hasHash(exported.Hash); err == nil && exists {
+			continue
+		}
+		// Names are unique, like the default token of a fresh server. The token
+		// of this server is kept, it may be the one running the import
+		if existing, err := ar.tokens.GetByName(exported.Name); err != nil || existing != nil {
+			if err == nil {
+				err = errors.New("a token with this name already exists, it was kept and the imported one skipped")
+			}
+			result.Errors = append(result.Errors, fmt.Sprintf("token %s: %s", exported.Name, err))
+			continue
+		}
+		if err := token.insert(ar.tokens.db); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("token %s: %s", exported.Name, err))
+			continue
+		}
+		result.Tokens++
+	}
+}
+
+func (ar AdminRouter) importDeployments(deployments []exportedDeployment, result *jigtypes.AdminImportResult) {
+	for _, exported := range deployments {
+		err := ar.deployments.Save(storedDeployment{
+			Name:         exported.Name,
+			Kind:         exported.Kind,
+			Config:       exported.Config,
+			Services:     exported.Services,
+			Image:        exported.Image,
+			DesiredState: exported.DesiredState,
+		})
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("deployment %s: %s", exported.Name, err))
+			continue
+		}
+		result.Deployments++
+	}
+}
+
+func (ar AdminRouter) importVolume(exported exportedVolume, backup io.Reader) error {
+	if _, err := ar.cli.VolumeInspect(context.Background(), exported.Name); err != nil {
+		_, err := ar.cli.VolumeCreate(context.Background(), volume.CreateOptions{
+			Name:       exported.Name,
+			Driver:     exported.Driver,
+			DriverOpts: exported.DriverOpts,
+			Labels:     map[string]string{jigVolumeLabel: "true"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	users, err := runningVolumeUsers(ar.cli, exported.Name)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("mounted by running containers (%s)", strings.Join(users, ", "))
+	}
+	return restoreVolume(ar.cli, exported.Name, backup)
+}
+
+// importState replays an export on this server. Secrets are overwritten,
+// tokens that already exist or share a name with one are kept, and
+// deployments are recreated by the reconciler from their stored config.
+func (ar AdminRouter) importState(w http.ResponseWriter, r *http.Request) {
+	gzipReader, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, "Export is not a gzip archive", http.StatusBadRequest)
+		return
+	}
+	defer gzipReader.Close()
+
+	result := jigtypes.AdminImportResult{Errors: []string{}}
+	var manifest *exportManifest
+	tr := tar.NewReader(gzipReader)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid export archive: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if header.Name == "manifest.json" {
+			manifest = &exportManifest{}
+			if err := readTarJson(tr, manifest); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid export manifest: %s", err), http.StatusBadRequest)
+				return
+			}
+			if manifest.Version != exportFormatVersion {
+				http.Error(w, fmt.Sprintf("Unsupported export version %d", manifest.Version), http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+		if manifest == nil {
+			http.Error(w, "Export archive must start with manifest.json", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case header.Name == "secrets.json":
+			var secrets []exportedSecret
+			if err := readTarJson(tr, &secrets); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ar.importSecrets(secrets, &result)
+		case header.Name == "tokens.json":
+			var tokens []exportedToken
+			if err := readTarJson(tr, &tokens); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ar.importTokens(tokens, &result)
+		case header.Name == "deployments.json":
+			var deployments []exportedDeployment
+			if err := readTarJson(tr, &deployments); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ar.importDeployments(deployments, &result)
+		case strings.HasPrefix(header.Name, "images/"):
+			loaded, err := ar.cli.ImageLoad(context.Background(), tr, true)
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("image %s: %s", header.Name, err))
+				continue
+			}
+			io.Copy(io.Discard, loaded.Body)
+			loaded.Body.Close()
+			result.Images++
+		case strings.HasPrefix(header.Name, "volumes/"):
+			volumeName := strings.TrimSuffix(path.Base(header.Name), ".tar.gz")
+			// Volume names follow the rules of deployment names, the archive is
+			// not trusted to pick a path
+			if validateDeploymentName(volumeName) != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("volume %q: invalid name, names must match %s", volumeName, deploymentNamePattern))
+				continue
+			}
+			exported := exportedVolume{Name: volumeName}
+			for _, candidate := range manifest.Volumes {
+				if candidate.Name == volumeName {
+					exported = candidate
+				}
+			}
+			if err := ar.importVolume(exported, tr); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("volume %s: %s", volumeName, err))
+				continue
+			}
+			result.Volumes++
+		}
+	}
+	if manifest == nil {
+		http.Error(w, "Export archive is empty", http.StatusBadRequest)
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, result)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+)
+
+func newAdminTestRouter(t *testing.T, path string) AdminRouter {
+	t.Helper()
+	db, err := createOrOpenDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove(path)
+	})
+	secrets, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenStore, err := InitTokenStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployments, err := InitDeploymentStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return AdminRouter{db: db, secrets: secrets, tokens: tokenStore, deployments: deployments}
+}
+
+func TestAdminExportImportRoundTrip(t *testing.T) {
+	source := newAdminTestRouter(t, "./testing-export-source.db")
+	if err := source.secrets.InsertAs("db-password", "hunter2", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.secrets.Put("db-password", "hunter3", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.secrets.Rollback("db-password", 1, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := source.tokens.Make("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceDefault, err := source.tokens.Make("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := jigtypes.DeploymentConfig{Name: "api", Port: 8080, Envs: map[string]string{"DB_PASSWORD": "@db-password"}}
+	if err := source.deployments.Save(storedDeployment{Name: "api", Kind: storedKindContainer, Config: config, Image: "sha256:abc", DesiredState: desiredStateStopped}); err != nil {
+		t.Fatal(err)
+	}
+
+	exportRecorder := httptest.NewRecorder()
+	source.Router().ServeHTTP(exportRecorder, httptest.NewRequest(http.MethodGet, "/export", nil))
+	if exportRecorder.Code != http.StatusOK {
+		t.Fatalf("export returned %d: %s", exportRecorder.Code, exportRecorder.Body.String())
+	}
+
+	target := newAdminTestRouter(t, "./testing-export-target.db")
+	if err := target.secrets.InsertAs("db-password", "stale", "", false); err != nil {
+		t.Fatal(err)
+	}
+	for range 4 {
+		if _, err := target.secrets.Put("db-password", "staler", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	targetDefault, err := target.tokens.Make("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	importRecorder := httptest.NewRecorder()
+	target.Router().ServeHTTP(importRecorder, httptest.NewRequest(http.MethodPost, "/import", exportRecorder.Body))
+	if importRecorder.Code != http.StatusOK {
+		t.Fatalf("import returned %d: %s", importRecorder.Code, importRecorder.Body.String())
+	}
+	var result jigtypes.AdminImportResult
+	if err := json.NewDecoder(importRecorder.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Secrets != 1 || result.Tokens != 1 || result.Deployments != 1 || len(result.Errors) != 1 || !strings.HasPrefix(result.Errors[0], "token default:") {
+		t.Fatalf("unexpected import result: %+v", result)
+	}
+	// The default token of the target is kept, the imported one is reported
+	if kept, err := target.tokens.Get(targetDefault.Token); err != nil || kept == nil {
+		t.Fatalf("expected the existing default token to be kept, got %+v, %v", kept, err)
+	}
+	if skipped, err := target.tokens.Get(sourceDefault.Token); err == nil && skipped != nil {
+		t.Fatalf("expected the imported default token to be skipped, got %+v", skipped)
+	}
+
+	if value, err := target.secrets.GetValue("db-password"); err != nil || value != "hunter2" {
+		t.Fatalf("expected imported secret to overwrite the stale one, got %q, %v", value, err)
+	}
+	// Pinned references like ${@db-password:2} have to resolve as on the source
+	if current, err := target.secrets.CurrentVersion("db-password"); err != nil || current != 3 {
+		t.Fatalf("expected the imported history to end at version 3, got %d, %v", current, err)
+	}
+	if value, found, err := target.secrets.GetVersion("db-password", 2); err != nil || !found || value != "hunter3" {
+		t.Fatalf("expected version 2 to be imported, got %q, %v, %v", value, found, err)
+	}
+	if _, found, _ := target.secrets.GetVersion("db-password", 4); found {
+		t.Fatal("expected versions of the stale secret to be replaced")
+	}
+	if versions, err := target.secrets.Versions("db-password"); err != nil || len(versions) != 3 || versions[1].CreatedBy != "alice" {
+		t.Fatalf("expected authors to be imported, got %+v, %v", versions, err)
+	}
+	if imported, err := target.tokens.Get(token.Token); err != nil || imported == nil || imported.Name != "ci" {
+		t.Fatalf("expected imported token, got %+v, %v", imported, err)
+	}
+	stored, err := target.deployments.Get("api")
+	if err != nil || stored == nil {
+		t.Fatalf("expected imported deployment, got %+v, %v", stored, err)
+	}
+	if stored.Image != "sha256:abc" || stored.DesiredState != desiredStateStopped || stored.Config.Envs["DB_PASSWORD"] != "@db-password" {
+		t.Fatalf("unexpected imported deployment: %+v", stored)
+	}
+}
+
+func TestAdminImportRejectsGarbage(t *testing.T) {
+	router := newAdminTestRouter(t, "./testing-import-garbage.db")
+	recorder := httptest.NewRecorder()
+	router.Router().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/import", http.NoBody))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty body, got %d", recorder.Code)
+	}
+}
+
+func TestAdminImportVolumeNames(t *testing.T) {
+	router := newAdminTestRouter(t, "./testing-import-volumes.db")
+
+	var archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gzipWriter)
+	if err := writeTarJson(tw, "manifest.json", exportManifest{Version: exportFormatVersion}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"volumes/.hidden.tar.gz", "volumes/-rm.tar.gz"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gzipWriter.Close()
+
+	recorder := httptest.NewRecorder()
+	router.Router().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/import", &archive))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("import returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var result jigtypes.AdminImportResult
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Volumes != 0 || len(result.Errors) != 2 || !strings.Contains(result.Errors[0], "invalid name") {
+		t.Fatalf("expected invalid volume names to be refused, got %+v", result)
+	}
+}
+
+func TestAdminExportWriteOnlySecrets(t *testing.T) {
+	source := newAdminTestRouter(t, "./testing-export-write-only.db")
+	if err := source.secrets.InsertAs("signing-key", "private", "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := source.collectSecrets(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 || !secrets[0].Placeholder || secrets[0].Value != "" || len(secrets[0].Versions) != 0 {
+		t.Fatalf("expected a placeholder without a value, got %+v", secrets)
+	}
+	included, err := source.collectSecrets(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(included) != 1 || included[0].Placeholder || included[0].Value != "private" {
+		t.Fatalf("expected the value when asked for, got %+v", included)
+	}
+
+	// A placeholder keeps the secret on the target and warns when there is none
+	target := newAdminTestRouter(t, "./testing-import-write-only.db")
+	var result jigtypes.AdminImportResult
+	target.importSecrets(secrets, &result)
+	if result.Secrets != 0 || len(result.Errors) != 1 {
+		t.Fatalf("expected a warning for the missing secret, got %+v", result)
+	}
+	if err := target.secrets.InsertAs("signing-key", "kept", "", true); err != nil {
+		t.Fatal(err)
+	}
+	result = jigtypes.AdminImportResult{}
+	target.importSecrets(secrets, &result)
+	if len(result.Errors) != 0 {
+		t.Fatalf("expected no warning for an existing secret, got %+v", result)
+	}
+	if value, err := target.secrets.GetValue("signing-key"); err != nil || value != "kept" {
+		t.Fatalf("expected the existing value to be kept, got %q, %v", value, err)
+	}
+}
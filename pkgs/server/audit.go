@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const auditContextKey contextKey = "audit"
+
+// auditedReads are GET routes that are recorded anyway, since they hand out
+// secret values.
+var auditedReads = []string{"/secrets/{name}", "/secrets/export", "/admin/export"}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditLog records who changed what through the API.
+type auditLog struct {
+	db *sql.DB
+}
+
+func InitAuditLog(db *sql.DB) (*auditLog, error) {
+	if err := runMigrations(db); err != nil {
+		return nil, err
+	}
+	return &auditLog{db: db}, nil
+}
+
+// auditEntry is filled in while a request is served and recorded once the
+// response is written.
+type auditEntry struct {
+	Time   time.Time
+	Actor  string
+	Method string
+	Route  string
+	Target string
+	Status int
+}
+
+type auditFilter struct {
+	Since  time.Time
+	Actor  string
+	Target string
+	Limit  int
+}
+
+func (a *auditLog) Record(entry auditEntry) error {
+	_, err := a.db.Exec(
+		"INSERT INTO audit_log (created_at, actor, method, route, target, status) VALUES (?, ?, ?, ?, ?, ?)",
+		entry.Time.UTC().Format(time.RFC3339), entry.Actor, entry.Method, entry.Route, entry.Target, entry.Status,
+	)
+	return err
+}
+
+// List returns the newest entries matching filter first.
+func (a *auditLog) List(filter auditFilter) ([]auditEntry, error) {
+	conditions := []string{}
+	args := []any{}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.Since.UTC().Format(time.RFC3339))
+	}
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Target != "" {
+		conditions = append(conditions, "target = ?")
+		args = append(args, filter.Target)
+	}
+	query := "SELECT created_at, actor, method, route, target, status FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, filter.Limit)
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var entry auditEntry
+		var createdAt string
+		if err := rows.Scan(&createdAt, &entry.Actor, &entry.Method, &entry.Route, &entry.Target, &entry.Status); err != nil {
+			return nil, err
+		}
+		entry.Time, err = time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// auditRequests records every request that changes something, and reads of
+// secret values, with the token behind it and the response status.
+func (a *auditLog) auditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &auditEntry{Time: time.Now(), Method: r.Method}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), auditContextKey, entry)))
+
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil {
+			entry.Route = routeContext.RoutePattern()
+			if entry.Target == "" {
+				entry.Target = routeContext.URLParam("name")
+			}
+			if entry.Target == "" {
+				entry.Target = routeContext.URLParam("token")
+			}
+		}
+		if entry.Route == "" {
+			entry.Route = r.URL.Path
+		}
+		if !isAuditedRequest(r.Method, entry.Route) {
+			return
+		}
+		entry.Status = ww.Status()
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if err := a.Record(*entry); err != nil {
+			log.Println("Failed to record audit entry:", err)
+		}
+	})
+}
+
+func isAuditedRequest(method, route string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return slices.Contains(auditedReads, route)
+	}
+	return true
+}
+
+// setAuditActor names the token behind the request in its audit entry.
+func setAuditActor(ctx context.Context, actor string) {
+	if entry, ok := ctx.Value(auditContextKey).(*auditEntry); ok {
+		entry.Actor = actor
+	}
+}
+
+// setAuditTarget names what a request changes when it is not in the route,
+// for example the deployment of a deploy.
+func setAuditTarget(r *http.Request, target string) {
+	if entry, ok := r.Context().Value(auditContextKey).(*auditEntry); ok {
+		entry.Target = target
+	}
+}
+
+type AuditRouter struct {
+	log *auditLog
+}
+
+func (ar AuditRouter) Router() chi.Router {
+	router := chi.NewRouter()
+	router.Get("/", ar.listAuditEntries)
+	return router
+}
+
+// listAuditEntries answers GET /audit?since=&actor=&target=&limit=. since is
+// a time or how long ago, like 24h or 7d.
+func (ar AuditRouter) listAuditEntries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := auditFilter{Actor: query.Get("actor"), Target: query.Get("target"), Limit: defaultAuditLimit}
+	if since := query.Get("since"); since != "" {
+		if parsed, err := time.Parse(time.RFC3339, since); err == nil {
+			filter.Since = parsed
+		} else if ago, err := parseTokenDuration(since); err == nil {
+			filter.Since = time.Now().Add(-ago)
+		} else {
+			http.Error(w, "since must be an RFC3339 time or a duration like 24h or 7d", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = min(parsed, maxAuditLimit)
+	}
+
+	entries, err := ar.log.List(filter)
+	if err != nil {
+		log.Println("Failed to list audit entries:", err)
+		http.Error(w, "Failed to list audit entries", http.StatusInternalServerError)
+		return
+	}
+	response := jigtypes.AuditLogResponse{Entries: []jigtypes.AuditEntry{}}
+	for _, entry := range entries {
+		response.Entries = append(response.Entries, jigtypes.AuditEntry{
+			Time:   entry.Time.Format(time.RFC3339),
+			Actor:  entry.Actor,
+			Method: entry.Method,
+			Route:  entry.Route,
+			Target: entry.Target,
+			Status: entry.Status,
+		})
+	}
+	respondWithJson(w, http.StatusOK, response)
+}
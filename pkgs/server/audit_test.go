@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAuditLog(t *testing.T) {
+	db, err := createOrOpenDb("./testing-audit.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-audit.db")
+	audit, err := InitAuditLog(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			setAuditActor(r.Context(), r.Header.Get("X-Actor"))
+			next.ServeHTTP(w, r)
+		})
+	}
+	secrets := chi.NewRouter()
+	secrets.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+	secrets.Get("/{name}", func(w http.ResponseWriter, r *http.Request) {})
+	secrets.Delete("/{name}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Secret is used", http.StatusConflict)
+	})
+	deployments := chi.NewRouter()
+	deployments.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		setAuditTarget(r, "billing")
+		w.Write([]byte("deployed"))
+	})
+	router := chi.NewRouter()
+	router.Use(audit.auditRequests)
+	router.With(authenticate).Mount("/secrets", secrets)
+	router.With(authenticate).Mount("/deployments", deployments)
+	router.With(authenticate).Mount("/audit", AuditRouter{log: audit}.Router())
+
+	request := func(method, path, actor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-Actor", actor)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	request(http.MethodGet, "/secrets", "ci")
+	request(http.MethodGet, "/secrets/db", "ci")
+	request(http.MethodDelete, "/secrets/db", "ops")
+	request(http.MethodPost, "/deployments", "ci")
+
+	entries, err := audit.List(auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []auditEntry{
+		{Actor: "ci", Method: http.MethodPost, Route: "/deployments", Target: "billing", Status: http.StatusOK},
+		{Actor: "ops", Method: http.MethodDelete, Route: "/secrets/{name}", Target: "db", Status: http.StatusConflict},
+		{Actor: "ci", Method: http.MethodGet, Route: "/secrets/{name}", Target: "db", Status: http.StatusOK},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %+v", len(expected), entries)
+	}
+	for i, entry := range entries {
+		entry.Time = time.Time{}
+		if entry != expected[i] {
+			t.Fatalf("expected entry %d to be %+v, got %+v", i, expected[i], entry)
+		}
+	}
+
+	for query, count := range map[string]int{
+		"":                                    3,
+		"?actor=ci":                           2,
+		"?target=db":                          2,
+		"?actor=ops&target=billing":           0,
+		"?since=1h":                           3,
+		"?since=2000-01-01T00:00:00Z&limit=1": 1,
+		"?since=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339): 0,
+	} {
+		w := request(http.MethodGet, "/audit"+query, "admin")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %s to succeed, got %d: %s", query, w.Code, w.Body.String())
+		}
+		var response jigtypes.AuditLogResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Entries) != count {
+			t.Fatalf("expected %d entries for %q, got %+v", count, query, response.Entries)
+		}
+	}
+	for _, query := range []string{"?since=yesterday", "?limit=0"} {
+		if w := request(http.MethodGet, "/audit"+query, "admin"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "must be") {
+			t.Fatalf("expected %s to be rejected, got %d", query, w.Code)
+		}
+	}
+}
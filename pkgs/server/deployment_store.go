@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+)
+
+const (
+	desiredStateRunning = "running"
+	desiredStateStopped = "stopped"
+)
+
+// Kinds of stored deployments, they decide how a deployment can be recreated.
+const (
+	storedKindContainer  = "container"
+	storedKindSwarm      = "swarm"
+	storedKindCompose    = "compose"
+	storedKindSwarmStack = "swarm-stack"
+)
+
+// deploymentStore keeps the desired state of every deployment, so that the
+// config survives the containers and services it was applied to.
+type deploymentStore struct {
+	db *sql.DB
+}
+
+type storedDeployment struct {
+	Name   string
+	Kind   string
+	Config jigtypes.DeploymentConfig
+	// Services holds the merged config of every managed service of a compose
+	// deployment or swarm stack, by service name
+	Services     map[string]jigtypes.DeploymentConfig
+	Image        string
+	DesiredState string
+	UpdatedAt    time.Time
+}
+
+func InitDeploymentStore(db *sql.DB) (*deploymentStore, error) {
+	if err := runMigrations(db); err != nil {
+		return nil, err
+	}
+	return &deploymentStore{db: db}, nil
+}
+
+// Save records an applied deployment as the desired state, a new deploy always
+// means the deployment should be running.
+func (s *deploymentStore) Save(deployment storedDeployment) error {
+	configBytes, err := json.Marshal(deployment.Config)
+	if err != nil {
+		return err
+	}
+	if deployment.Services == nil {
+		deployment.Services = map[string]jigtypes.DeploymentConfig{}
+	}
+	servicesBytes, err := json.Marshal(deployment.Services)
+	if err != nil {
+		return err
+	}
+	if deployment.DesiredState == "" {
+		deployment.DesiredState = desiredStateRunning
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO deployments (name, kind, config, services, image, desired_state, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET kind = excluded.kind, config = excluded.config, services = excluded.services, image = excluded.image, desired_state = excluded.desired_state, updated_at = excluded.updated_at`,
+		deployment.Name, deployment.Kind, string(configBytes), string(servicesBytes), deployment.Image, deployment.DesiredState, time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+func (s *deploymentStore) SetDesiredState(name, state string) error {
+	_, err := s.db.Exec(
+		"UPDATE deployments SET desired_state = ?, updated_at = ? WHERE name = ?",
+		state, time.Now().UTC().Format(time.RFC3339), name,
+	)
+	return err
+}
+
+func (s *deploymentStore) Delete(name string) error {
+	_, err := s.db.Exec("DELETE FROM deployments WHERE name = ?", name)
+	return err
+}
+
+func (s *deploymentStore) Get(name string) (*storedDeployment, error) {
+	row := s.db.QueryRow("SELECT name, kind, config, services, image, desired_state, updated_at FROM deployments WHERE name = ?", name)
+	deployment, err := scanStoredDeployment(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+func (s *deploymentStore) List() ([]storedDeployment, error) {
+	rows, err := s.db.Query("SELECT name, kind, config, services, image, desired_state, updated_at FROM deployments ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deployments := []storedDeployment{}
+	for rows.Next() {
+		deployment, err := scanStoredDeployment(rows)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, *deployment)
+	}
+	return deployments, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanStoredDeployment(row rowScanner) (*storedDeployment, error) {
+	var deployment storedDeployment
+	var configString string
+	var servicesString string
+	var updatedAt string
+	if err := row.Scan(&deployment.Name, &deployment.Kind, &configString, &servicesString, &deployment.Image, &deployment.DesiredState, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(configString), &deployment.Config); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(servicesString), &deployment.Services); err != nil {
+		return nil, err
+	}
+	updatedAtTime, err := time.Parse(time.RFC3339, updatedAt)
+	if err != nil {
+		log.Printf("Failed to parse updated_at for deployment %s: %s", deployment.Name, err)
+	}
+	deployment.UpdatedAt = updatedAtTime
+	return &deployment, nil
+}
+
+// deploymentDrift describes how an observed deployment differs from the stored
+// desired state, observed is nil when Docker does not know the deployment.
+func deploymentDrift(desired storedDeployment, observed *jigtypes.Deployment) string {
+	if observed == nil {
+		return "missing"
+	}
+	switch {
+	case desired.DesiredState == desiredStateRunning && observed.Status == "stopped":
+		return "stopped unexpectedly"
+	case desired.DesiredState == desiredStateRunning && observed.Status == "unhealthy":
+		return "unhealthy"
+	case desired.DesiredState == desiredStateStopped && observed.Status == "healthy":
+		return "running unexpectedly"
+	}
+	return ""
+}
+
+// mergeDesiredDeployments annotates observed deployments with drift from the
+// desired state and adds placeholders for deployments that no longer exist.
+func mergeDesiredDeployments(observed []jigtypes.Deployment, desired []storedDeployment) []jigtypes.Deployment {
+	byName := make(map[string]int, len(observed))
+	for index, deployment := range observed {
+		byName[deployment.Name] = index
+	}
+	merged := append([]jigtypes.Deployment{}, observed...)
+	for _, stored := range desired {
+		if index, found := byName[stored.Name]; found {
+			merged[index].Drift = deploymentDrift(stored, &merged[index])
+			continue
+		}
+		kind := "service"
+		if stored.Kind == storedKindCompose || stored.Kind == storedKindSwarmStack {
+			kind = "stack"
+		}
+		merged = append(merged, jigtypes.Deployment{
+			Name:   stored.Name,
+			Kind:   kind,
+			Rule:   makeRule(stored.Config),
+			Status: "missing",
+			Drift:  deploymentDrift(stored, nil),
+		})
+	}
+	return merged
+}
+
+// recordDeployment stores config as the desired state of a deployment. Docker
+// has already been changed at this point, so failures are only logged.
+func (d *DeploymentsRouter) recordDeployment(kind string, config jigtypes.DeploymentConfig, image string) {
+	if d.store == nil {
+		return
+	}
+	if err := d.store.Save(storedDeployment{Name: config.Name, Kind: kind, Config: config, Image: image}); err != nil {
+		log.Printf("Failed to record desired state of deployment %s: %s", config.Name, err)
+	}
+}
+
+// recordStackDeployment stores a compose deployment or swarm stack together
+// with the configs of its managed services.
+func (d *DeploymentsRouter) recordStackDeployment(kind string, config jigtypes.DeploymentConfig, managedServices []composeManagedService) {
+	if d.store == nil {
+		return
+	}
+	services := map[string]jigtypes.DeploymentConfig{}
+	for _, service := range managedServices {
+		services[service.ServiceName] = service.Config
+	}
+	if err := d.store.Save(storedDeployment{Name: config.Name, Kind: kind, Config: config, Services: services}); err != nil {
+		log.Printf("Failed to record desired state of deployment %s: %s", config.Name, err)
+	}
+}
+
+func (d *DeploymentsRouter) recordDesiredState(name, state string) {
+	if d.store == nil {
+		return
+	}
+	if err := d.store.SetDesiredState(name, state); err != nil {
+		log.Printf("Failed to record desired state of deployment %s: %s", name, err)
+	}
+}
+
+func (d *DeploymentsRouter) forgetDeployment(name string) {
+	removeProjectFiles(name)
+	if d.store == nil {
+		return
+	}
+	if err := d.store.Delete(name); err != nil {
+		log.Printf("Failed to remove desired state of deployment %s: %s", name, err)
+	}
+}
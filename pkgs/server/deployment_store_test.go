@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+)
+
+func TestDeploymentStore(t *testing.T) {
+	db, err := createOrOpenDb("./testing-deployments.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-deployments.db")
+
+	store, err := InitDeploymentStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := jigtypes.DeploymentConfig{Name: "api", Port: 8080, Envs: map[string]string{"MODE": "prod"}}
+	if err := store.Save(storedDeployment{Name: "api", Kind: storedKindContainer, Config: config, Image: "sha256:1"}); err != nil {
+		t.Fatal(err)
+	}
+	config.Port = 9090
+	if err := store.Save(storedDeployment{Name: "api", Kind: storedKindContainer, Config: config, Image: "sha256:2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetDesiredState("api", desiredStateStopped); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := store.Get("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.Image != "sha256:2" || stored.Config.Port != 9090 || stored.Config.Envs["MODE"] != "prod" {
+		t.Fatalf("unexpected stored deployment: %+v", stored)
+	}
+	if stored.DesiredState != desiredStateStopped {
+		t.Fatalf("expected stopped desired state, got %q", stored.DesiredState)
+	}
+
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("expected one stored deployment, got %d", len(list))
+	}
+
+	if err := store.Delete("api"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := store.Get("api"); err != nil || stored != nil {
+		t.Fatalf("expected deployment to be deleted, got %+v, %v", stored, err)
+	}
+
+	// Compose projects are redeployed from the project kept by their last deploy
+	t.Setenv("JIG_PROJECT_FILES_DIR", t.TempDir())
+	shop := jigtypes.DeploymentConfig{Name: "shop", ComposeFile: "docker-compose.yaml"}
+	if err := store.Save(storedDeployment{Name: "shop", Kind: storedKindCompose, Config: shop}); err != nil {
+		t.Fatal(err)
+	}
+	if project, err := (&DeploymentsRouter{store: store}).storedProject("shop"); err != nil || project == nil {
+		t.Fatalf("expected shop to be redeployed as a project, got %+v, %v", project, err)
+	}
+	w := httptest.NewRecorder()
+	(&DeploymentsRouter{store: store}).Router().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/shop/redeploy", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "jig deploy") {
+		t.Fatalf("expected a project that is not kept to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMergeDesiredDeployments(t *testing.T) {
+	observed := []jigtypes.Deployment{
+		{Name: "api", Kind: "service", Status: "stopped"},
+		{Name: "flaky", Kind: "service", Status: "unhealthy"},
+		{Name: "worker", Kind: "service", Status: "stopped", Replicas: 0},
+		{Name: "web", Kind: "service", Status: "healthy"},
+		{Name: "unmanaged", Kind: "service", Status: "healthy"},
+	}
+	desired := []storedDeployment{
+		{Name: "api", Kind: storedKindContainer, DesiredState: desiredStateRunning},
+		{Name: "flaky", Kind: storedKindSwarm, DesiredState: desiredStateRunning},
+		{Name: "worker", Kind: storedKindSwarm, DesiredState: desiredStateStopped},
+		{Name: "web", Kind: storedKindContainer, DesiredState: desiredStateStopped},
+		{Name: "gone", Kind: storedKindContainer, DesiredState: desiredStateRunning, Config: jigtypes.DeploymentConfig{Name: "gone", Domain: "gone.example.test"}},
+	}
+
+	merged := mergeDesiredDeployments(observed, desired)
+	drift := map[string]string{}
+	for _, deployment := range merged {
+		drift[deployment.Name] = deployment.Drift
+	}
+	expected := map[string]string{
+		"api":       "stopped unexpectedly",
+		"flaky":     "unhealthy",
+		"worker":    "",
+		"web":       "running unexpectedly",
+		"unmanaged": "",
+		"gone":      "missing",
+	}
+	for name, want := range expected {
+		if drift[name] != want {
+			t.Fatalf("expected drift %q for %s, got %q", want, name, drift[name])
+		}
+	}
+	if merged[len(merged)-1].Status != "missing" || merged[len(merged)-1].Rule != "Host(`gone.example.test`)" {
+		t.Fatalf("unexpected placeholder for missing deployment: %+v", merged[len(merged)-1])
+	}
+}
+
+func TestPlanReconcile(t *testing.T) {
+	observed := []jigtypes.Deployment{
+		{Name: "api", Kind: "service", Status: "stopped"},
+		{Name: "flaky", Kind: "service", Status: "unhealthy"},
+		{Name: "web", Kind: "service", Status: "healthy"},
+	}
+	desired := []storedDeployment{
+		{Name: "api", Kind: storedKindContainer, DesiredState: desiredStateRunning},
+		{Name: "flaky", Kind: storedKindContainer, DesiredState: desiredStateRunning},
+		{Name: "web", Kind: storedKindContainer, DesiredState: desiredStateRunning},
+		{Name: "gone", Kind: storedKindSwarm, DesiredState: desiredStateRunning},
+		{Name: "paused", Kind: storedKindContainer, DesiredState: desiredStateStopped},
+		{Name: "stack", Kind: storedKindCompose, DesiredState: desiredStateRunning},
+	}
+
+	steps := planReconcile(desired, observed)
+	if len(steps) != 2 {
+		t.Fatalf("expected two reconcile steps, got %+v", steps)
+	}
+	if steps[0].deployment.Name != "api" || steps[0].action != reconcileStart {
+		t.Fatalf("expected api to be started, got %+v", steps[0])
+	}
+	if steps[1].deployment.Name != "gone" || steps[1].action != reconcileRecreate {
+		t.Fatalf("expected gone to be recreated, got %+v", steps[1])
+	}
+}
+
+func TestSecretDependencyIndex(t *testing.T) {
+	following := jigtypes.DeploymentConfig{RestartOnSecretChange: true, Envs: map[string]string{"DB": "@db"}}
+	deployments := []storedDeployment{
+		{Name: "api", Kind: storedKindContainer, DesiredState: desiredStateRunning, Config: jigtypes.DeploymentConfig{
+			RestartOnSecretChange: true,
+			Envs:                  map[string]string{"DB": "@db", "URL": "postgres://app:${@db}@${@host}/app"},
+		}},
+		{Name: "worker", Kind: storedKindSwarm, DesiredState: desiredStateRunning, Config: jigtypes.DeploymentConfig{
+			Envs: map[string]string{"DB": "@db"},
+		}},
+		{Name: "pinned", Kind: storedKindContainer, DesiredState: desiredStateRunning, Config: jigtypes.DeploymentConfig{
+			RestartOnSecretChange: true,
+			Envs:                  map[string]string{"DB": "@db:2", "LITERAL": "$${@db}"},
+		}},
+		{Name: "paused", Kind: storedKindContainer, DesiredState: desiredStateStopped, Config: following},
+		{Name: "stack", Kind: storedKindCompose, DesiredState: desiredStateRunning, Config: following},
+	}
+
+	index := secretDependencyIndex(deployments)
+	names := func(deployments []storedDeployment) []string {
+		result := []string{}
+		for _, deployment := range deployments {
+			result = append(result, deployment.Name)
+		}
+		return result
+	}
+	if got := names(index["db"]); len(got) != 4 || got[0] != "api" || got[1] != "worker" {
+		t.Fatalf("expected api, worker, paused and stack to depend on db, got %v", got)
+	}
+	if got := names(index["host"]); len(got) != 1 || got[0] != "api" {
+		t.Fatalf("expected api to depend on host, got %v", got)
+	}
+	if _, found := index["db:2"]; found {
+		t.Fatal("expected pinned references to be left out")
+	}
+
+	if got := names(secretRestartTargets(index["db"])); len(got) != 1 || got[0] != "api" {
+		t.Fatalf("expected only api to be restarted, got %v", got)
+	}
+}
+
+func TestLabeledDeploymentUsages(t *testing.T) {
+	api := jigtypes.DeploymentConfig{Name: "api", Envs: map[string]string{"DB": "@db"}}
+	apiLabels := makeContainerLabels(api)
+	maps.Copy(apiLabels, makeLabels(api))
+	labelSets := []map[string]string{
+		apiLabels,
+		makeComposeContainerLabels(composeManagedService{StackName: "shop", DisplayName: "web", Config: jigtypes.DeploymentConfig{Name: "shop-web", Envs: map[string]string{"DB": "${@db}"}}}),
+		makeComposeContainerLabels(composeManagedService{StackName: "shop", DisplayName: "worker", Config: jigtypes.DeploymentConfig{Name: "shop-worker"}}),
+		makeSwarmStackServiceLabels(composeManagedService{StackName: "queue", DisplayName: "broker", Config: jigtypes.DeploymentConfig{Name: "queue-broker", SecretFiles: map[string]string{"/run/db": "@db:1"}}}),
+		{"jig.name": "broken", "jig.config": "{"},
+	}
+
+	usages := secretUsages(labeledDeployments(labelSets), "db")
+	expected := []jigtypes.SecretUsage{
+		{Deployment: "api", Kind: storedKindContainer},
+		{Deployment: "shop", Service: "web", Kind: storedKindCompose},
+		{Deployment: "queue", Service: "broker", Kind: storedKindSwarmStack},
+	}
+	if len(usages) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, usages)
+	}
+	for index, usage := range usages {
+		if usage != expected[index] {
+			t.Fatalf("expected %+v, got %+v", expected, usages)
+		}
+	}
+}
+
+func TestSecretUsages(t *testing.T) {
+	db, err := createOrOpenDb("./testing-secret-usage.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-secret-usage.db")
+
+	store, err := InitDeploymentStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretStore, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployments := &DeploymentsRouter{store: store, secret_db: secretStore}
+
+	saved := []storedDeployment{
+		{Name: "api", Kind: storedKindContainer, Config: jigtypes.DeploymentConfig{Envs: map[string]string{"URL": "postgres://app:${@db}@db/app"}}},
+		{Name: "pinned", Kind: storedKindSwarm, Config: jigtypes.DeploymentConfig{SecretFiles: map[string]string{"/run/db": "@db:2"}}},
+		{Name: "shop", Kind: storedKindCompose, Config: jigtypes.DeploymentConfig{Name: "shop"}, Services: map[string]jigtypes.DeploymentConfig{
+			"web":    {Envs: map[string]string{"DB": "@db"}},
+			"worker": {Envs: map[string]string{"DB": "@other"}},
+		}},
+		{Name: "external", Kind: storedKindContainer, Config: jigtypes.DeploymentConfig{Envs: map[string]string{"DB": "@vault:secret/db#password"}}},
+	}
+	for _, deployment := range saved {
+		if err := store.Save(deployment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usages, err := deployments.secretUsage("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []jigtypes.SecretUsage{
+		{Deployment: "api", Kind: storedKindContainer},
+		{Deployment: "pinned", Kind: storedKindSwarm},
+		{Deployment: "shop", Service: "web", Kind: storedKindCompose},
+	}
+	if len(usages) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, usages)
+	}
+	for index, usage := range usages {
+		if usage != expected[index] {
+			t.Fatalf("expected %+v, got %+v", expected, usages)
+		}
+	}
+
+	if err := secretStore.Insert("db", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	router := SecretRouter{secret_db: secretStore, deployments: deployments}.Router()
+	remove := func(path string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, path, nil))
+		return w.Code
+	}
+	if code := remove("/db"); code != http.StatusConflict {
+		t.Fatalf("expected deleting a used secret to conflict, got %d", code)
+	}
+	if _, found, _ := secretStore.Get("db"); !found {
+		t.Fatal("expected the secret to survive a refused deletion")
+	}
+	// A token scoped to api can not change a secret that shop also uses
+	scoped := &Token{Name: "api-ci", Permissions: permissionsDefault, Scopes: []string{"api"}}
+	scopedRequest := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), tokenContextKey, scoped))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, request := range []struct {
+		method, path, body string
+		expected           int
+	}{
+		{http.MethodPut, "/db", `{"value":"stolen"}`, http.StatusForbidden},
+		{http.MethodPost, "/db/rollback", `{"version":1}`, http.StatusForbidden},
+		{http.MethodDelete, "/db?force=true", "", http.StatusForbidden},
+		{http.MethodPost, "/batch", `{"secrets":{"db":"stolen"},"overwrite":true}`, http.StatusForbidden},
+		{http.MethodPut, "/unused", `{"value":"fresh"}`, http.StatusOK},
+	} {
+		if code := scopedRequest(request.method, request.path, request.body); code != request.expected {
+			t.Fatalf("expected %s %s to return %d, got %d", request.method, request.path, request.expected, code)
+		}
+	}
+	if value, _, _ := secretStore.Get("db"); value != "secret" {
+		t.Fatalf("expected the secret to keep its value, got %q", value)
+	}
+
+	if code := remove("/db?force=true"); code != http.StatusNoContent {
+		t.Fatalf("expected a forced deletion to succeed, got %d", code)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
@@ -38,30 +39,164 @@ import (
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-func makeEnvs(newenvs map[string]string, secretDb *Secrets) ([]string, error) {
+// parseSecretReference splits a secret reference like "db_password:3" into the
+// secret name and the pinned version. Unpinned references return version 0.
+func parseSecretReference(reference string) (string, int) {
+	index := strings.LastIndex(reference, ":")
+	if index == -1 {
+		return reference, 0
+	}
+	version, err := strconv.Atoi(reference[index+1:])
+	if err != nil || version < 1 {
+		return reference, 0
+	}
+	return reference[:index], version
+}
+
+// resolveSecretReference looks up a secret reference without the leading @,
+// honouring a pinned version like "db_password:3". References with a provider
+// scheme like "vault:secret/app#password" are read from that provider.
+func resolveSecretReference(secretDb SecretStore, reference string) (string, error) {
+	if scheme, path, key, version, ok := parseProviderReference(reference); ok {
+		value, err := lookupProviderSecret(secretDb, scheme, path, key, version)
+		if err != nil {
+			return "", fmt.Errorf("@%s: %w", reference, err)
+		}
+		// Output is redacted with the values of store secrets, these have to
+		// join them
+		secretDb.TrackResolved(value)
+		return value, nil
+	}
+	var secretValue string
+	var found bool
+	var err error
+	if name, version := parseSecretReference(reference); version > 0 {
+		secretValue, found, err = secretDb.GetVersion(name, version)
+	} else {
+		secretValue, found, err = secretDb.Get(name)
+	}
+	if err != nil {
+		return "", errors.New("Failed to get secret value: @" + reference)
+	}
+	if !found {
+		return "", errors.New("Secret not found: @" + reference)
+	}
+	return secretValue, nil
+}
+
+// interpolateSecrets replaces every ${@reference} in value with the result of
+// lookup. $${ is an escape for a literal ${, any other $ is kept as is.
+func interpolateSecrets(value string, lookup func(reference string) (string, error)) (string, error) {
+	return interpolateSecretsEscaped(value, lookup, "${")
+}
+
+// interpolateComposeSecrets is interpolateSecrets for values that compose
+// interpolates once more. $${ is left as it is, compose reads it as a literal
+// ${ too, and the secret values are escaped.
+func interpolateComposeSecrets(value string, lookup func(reference string) (string, error)) (string, error) {
+	return interpolateSecretsEscaped(value, func(reference string) (string, error) {
+		secretValue, err := lookup(reference)
+		return escapeComposeInterpolation(secretValue), err
+	}, "$${")
+}
+
+// interpolateSecretsEscaped writes literal for every $${ escape.
+func interpolateSecretsEscaped(value string, lookup func(reference string) (string, error), literal string) (string, error) {
+	if !strings.Contains(value, "${") {
+		return value, nil
+	}
+	var builder strings.Builder
+	for {
+		index := strings.Index(value, "${")
+		if index == -1 {
+			builder.WriteString(value)
+			return builder.String(), nil
+		}
+		if index > 0 && value[index-1] == '$' {
+			builder.WriteString(value[:index-1] + literal)
+			value = value[index+2:]
+			continue
+		}
+		builder.WriteString(value[:index])
+		value = value[index+2:]
+		if !strings.HasPrefix(value, "@") {
+			// Not a secret reference, leave it for the application
+			builder.WriteString("${")
+			continue
+		}
+		end := strings.Index(value, "}")
+		if end == -1 {
+			return "", fmt.Errorf("unterminated secret reference in %q", "${"+value)
+		}
+		reference := value[1:end]
+		if reference == "" {
+			return "", errors.New("empty secret reference ${@}")
+		}
+		secretValue, err := lookup(reference)
+		if err != nil {
+			return "", err
+		}
+		builder.WriteString(secretValue)
+		value = value[end+1:]
+	}
+}
+
+// makeEnvs resolves env values into KEY=value pairs. A value starting with @ is
+// replaced by the secret as a whole, other values can embed secrets with
+// ${@name}.
+func makeEnvs(newenvs map[string]string, secretDb SecretStore) ([]string, error) {
+	return resolveEnvs(newenvs, secretDb, false)
+}
+
+// resolveEnvs is makeEnvs, with the values prepared for a compose file when
+// forCompose is set.
+func resolveEnvs(newenvs map[string]string, secretDb SecretStore, forCompose bool) ([]string, error) {
+	lookup := func(reference string) (string, error) {
+		return resolveSecretReference(secretDb, reference)
+	}
+	interpolate := interpolateSecrets
+	if forCompose {
+		interpolate = interpolateComposeSecrets
+	}
 	resolvedEnvs := []string{}
 	for key, value := range newenvs {
+		var err error
 		if strings.HasPrefix(value, "@") {
-			secretValue, found, err := secretDb.Get(value[1:])
-			if !found {
-				return nil, errors.New("Secret not found: " + value)
+			value, err = lookup(value[1:])
+			if forCompose {
+				value = escapeComposeInterpolation(value)
 			}
-			if err != nil {
-				return nil, errors.New("Failed to get secret value: " + value)
-			}
-			value = secretValue
+		} else {
+			value, err = interpolate(value, lookup)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %w", key, err)
 		}
 		resolvedEnvs = append(resolvedEnvs, key+"="+value)
 	}
 	return resolvedEnvs, nil
 }
 
-func makeEnvMap(newenvs map[string]string, secretDb *Secrets) (map[string]string, error) {
+func makeEnvMap(newenvs map[string]string, secretDb SecretStore) (map[string]string, error) {
 	resolvedEnvs, err := makeEnvs(newenvs, secretDb)
 	if err != nil {
 		return nil, err
 	}
+	return splitEnvs(resolvedEnvs)
+}
+
+// makeComposeEnvMap resolves env values for a compose file. Only the secret
+// values are escaped, so compose still interpolates the rest like it does for
+// the environment of unmanaged services.
+func makeComposeEnvMap(newenvs map[string]string, secretDb SecretStore) (map[string]string, error) {
+	resolvedEnvs, err := resolveEnvs(newenvs, secretDb, true)
+	if err != nil {
+		return nil, err
+	}
+	return splitEnvs(resolvedEnvs)
+}
 
+func splitEnvs(resolvedEnvs []string) (map[string]string, error) {
 	envMap := make(map[string]string, len(resolvedEnvs))
 	for _, env := range resolvedEnvs {
 		key, value, found := strings.Cut(env, "=")
@@ -85,6 +220,16 @@ func makeRule(config jigtypes.DeploymentConfig) string {
 	}
 }
 
+func deploymentConfigFromLabels(labels map[string]string) (jigtypes.DeploymentConfig, error) {
+	var config jigtypes.DeploymentConfig
+	if configString := labels["jig.config"]; configString != "" {
+		if err := json.Unmarshal([]byte(configString), &config); err != nil {
+			return jigtypes.DeploymentConfig{}, err
+		}
+	}
+	return config, nil
+}
+
 func deploymentRuleFromLabels(labels map[string]string) string {
 	name := labels["jig.name"]
 	if name == "" {
@@ -211,6 +356,27 @@ func makeVolumeMounts(config jigtypes.DeploymentConfig) ([]mount.Mount, error) {
 			Target: parts[1],
 		})
 	}
+	for _, volume := range config.NamedVolumes {
+		if volume.Name == "" || volume.Target == "" {
+			return nil, errors.New("Named volumes require a name and a target")
+		}
+		volumeOptions := &mount.VolumeOptions{
+			Labels: map[string]string{jigVolumeLabel: "true"},
+		}
+		if volume.Driver != "" || len(volume.DriverOpts) > 0 {
+			volumeOptions.DriverConfig = &mount.Driver{
+				Name:    volume.Driver,
+				Options: volume.DriverOpts,
+			}
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:          mount.TypeVolume,
+			Source:        volume.Name,
+			Target:        volume.Target,
+			ReadOnly:      volume.ReadOnly,
+			VolumeOptions: volumeOptions,
+		})
+	}
 	return mounts, nil
 }
 
@@ -287,6 +453,17 @@ func makeSwarmConstraints(config jigtypes.DeploymentConfig) ([]string, error) {
 	return constraints, nil
 }
 
+// deploymentNamePattern is what docker accepts as a container name. Names are
+// also used as directory names on the host, so nothing else may get through.
+var deploymentNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func validateDeploymentName(name string) error {
+	if !deploymentNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid deployment name %q, names must match %s", name, deploymentNamePattern)
+	}
+	return nil
+}
+
 func validateSwarmConfig(config jigtypes.DeploymentConfig) error {
 	if len(config.Volumes) > 0 && len(config.Placement.RequiredNodeLabels) == 0 {
 		return errors.New("Swarm deployments with bind mounts require placement.requiredNodeLabels")
@@ -340,6 +517,12 @@ func yamlQuote(value string) string {
 	return strconv.Quote(value)
 }
 
+// escapeComposeInterpolation keeps compose from expanding $ in text that jig
+// has already resolved, such as secret values and generated paths.
+func escapeComposeInterpolation(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
 type composeProject struct {
 	Services map[string]composeProjectService `yaml:"services"`
 }
@@ -356,6 +539,7 @@ type composeManagedService struct {
 	DisplayName string
 	Config      jigtypes.DeploymentConfig
 	Envs        map[string]string
+	SecretFiles []secretFile
 }
 
 func mergeEnvMaps(base, override map[string]string) map[string]string {
@@ -402,12 +586,16 @@ func mergeDeploymentConfig(base, override jigtypes.DeploymentConfig, defaultName
 		merged.ComposeService = override.ComposeService
 	}
 	merged.Envs = mergeEnvMaps(base.Envs, override.Envs)
+	merged.SecretFiles = mergeEnvMaps(base.SecretFiles, override.SecretFiles)
 	if override.ExposePorts != nil {
 		merged.ExposePorts = override.ExposePorts
 	}
 	if override.Volumes != nil {
 		merged.Volumes = override.Volumes
 	}
+	if override.NamedVolumes != nil {
+		merged.NamedVolumes = override.NamedVolumes
+	}
 	if override.Middlewares != (jigtypes.DeploymentMiddleares{}) {
 		merged.Middlewares = override.Middlewares
 	}
@@ -415,7 +603,10 @@ func mergeDeploymentConfig(base, override jigtypes.DeploymentConfig, defaultName
 }
 
 func validateComposeManagedConfig(config jigtypes.DeploymentConfig) error {
-	if len(config.Volumes) > 0 {
+	if err := validateDeploymentName(config.Name); err != nil {
+		return err
+	}
+	if len(config.Volumes) > 0 || len(config.NamedVolumes) > 0 {
 		return errors.New("Compose deployments must configure volumes in the compose file")
 	}
 	if len(config.ExposePorts) > 0 {
@@ -439,7 +630,7 @@ func loadComposeProject(workdir, composeFile string) (composeProject, error) {
 	return project, nil
 }
 
-func collectManagedComposeServices(project composeProject, baseConfig jigtypes.DeploymentConfig, secretDB *Secrets) ([]composeManagedService, error) {
+func collectManagedComposeServices(project composeProject, baseConfig jigtypes.DeploymentConfig, secretDB SecretStore) ([]composeManagedService, error) {
 	serviceNames := make([]string, 0, len(project.Services))
 	for serviceName := range project.Services {
 		serviceNames = append(serviceNames, serviceName)
@@ -453,6 +644,7 @@ func collectManagedComposeServices(project composeProject, baseConfig jigtypes.D
 	baseDefaults.Port = 0
 	baseDefaults.ExposePorts = nil
 	baseDefaults.Volumes = nil
+	baseDefaults.NamedVolumes = nil
 
 	managed := []composeManagedService{}
 	seenNames := map[string]string{}
@@ -482,7 +674,11 @@ func collectManagedComposeServices(project composeProject, baseConfig jigtypes.D
 		}
 		seenNames[displayName] = serviceName
 
-		envs, err := makeEnvMap(config.Envs, secretDB)
+		envs, err := makeComposeEnvMap(config.Envs, secretDB)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", serviceName, err)
+		}
+		files, err := makeSecretFiles(config.SecretFiles, secretDB)
 		if err != nil {
 			return nil, fmt.Errorf("service %s: %w", serviceName, err)
 		}
@@ -493,14 +689,15 @@ func collectManagedComposeServices(project composeProject, baseConfig jigtypes.D
 			DisplayName: displayName,
 			Config:      config,
 			Envs:        envs,
+			SecretFiles: files,
 		})
 	}
 
 	return managed, nil
 }
 
-func legacyComposeManagedService(baseConfig jigtypes.DeploymentConfig, services []string, secretDB *Secrets) ([]composeManagedService, error) {
-	if len(baseConfig.Volumes) > 0 {
+func legacyComposeManagedService(baseConfig jigtypes.DeploymentConfig, services []string, secretDB SecretStore) ([]composeManagedService, error) {
+	if len(baseConfig.Volumes) > 0 || len(baseConfig.NamedVolumes) > 0 {
 		return nil, errors.New("Compose deployments must configure volumes in the compose file")
 	}
 	if baseConfig.Port != 0 {
@@ -514,7 +711,11 @@ func legacyComposeManagedService(baseConfig jigtypes.DeploymentConfig, services
 	if err != nil {
 		return nil, err
 	}
-	envMap, err := makeEnvMap(baseConfig.Envs, secretDB)
+	envMap, err := makeComposeEnvMap(baseConfig.Envs, secretDB)
+	if err != nil {
+		return nil, err
+	}
+	files, err := makeSecretFiles(baseConfig.SecretFiles, secretDB)
 	if err != nil {
 		return nil, err
 	}
@@ -527,6 +728,7 @@ func legacyComposeManagedService(baseConfig jigtypes.DeploymentConfig, services
 	config.Port = 0
 	config.ExposePorts = nil
 	config.Volumes = nil
+	config.NamedVolumes = nil
 
 	return []composeManagedService{{
 		StackName:   baseConfig.Name,
@@ -534,9 +736,20 @@ func legacyComposeManagedService(baseConfig jigtypes.DeploymentConfig, services
 		DisplayName: primaryService,
 		Config:      config,
 		Envs:        envMap,
+		SecretFiles: files,
 	}}, nil
 }
 
+// composeManagedServices returns the services of project configured by x-jig
+// blocks, or the primary service of a project without them.
+func composeManagedServices(project composeProject, baseConfig jigtypes.DeploymentConfig, services []string, secretDB SecretStore) ([]composeManagedService, error) {
+	managedServices, err := collectManagedComposeServices(project, baseConfig, secretDB)
+	if err != nil || len(managedServices) > 0 {
+		return managedServices, err
+	}
+	return legacyComposeManagedService(baseConfig, services, secretDB)
+}
+
 func makeComposeOverride(managedServices []composeManagedService) string {
 	var builder strings.Builder
 	builder.WriteString("services:\n")
@@ -561,6 +774,15 @@ func makeComposeOverride(managedServices []composeManagedService) string {
 				builder.WriteString("      " + yamlQuote(key) + ": " + yamlQuote(service.Envs[key]) + "\n")
 			}
 		}
+		if len(service.SecretFiles) > 0 {
+			builder.WriteString("    volumes:\n")
+			for _, file := range service.SecretFiles {
+				builder.WriteString("      - type: bind\n")
+				builder.WriteString("        source: " + yamlQuote(escapeComposeInterpolation(secretFileHostPath(service.Config.Name, file))) + "\n")
+				builder.WriteString("        target: " + yamlQuote(escapeComposeInterpolation(file.Target)) + "\n")
+				builder.WriteString("        read_only: true\n")
+			}
+		}
 
 		labels := makeComposeContainerLabels(service)
 		if len(labels) > 0 {
@@ -708,6 +930,7 @@ func makeSwarmStackRestartPolicy(config jigtypes.DeploymentConfig) (map[string]a
 
 func makeSwarmStackOverride(managedServices []composeManagedService) (string, error) {
 	servicesConfig := map[string]any{}
+	secretsConfig := map[string]any{}
 	services := append([]composeManagedService{}, managedServices...)
 	slices.SortFunc(services, func(a, b composeManagedService) int {
 		return strings.Compare(a.ServiceName, b.ServiceName)
@@ -721,6 +944,20 @@ func makeSwarmStackOverride(managedServices []composeManagedService) (string, er
 		if len(service.Envs) > 0 {
 			serviceConfig["environment"] = service.Envs
 		}
+		if len(service.SecretFiles) > 0 {
+			secrets := []map[string]any{}
+			for _, file := range service.SecretFiles {
+				name := swarmSecretName(service.Config.Name, file)
+				// The secrets are created by the server before the stack is deployed
+				secretsConfig[name] = map[string]any{"external": true}
+				secrets = append(secrets, map[string]any{
+					"source": name,
+					"target": escapeComposeInterpolation(file.Target),
+					"mode":   0444,
+				})
+			}
+			serviceConfig["secrets"] = secrets
+		}
 		serviceConfig["networks"] = map[string]any{
 			"jig": map[string]any{
 				"aliases": []string{internalHostname(service.Config)},
@@ -759,6 +996,9 @@ func makeSwarmStackOverride(managedServices []composeManagedService) (string, er
 			},
 		},
 	}
+	if len(secretsConfig) > 0 {
+		overrideConfig["secrets"] = secretsConfig
+	}
 	output, err := yaml.Marshal(overrideConfig)
 	if err != nil {
 		return "", err
@@ -1029,18 +1269,35 @@ func (d *DeploymentsRouter) deployCompose(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	managedServices, err := collectManagedComposeServices(project, config, d.secret_db)
+	// @file: references are read from the upload, and kept for later restarts
+	projectSecrets := secretsForProject(d.secret_db, tempDir)
+	managedServices, err := composeManagedServices(project, config, services, projectSecrets)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if len(managedServices) == 0 {
-		managedServices, err = legacyComposeManagedService(config, services, d.secret_db)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+	// x-jig blocks can rename services, they must stay inside the token scopes
+	for _, service := range managedServices {
+		if !canAccessDeployment(r, service.Config.Name) {
+			http.Error(w, "Token is not scoped to deployment "+service.Config.Name, http.StatusForbidden)
 			return
 		}
 	}
+	fileSecrets := fileSecretPaths(config.Envs, config.SecretFiles)
+	for _, service := range managedServices {
+		fileSecrets = append(fileSecrets, fileSecretPaths(service.Config.Envs, service.Config.SecretFiles)...)
+	}
+	// Redeploys render the kept project again, @file: references included
+	if _, err := readProjectFiles(tempDir, fileSecrets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stagedFiles, err := stageProjectDir(tempDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(stagedFiles)
 
 	if d.usesSwarm() {
 		w.Header().Set("Content-Type", "text/plain")
@@ -1049,15 +1306,18 @@ func (d *DeploymentsRouter) deployCompose(w http.ResponseWriter, r *http.Request
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		buildOverridePath := ""
+		buildOverrideFile := ""
 		if buildOverrideContents != "" {
-			buildOverridePath = filepath.Join(tempDir, ".jig.stack.build.yaml")
-			if err := os.WriteFile(buildOverridePath, []byte(buildOverrideContents), 0644); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			buildOverrideFile = swarmBuildOverrideFile
+			// The kept project references the pushed images, redeploys do not build
+			for _, dir := range []string{tempDir, stagedFiles} {
+				if err := os.WriteFile(filepath.Join(dir, buildOverrideFile), []byte(buildOverrideContents), 0644); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
 			}
 
-			buildArgs := []string{"-p", config.Name, "-f", config.ComposeFile, "-f", filepath.Base(buildOverridePath), "build"}
+			buildArgs := []string{"-p", config.Name, "-f", config.ComposeFile, "-f", buildOverrideFile, "build"}
 			writeResponseLine(w, "Building images")
 			if err := runDockerCommandStreaming(tempDir, makeDeployOutputFilter(w, config.Name, verbose), append([]string{"compose"}, buildArgs...)...); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1072,72 +1332,114 @@ func (d *DeploymentsRouter) deployCompose(w http.ResponseWriter, r *http.Request
 			}
 		}
 
-		overridePath := filepath.Join(tempDir, ".jig.stack.override.yaml")
 		overrideContents, err := makeSwarmStackOverride(managedServices)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := os.WriteFile(overridePath, []byte(overrideContents), 0644); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		sanitizedComposeFile, err := writeSanitizedSwarmComposeFile(tempDir, config.ComposeFile)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		stackArgs := []string{"stack", "deploy", "--detach=true", "-c", sanitizedComposeFile}
-		if buildOverridePath != "" {
-			stackArgs = append(stackArgs, "-c", filepath.Base(buildOverridePath))
-		}
-		stackArgs = append(stackArgs, "-c", filepath.Base(overridePath), config.Name)
 
 		writeResponseLine(w, "Deploying stack")
-		if err := runDockerCommandStreaming(tempDir, makeDeployOutputFilter(w, config.Name, verbose), stackArgs...); err != nil {
+		if err := d.deployStack(tempDir, config, buildOverrideFile, overrideContents, managedServices, makeDeployOutputFilter(w, config.Name, verbose)); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		keepProjectFiles(config.Name, stagedFiles)
+		d.recordStackDeployment(storedKindSwarmStack, config, managedServices)
 		writeResponseLine(w, "Stack updated")
 		return
 	}
 
+	output, err := d.upComposeProject(tempDir, config, managedServices, "--build")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	keepProjectFiles(config.Name, stagedFiles)
+	d.recordStackDeployment(storedKindCompose, config, managedServices)
+
+	w.Header().Set("Content-Type", "text/plain")
+	if len(output) > 0 {
+		w.Write(output)
+	}
+}
+
+// swarmBuildOverrideFile points the services of a stack that compose builds
+// at the images pushed to the swarm registry.
+const swarmBuildOverrideFile = ".jig.stack.build.yaml"
+
+// deployStack runs docker stack deploy for the compose project in workdir,
+// with the images of buildOverrideFile when it is set.
+func (d *DeploymentsRouter) deployStack(workdir string, config jigtypes.DeploymentConfig, buildOverrideFile, overrideContents string, managedServices []composeManagedService, onLine func(string)) error {
+	overridePath := filepath.Join(workdir, ".jig.stack.override.yaml")
+	if err := os.WriteFile(overridePath, []byte(overrideContents), 0644); err != nil {
+		return err
+	}
+
+	sanitizedComposeFile, err := writeSanitizedSwarmComposeFile(workdir, config.ComposeFile)
+	if err != nil {
+		return err
+	}
+
+	stackArgs := []string{"stack", "deploy", "--detach=true", "-c", sanitizedComposeFile}
+	if buildOverrideFile != "" {
+		stackArgs = append(stackArgs, "-c", buildOverrideFile)
+	}
+	stackArgs = append(stackArgs, "-c", filepath.Base(overridePath), config.Name)
+
+	for _, service := range managedServices {
+		if _, err := ensureSwarmSecrets(d.cli, service.Config.Name, service.SecretFiles); err != nil {
+			return err
+		}
+	}
+
+	if err := runDockerCommandStreaming(workdir, onLine, stackArgs...); err != nil {
+		return err
+	}
+	for _, service := range managedServices {
+		pruneSwarmSecrets(d.cli, service.Config.Name)
+	}
+	return nil
+}
+
+// upComposeProject replaces the containers of the managed services with the
+// ones compose creates from the project in workdir.
+func (d *DeploymentsRouter) upComposeProject(workdir string, config jigtypes.DeploymentConfig, managedServices []composeManagedService, upArgs ...string) ([]byte, error) {
 	for _, service := range managedServices {
 		if _, err := removeDeploymentContainers(d.cli, service.Config.Name); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
+		}
+		if _, err := writeSecretFiles(service.Config.Name, service.SecretFiles); err != nil {
+			return nil, err
 		}
 	}
 
-	overridePath := filepath.Join(tempDir, ".jig.compose.override.yaml")
+	overridePath := filepath.Join(workdir, ".jig.compose.override.yaml")
 	overrideContents := makeComposeOverride(managedServices)
 	if err := os.WriteFile(overridePath, []byte(overrideContents), 0644); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	output, err := runComposeCommand(tempDir, "-p", config.Name, "-f", config.ComposeFile, "-f", filepath.Base(overridePath), "up", "-d", "--build", "--remove-orphans")
+	args := []string{"-p", config.Name, "-f", config.ComposeFile, "-f", filepath.Base(overridePath), "up", "-d"}
+	args = append(args, upArgs...)
+	output, err := runComposeCommand(workdir, append(args, "--remove-orphans")...)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	if err := connectManagedComposeServicesToNetwork(d.cli, config.Name, managedServices); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
-	w.Header().Set("Content-Type", "text/plain")
-	if len(output) > 0 {
-		w.Write(output)
+	for _, service := range managedServices {
+		pruneSecretFiles(d.cli, service.Config.Name)
 	}
+	return output, nil
 }
 
 type DeploymentsRouter struct {
 	cli       *client.Client
-	secret_db *Secrets
+	secret_db SecretStore
+	store     *deploymentStore
 	backend   deploymentBackend
 }
 
@@ -1169,9 +1471,18 @@ func deploymentRepresentativeScore(name string, container types.Container) int {
 	return score
 }
 
-func deploymentHealth(state string) string {
-	if state == "running" {
+// deploymentHealth reports a container that is not running as stopped, like a
+// stopped swarm service. Running containers with a failing health check,
+// restarting and paused ones are unhealthy.
+func deploymentHealth(container types.Container) string {
+	switch container.State {
+	case "running":
+		if strings.Contains(container.Status, "(unhealthy)") {
+			return "unhealthy"
+		}
 		return "healthy"
+	case "created", "exited", "dead":
+		return "stopped"
 	}
 	return "unhealthy"
 }
@@ -1306,6 +1617,9 @@ func buildDeployments(containers []types.Container) []jigtypes.Deployment {
 }
 
 func swarmDeploymentHealth(service swarm.Service) string {
+	if service.Spec.Labels[stoppedReplicasLabel] != "" {
+		return "stopped"
+	}
 	if service.ServiceStatus != nil {
 		if service.ServiceStatus.DesiredTasks > 0 && service.ServiceStatus.RunningTasks == service.ServiceStatus.DesiredTasks {
 			return "healthy"
@@ -1337,7 +1651,7 @@ func deploymentFromContainer(container types.Container, name string, hasRollback
 		Name:        name,
 		Kind:        "service",
 		Rule:        deploymentRuleFromLabels(container.Labels),
-		Status:      deploymentHealth(container.State),
+		Status:      deploymentHealth(container),
 		Lifetime:    container.Status,
 		HasRollback: hasRollback,
 	}
@@ -1614,11 +1928,9 @@ func scaleSwarmDeployment(cli *client.Client, name string, replicas uint64) erro
 		return errors.New("swarm deployment not found")
 	}
 
-	var config jigtypes.DeploymentConfig
-	if configString := service.Spec.Labels["jig.config"]; configString != "" {
-		if err := json.Unmarshal([]byte(configString), &config); err != nil {
-			return fmt.Errorf("invalid deployment config on service: %w", err)
-		}
+	config, err := deploymentConfigFromLabels(service.Spec.Labels)
+	if err != nil {
+		return fmt.Errorf("invalid deployment config on service: %w", err)
 	}
 	if len(config.Placement.RequiredNodeLabels) > 0 {
 		return errors.New("Scaling is not supported for deployments with placement.requiredNodeLabels")
@@ -1781,6 +2093,17 @@ func (d *DeploymentsRouter) getDeployments(w http.ResponseWriter, r *http.Reques
 		}
 		deployments = append(deployments, swarmDeployments...)
 	}
+	if d.store != nil {
+		desired, err := d.store.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deployments = mergeDesiredDeployments(deployments, desired)
+	}
+	deployments = slices.DeleteFunc(deployments, func(deployment jigtypes.Deployment) bool {
+		return !canAccessDeployment(r, deployment.Name)
+	})
 	slices.SortFunc(deployments, func(a, b jigtypes.Deployment) int {
 		return strings.Compare(a.Name, b.Name)
 	})
@@ -1814,6 +2137,15 @@ func (d *DeploymentsRouter) runDeploy(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Name is required", http.StatusBadRequest)
 		return
 	}
+	if err := validateDeploymentName(config.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setAuditTarget(r, config.Name)
+	if !canAccessDeployment(r, config.Name) {
+		http.Error(w, "Token is not scoped to deployment "+config.Name, http.StatusForbidden)
+		return
+	}
 	if config.ComposeFile != "" {
 		if isJigImage {
 			http.Error(w, "Compose deployments do not support prebuilt image uploads", http.StatusBadRequest)
@@ -1829,6 +2161,31 @@ func (d *DeploymentsRouter) runDeploy(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// @file: references read files of the project, they are taken out of the
+	// build context on its way to docker
+	fileSecrets := fileSecretPaths(config.Envs, config.SecretFiles)
+	if len(fileSecrets) > 0 && isJigImage {
+		http.Error(w, "@file: secrets are read from the project, deploy it without a prebuilt image", http.StatusBadRequest)
+		return
+	}
+	buildContext := io.Reader(r.Body)
+	projectFilesRead := make(chan error, 1)
+	projectFiles := map[string][]byte{}
+	var uploadWriter *io.PipeWriter
+	if len(fileSecrets) > 0 {
+		var upload *io.PipeReader
+		upload, uploadWriter = io.Pipe()
+		defer uploadWriter.Close()
+		buildContext = io.TeeReader(r.Body, uploadWriter)
+		go func() {
+			var err error
+			projectFiles, err = readProjectFilesFromTar(upload, fileSecrets)
+			projectFilesRead <- err
+		}()
+	} else {
+		projectFilesRead <- nil
+	}
+
 	images, err := cli.ImageList(context.Background(), types.ImageListOptions{})
 	if err != nil {
 		log.Println("Failed to list images", err.Error())
@@ -1875,7 +2232,7 @@ func (d *DeploymentsRouter) runDeploy(w http.ResponseWriter, r *http.Request) {
 		if d.usesSwarm() {
 			buildTags = append(buildTags, swarmImageRef)
 		}
-		buildResponse, err := cli.ImageBuild(context.Background(), r.Body, types.ImageBuildOptions{
+		buildResponse, err := cli.ImageBuild(context.Background(), buildContext, types.ImageBuildOptions{
 			Tags:        buildTags,
 			Remove:      true,
 			ForceRemove: true,
@@ -1903,8 +2260,25 @@ func (d *DeploymentsRouter) runDeploy(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if uploadWriter != nil {
+		uploadWriter.Close()
+	}
+	if err := <-projectFilesRead; err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The files kept for the running deployment are only replaced once the new
+	// one runs, until then secrets are read from the staged copy
+	stagedFiles, err := stageProjectFiles(projectFiles)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(stagedFiles)
+	secretDb := secretsForProject(d.secret_db, stagedFiles)
+
 	if d.usesSwarm() {
-		envs, err := makeEnvs(config.Envs, d.secret_db)
+		envs, files, err := resolveDeploymentSecrets(config, secretDb)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -1915,6 +2289,10 @@ func (d *DeploymentsRouter) runDeploy(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if err := attachSwarmSecrets(cli, &spec, files); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		existingService, err := findSwarmServiceByDeploymentName(cli, config.Name)
 		if err != nil {
@@ -1932,6 +2310,9 @@ func (d *DeploymentsRouter) runDeploy(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
+		pruneSwarmSecrets(cli, config.Name)
+		keepProjectFiles(config.Name, stagedFiles)
+		d.recordDeployment(storedKindSwarm, config, swarmImageRef)
 		if !isJigImage {
 			w.Write([]byte("{\"stream\": \"\\nImage built and swarm service updated\"}\n"))
 			w.(http.Flusher).Flush()
@@ -1939,103 +2320,138 @@ func (d *DeploymentsRouter) runDeploy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rollbackContainer, err := containerExistsWithName(cli, config.Name+"-prev")
+	envs, files, err := resolveDeploymentSecrets(config, secretDb)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if rollbackContainer != nil {
+
+	hostConfig, err := makeContainerHostConfig(config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = rotateDeploymentContainers(cli, config.Name, func(message string) {
 		if !isJigImage {
-			w.Write([]byte("\n{\"stream\": \"Rollback container exists, removing...\"}\n"))
+			w.Write([]byte("\n{\"stream\": \"" + message + "\"}\n"))
 			w.(http.Flusher).Flush()
 		}
-		fmt.Printf("Rollback container %s exists, stopping...\n", config.Name)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := createDeploymentContainer(cli, config, config.Name+":latest", envs, files, hostConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	keepProjectFiles(config.Name, stagedFiles)
+	// Record the image ID rather than the tag, the tag moves with every deploy
+	imageID := config.Name + ":latest"
+	if inspected, _, err := cli.ImageInspectWithRaw(context.Background(), imageID); err == nil {
+		imageID = inspected.ID
+	}
+	d.recordDeployment(storedKindContainer, config, imageID)
+	if !isJigImage {
+		w.Write([]byte("{\"stream\": \"\\nImage built and container started\"}\n"))
+		w.(http.Flusher).Flush()
+	}
+}
+
+// rotateDeploymentContainers removes the previous rollback container and turns
+// the currently running container into the new rollback target.
+func rotateDeploymentContainers(cli *client.Client, name string, onProgress func(string)) error {
+	rollbackContainer, err := containerExistsWithName(cli, name+"-prev")
+	if err != nil {
+		return err
+	}
+	if rollbackContainer != nil {
+		if onProgress != nil {
+			onProgress("Rollback container exists, removing...")
+		}
+		fmt.Printf("Rollback container %s exists, stopping...\n", name)
 		cli.ContainerStop(context.Background(), rollbackContainer.ID, container.StopOptions{})
-		fmt.Printf("Rollback container %s exists, removing\n", config.Name)
+		fmt.Printf("Rollback container %s exists, removing\n", name)
 		cli.ContainerRemove(context.Background(), rollbackContainer.ID, container.RemoveOptions{})
 
 	}
 
-	currentContainer, err := containerExistsWithName(cli, config.Name)
+	currentContainer, err := containerExistsWithName(cli, name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	if currentContainer != nil {
-		if !isJigImage {
-			w.Write([]byte("\n{\"stream\": \"Current container exists, renaming...\"}\n"))
-			w.(http.Flusher).Flush()
+		if onProgress != nil {
+			onProgress("Current container exists, renaming...")
 		}
-		fmt.Printf("Container %s exists, using it as a rollback...\n", config.Name)
+		fmt.Printf("Container %s exists, using it as a rollback...\n", name)
 		err = cli.ContainerStop(context.Background(), currentContainer.ID, container.StopOptions{})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			fmt.Printf("Failed to stop container %s: %s\n", config.Name, err.Error())
-			return
+			fmt.Printf("Failed to stop container %s: %s\n", name, err.Error())
+			return err
 		}
 
-		fmt.Printf("Container %s exists, using it as a rollback...\n", config.Name)
-		err = cli.ContainerRename(context.Background(), currentContainer.ID, config.Name+"-prev")
+		err = cli.ContainerRename(context.Background(), currentContainer.ID, name+"-prev")
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			fmt.Printf("Failed to rename container %s: %s\n", config.Name, err.Error())
-			return
+			fmt.Printf("Failed to rename container %s: %s\n", name, err.Error())
+			return err
 		}
 	}
+	return nil
+}
 
-	exposedPorts := map[nat.Port]struct{}{}
-	if config.Port != 0 {
-		exposedPorts[nat.Port(fmt.Sprint(config.Port)+"/tcp")] = struct{}{}
-	}
-
-	envs, err := makeEnvs(config.Envs, d.secret_db)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
+func makeContainerHostConfig(config jigtypes.DeploymentConfig) (*container.HostConfig, error) {
 	restartPolicy, err := makeRestartPolicy(config)
 	if err != nil {
-		println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	internalHostname := internalHostname(config)
-
 	mounts, err := makeVolumeMounts(config)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, err
 	}
 
-	// Declare dHostConfig before usage
-	dHostConfig := &container.HostConfig{
+	hostConfig := &container.HostConfig{
 		RestartPolicy: restartPolicy,
 		Mounts:        mounts,
 	}
 
-	if config.ExposePorts != nil {
-		// config.ExposePorts is a map "<portnum>/<protocol>" => "portnum"
-		for portProto, hostPort := range config.ExposePorts {
-			port, err := nat.NewPort("tcp", portProto)
+	// config.ExposePorts is a map "<portnum>/<protocol>" => "portnum"
+	for portProto, hostPort := range config.ExposePorts {
+		port, err := nat.NewPort("tcp", portProto)
+		if err != nil {
+			// try udp if tcp fails
+			port, err = nat.NewPort("udp", portProto)
 			if err != nil {
-				// try udp if tcp fails
-				port, err = nat.NewPort("udp", portProto)
-				if err != nil {
-					http.Error(w, "Invalid port format", http.StatusBadRequest)
-					return
-				}
-			}
-			hostPortBinding := nat.PortBinding{
-				HostIP:   "0.0.0.0",
-				HostPort: hostPort,
-			}
-			if dHostConfig.PortBindings == nil {
-				dHostConfig.PortBindings = nat.PortMap{}
+				return nil, errors.New("Invalid port format")
 			}
-			dHostConfig.PortBindings[port] = []nat.PortBinding{hostPortBinding}
 		}
+		hostPortBinding := nat.PortBinding{
+			HostIP:   "0.0.0.0",
+			HostPort: hostPort,
+		}
+		if hostConfig.PortBindings == nil {
+			hostConfig.PortBindings = nat.PortMap{}
+		}
+		hostConfig.PortBindings[port] = []nat.PortBinding{hostPortBinding}
+	}
+	return hostConfig, nil
+}
+
+// createDeploymentContainer creates and starts the container of a single
+// deployment from image on the jig network.
+func createDeploymentContainer(cli *client.Client, config jigtypes.DeploymentConfig, image string, envs []string, files []secretFile, hostConfig *container.HostConfig) error {
+	secretMounts, err := writeSecretFiles(config.Name, files)
+	if err != nil {
+		return err
+	}
+	hostConfig.Mounts = append(hostConfig.Mounts, secretMounts...)
+
+	exposedPorts := map[nat.Port]struct{}{}
+	if config.Port != 0 {
+		exposedPorts[nat.Port(fmt.Sprint(config.Port)+"/tcp")] = struct{}{}
 	}
 
 	labels := makeContainerLabels(config)
@@ -2044,33 +2460,29 @@ func (d *DeploymentsRouter) runDeploy(w http.ResponseWriter, r *http.Request) {
 	_, err = cli.ContainerCreate(context.Background(), &container.Config{
 		ExposedPorts: exposedPorts,
 		Env:          envs,
-		Image:        config.Name + ":latest",
+		Image:        image,
 		Labels:       labels,
-	}, dHostConfig, &network.NetworkingConfig{
+	}, hostConfig, &network.NetworkingConfig{
 		EndpointsConfig: map[string]*network.EndpointSettings{
 			"jig": {
-				Aliases: []string{internalHostname},
+				Aliases: []string{internalHostname(config)},
 			},
 		},
 	}, &v1.Platform{}, config.Name)
 	if err != nil {
 		println("Failed to create container", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	fmt.Printf("Container %s created\n", config.Name)
 
 	err = cli.ContainerStart(context.Background(), config.Name, container.StartOptions{})
 	if err != nil {
 		println("Failed to start container", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	fmt.Printf("Container %s started\n", config.Name)
-	if !isJigImage {
-		w.Write([]byte("{\"stream\": \"\\nImage built and container started\"}\n"))
-		w.(http.Flusher).Flush()
-	}
+	pruneSecretFiles(cli, config.Name)
+	return nil
 }
 
 func (d *DeploymentsRouter) deleteDeploy(w http.ResponseWriter, r *http.Request) {
@@ -2091,6 +2503,10 @@ func (d *DeploymentsRouter) deleteDeploy(w http.ResponseWriter, r *http.Request)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			for _, service := range stackServices {
+				pruneSwarmSecrets(d.cli, service.Spec.Labels["jig.name"])
+			}
+			d.forgetDeployment(name)
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -2100,6 +2516,8 @@ func (d *DeploymentsRouter) deleteDeploy(w http.ResponseWriter, r *http.Request)
 			return
 		}
 		if found {
+			pruneSwarmSecrets(d.cli, name)
+			d.forgetDeployment(name)
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -2110,6 +2528,14 @@ func (d *DeploymentsRouter) deleteDeploy(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	if len(target.containers) == 0 {
+		// A deployment whose containers are already gone can still be forgotten
+		if d.store != nil {
+			if stored, err := d.store.Get(name); err == nil && stored != nil {
+				d.forgetDeployment(name)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
 		http.Error(w, "Container not found", http.StatusNotFound)
 		return
 	}
@@ -2118,7 +2544,11 @@ func (d *DeploymentsRouter) deleteDeploy(w http.ResponseWriter, r *http.Request)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if deploymentName := containerInfo.Labels["jig.name"]; deploymentName != "" {
+			removeSecretFiles(deploymentName)
+		}
 	}
+	d.forgetDeployment(name)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -2169,6 +2599,9 @@ func (d *DeploymentsRouter) rollbackDeployment(w http.ResponseWriter, r *http.Re
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			if previousConfig, err := deploymentConfigFromLabels(service.PreviousSpec.Labels); err == nil && service.PreviousSpec.TaskTemplate.ContainerSpec != nil {
+				d.recordDeployment(storedKindSwarm, previousConfig, service.PreviousSpec.TaskTemplate.ContainerSpec.Image)
+			}
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -2228,6 +2661,13 @@ func (d *DeploymentsRouter) rollbackDeployment(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	if rollbackConfig, err := deploymentConfigFromLabels(rollbackTarget.Labels); err == nil {
+		if rollbackConfig.Name == "" {
+			rollbackConfig.Name = name
+		}
+		d.recordDeployment(storedKindContainer, rollbackConfig, rollbackTarget.ImageID)
+	}
+
 	err = cli.ContainerRemove(context.Background(), currentDeployment.ID, container.RemoveOptions{})
 	if err != nil {
 		http.Error(w, "Failed to remove old container", http.StatusInternalServerError)
@@ -2441,6 +2881,9 @@ func (dr *DeploymentsRouter) getDeploymentStats(w http.ResponseWriter, r *http.R
 	}
 	var allStats []jigtypes.Stats = make([]jigtypes.Stats, 0, len(containers))
 	for _, container := range containers {
+		if !canAccessDeployment(r, container.Labels["jig.name"]) && !canAccessDeployment(r, deploymentDisplayName(container)) {
+			continue
+		}
 		stats, err := dr.cli.ContainerStatsOneShot(context.Background(), container.ID)
 
 		if err != nil {
@@ -2491,15 +2934,32 @@ func (dr DeploymentsRouter) Router() (r chi.Router) {
 	r = chi.NewRouter()
 	r.Get("/", dr.getDeployments)
 
-	r.Post("/", dr.runDeploy)
+	// Requests that change deployments keep the reconciler out until they are done
+	r.Group(func(r chi.Router) {
+		r.Use(holdDeploymentChanges, requireDeploymentScope)
+
+		r.With(dr.redactSecrets).Post("/", dr.runDeploy)
+
+		r.Delete("/{name}", dr.deleteDeploy)
+
+		r.Post("/{name}/rollback", dr.rollbackDeployment)
+
+		r.Post("/{name}/scale", dr.scaleDeployment)
 
-	r.Delete("/{name}", dr.deleteDeploy)
+		r.Post("/{name}/restart", dr.lifecycleHandler(deploymentActionRestart))
 
-	r.Post("/{name}/rollback", dr.rollbackDeployment)
+		r.Post("/{name}/stop", dr.lifecycleHandler(deploymentActionStop))
+
+		r.Post("/{name}/start", dr.lifecycleHandler(deploymentActionStart))
+
+		r.Post("/{name}/redeploy", dr.redeployDeployment)
+
+		r.Patch("/{name}/env", dr.updateDeploymentEnv)
+	})
 
-	r.Post("/{name}/scale", dr.scaleDeployment)
+	r.With(requireDeploymentScope).Get("/{name}/env", dr.getDeploymentEnv)
 
-	r.Get("/{name}/logs", dr.getDeploymentLogs)
+	r.With(requireDeploymentScope, dr.redactSecrets).Get("/{name}/logs", dr.getDeploymentLogs)
 
 	r.Get("/stats", dr.getDeploymentStats)
 	return r
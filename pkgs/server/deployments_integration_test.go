@@ -288,3 +288,279 @@ services:
 		t.Fatalf("expected frontend and api child services in %#v", listed[0])
 	}
 }
+
+func pullIntegrationImage(t *testing.T, cli *client.Client, image string) {
+	t.Helper()
+
+	pull, err := cli.ImagePull(context.Background(), image, dockertypes.ImagePullOptions{})
+	if err != nil {
+		t.Fatalf("pull %s: %v", image, err)
+	}
+	defer pull.Close()
+	if _, err := io.Copy(io.Discard, pull); err != nil {
+		t.Fatalf("pull %s: %v", image, err)
+	}
+}
+
+// recreateIntegrationRouter serves the deployments routes with a fresh store,
+// it returns the stores to check what was recorded and to rotate secrets.
+func recreateIntegrationRouter(t *testing.T, cli *client.Client, backend deploymentBackend) (chi.Router, *deploymentStore, *Secrets) {
+	t.Helper()
+
+	db, err := createOrOpenDb(filepath.Join(t.TempDir(), "integration.db"))
+	if err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	secretStore, err := InitSecrets(db)
+	if err != nil {
+		t.Fatalf("init secrets: %v", err)
+	}
+	store, err := InitDeploymentStore(db)
+	if err != nil {
+		t.Fatalf("init deployment store: %v", err)
+	}
+	if err := secretStore.Insert("recreate-e2e-secret", "rotated"); err != nil {
+		t.Fatalf("insert secret: %v", err)
+	}
+
+	deployments := DeploymentsRouter{cli: cli, secret_db: secretStore, store: store, backend: backend}
+	router := chi.NewRouter()
+	router.Mount("/deployments", deployments.Router())
+	return router, store, secretStore
+}
+
+func postIntegrationAction(t *testing.T, router chi.Router, name, action string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/deployments/"+name+"/"+action, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("%s status %d: %s", action, w.Code, w.Body.String())
+	}
+}
+
+func patchIntegrationEnv(t *testing.T, router chi.Router, name string, update jigtypes.DeploymentEnvUpdateRequest) {
+	t.Helper()
+
+	body, err := json.Marshal(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPatch, "/deployments/"+name+"/env", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("env update status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRecreateContainerDeploymentE2E(t *testing.T) {
+	cli := dockerIntegrationClient(t)
+
+	if err := ensureNetworkIsUp(cli, deploymentBackendContainers); err != nil {
+		t.Fatalf("ensure jig network: %v", err)
+	}
+	t.Setenv("JIG_SECRET_FILES_DIR", t.TempDir())
+	t.Setenv("JIG_PROJECT_FILES_DIR", t.TempDir())
+
+	image := "traefik/whoami:v1.10"
+	pullIntegrationImage(t, cli, image)
+
+	name := fmt.Sprintf("recreate-e2e-%d", time.Now().UnixNano())
+	t.Cleanup(func() { cleanupDeploymentByName(t, cli, name) })
+
+	router, store, _ := recreateIntegrationRouter(t, cli, deploymentBackendContainers)
+
+	config := jigtypes.DeploymentConfig{Name: name, Envs: map[string]string{"APP_ROLE": "before"}}
+	hostConfig, err := makeContainerHostConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createDeploymentContainer(cli, config, image, []string{"APP_ROLE=before"}, nil, hostConfig); err != nil {
+		t.Fatalf("create container: %v", err)
+	}
+
+	patchIntegrationEnv(t, router, name, jigtypes.DeploymentEnvUpdateRequest{
+		Set: map[string]string{"APP_ROLE": "after", "SECRET": "@recreate-e2e-secret"},
+	})
+
+	current, err := cli.ContainerInspect(context.Background(), name)
+	if err != nil {
+		t.Fatalf("inspect recreated container: %v", err)
+	}
+	envs := strings.Join(current.Config.Env, "\n")
+	if !strings.Contains(envs, "APP_ROLE=after") || !strings.Contains(envs, "SECRET=rotated") {
+		t.Fatalf("expected the patched env in %q", envs)
+	}
+	previous, err := cli.ContainerInspect(context.Background(), name+"-prev")
+	if err != nil {
+		t.Fatalf("inspect rollback container: %v", err)
+	}
+	if !strings.Contains(strings.Join(previous.Config.Env, "\n"), "APP_ROLE=before") {
+		t.Fatalf("expected the replaced revision to be kept for rollback, got %q", previous.Config.Env)
+	}
+
+	stored, err := store.Get(name)
+	if err != nil || stored == nil {
+		t.Fatalf("expected the recreated deployment to be stored, got %+v, %v", stored, err)
+	}
+	if stored.Kind != storedKindContainer || stored.Config.Envs["SECRET"] != "@recreate-e2e-secret" {
+		t.Fatalf("unexpected stored deployment %+v", stored)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/deployments/"+name+"/redeploy", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("redeploy status %d: %s", w.Code, w.Body.String())
+	}
+	redeployed, err := cli.ContainerInspect(context.Background(), name)
+	if err != nil {
+		t.Fatalf("inspect redeployed container: %v", err)
+	}
+	if redeployed.ID == current.ID {
+		t.Fatal("expected redeploy to replace the container")
+	}
+	if !strings.Contains(strings.Join(redeployed.Config.Env, "\n"), "SECRET=rotated") {
+		t.Fatalf("expected redeploy to keep the stored env, got %q", redeployed.Config.Env)
+	}
+}
+
+func TestRecreateSwarmServiceDeploymentE2E(t *testing.T) {
+	cli := dockerIntegrationClient(t)
+
+	backend, err := detectDeploymentBackend(cli)
+	if err != nil {
+		t.Fatalf("detect backend: %v", err)
+	}
+	if backend != deploymentBackendSwarm {
+		t.Skip("docker is not a swarm manager")
+	}
+	if err := ensureNetworkIsUp(cli, deploymentBackendSwarm); err != nil {
+		t.Fatalf("ensure jig network: %v", err)
+	}
+	t.Setenv("JIG_PROJECT_FILES_DIR", t.TempDir())
+
+	image := "traefik/whoami:v1.10"
+	pullIntegrationImage(t, cli, image)
+
+	name := fmt.Sprintf("recreate-swarm-e2e-%d", time.Now().UnixNano())
+	router, store, _ := recreateIntegrationRouter(t, cli, deploymentBackendSwarm)
+
+	config := jigtypes.DeploymentConfig{Name: name, Envs: map[string]string{"APP_ROLE": "before"}}
+	spec, err := makeSwarmServiceSpec(config, image, []string{"APP_ROLE=before"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := cli.ServiceCreate(context.Background(), spec, dockertypes.ServiceCreateOptions{})
+	if err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	t.Cleanup(func() { cli.ServiceRemove(context.Background(), created.ID) })
+
+	patchIntegrationEnv(t, router, name, jigtypes.DeploymentEnvUpdateRequest{
+		Set:   map[string]string{"SECRET": "@recreate-e2e-secret"},
+		Unset: []string{"APP_ROLE"},
+	})
+
+	service, _, err := cli.ServiceInspectWithRaw(context.Background(), created.ID, dockertypes.ServiceInspectOptions{})
+	if err != nil {
+		t.Fatalf("inspect service: %v", err)
+	}
+	envs := strings.Join(service.Spec.TaskTemplate.ContainerSpec.Env, "\n")
+	if !strings.Contains(envs, "SECRET=rotated") || strings.Contains(envs, "APP_ROLE=") {
+		t.Fatalf("expected the patched env in %q", envs)
+	}
+	if service.PreviousSpec == nil || !strings.Contains(strings.Join(service.PreviousSpec.TaskTemplate.ContainerSpec.Env, "\n"), "APP_ROLE=before") {
+		t.Fatalf("expected the replaced spec to be kept for rollback, got %+v", service.PreviousSpec)
+	}
+
+	stored, err := store.Get(name)
+	if err != nil || stored == nil || stored.Kind != storedKindSwarm {
+		t.Fatalf("expected the recreated service to be stored, got %+v, %v", stored, err)
+	}
+
+	// A stopped service stays stopped when recreated, and starts again later
+	postIntegrationAction(t, router, name, "stop")
+	patchIntegrationEnv(t, router, name, jigtypes.DeploymentEnvUpdateRequest{Set: map[string]string{"APP_ROLE": "stopped"}})
+	service, _, err = cli.ServiceInspectWithRaw(context.Background(), created.ID, dockertypes.ServiceInspectOptions{})
+	if err != nil {
+		t.Fatalf("inspect service: %v", err)
+	}
+	if swarmServiceDesiredReplicas(service) != 0 || service.Spec.Labels[stoppedReplicasLabel] != "1" {
+		t.Fatalf("expected the stopped service to keep its replica count label, got %+v", service.Spec)
+	}
+	postIntegrationAction(t, router, name, "start")
+	service, _, err = cli.ServiceInspectWithRaw(context.Background(), created.ID, dockertypes.ServiceInspectOptions{})
+	if err != nil {
+		t.Fatalf("inspect service: %v", err)
+	}
+	if swarmServiceDesiredReplicas(service) != 1 {
+		t.Fatalf("expected the started service to run one replica, got %+v", service.Spec.Mode)
+	}
+}
+
+func TestRedeployComposeDeploymentE2E(t *testing.T) {
+	cli := dockerIntegrationClient(t)
+
+	if err := ensureNetworkIsUp(cli, deploymentBackendContainers); err != nil {
+		t.Fatalf("ensure jig network: %v", err)
+	}
+	t.Setenv("JIG_SECRET_FILES_DIR", t.TempDir())
+	t.Setenv("JIG_PROJECT_FILES_DIR", t.TempDir())
+
+	router, store, secretStore := recreateIntegrationRouter(t, cli, deploymentBackendContainers)
+
+	projectDir := t.TempDir()
+	projectName := fmt.Sprintf("redeploy-compose-e2e-%d", time.Now().UnixNano())
+	apiInternalName := projectName + "-api"
+	writeIntegrationFile(t, projectDir, "docker-compose.yaml", fmt.Sprintf(`
+services:
+  api:
+    image: busybox:1.36
+    command: ["sh", "-c", "while true; do sleep 5; done"]
+    x-jig:
+      name: %s
+      envs:
+        API_SECRET: "@recreate-e2e-secret"
+`, apiInternalName))
+
+	t.Cleanup(func() {
+		cleanupDeploymentByName(t, cli, apiInternalName)
+		_, _ = runComposeCommand(projectDir, "-p", projectName, "-f", "docker-compose.yaml", "down", "--remove-orphans")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/deployments", tarIntegrationDir(t, projectDir))
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.Header.Set("x-jig-image", "false")
+	req.Header.Set("x-jig-config", fmt.Sprintf(`{"name":"%s","composeFile":"docker-compose.yaml"}`, projectName))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deploy status %d: %s", w.Code, w.Body.String())
+	}
+	deployed := waitForContainerByLabel(t, cli, "jig.display-name="+projectName+":api")
+
+	if _, err := secretStore.Put("recreate-e2e-secret", "rotated-again", ""); err != nil {
+		t.Fatal(err)
+	}
+	postIntegrationAction(t, router, projectName, "redeploy")
+
+	redeployed, err := cli.ContainerInspect(context.Background(), apiInternalName)
+	if err != nil {
+		t.Fatalf("inspect redeployed container: %v", err)
+	}
+	if redeployed.ID == deployed.ID {
+		t.Fatal("expected redeploy to replace the container")
+	}
+	if !strings.Contains(strings.Join(redeployed.Config.Env, "\n"), "API_SECRET=rotated-again") {
+		t.Fatalf("expected redeploy to resolve the current secret, got %q", redeployed.Config.Env)
+	}
+	stored, err := store.Get(projectName)
+	if err != nil || stored == nil || stored.Kind != storedKindCompose {
+		t.Fatalf("expected the redeployed project to be stored, got %+v, %v", stored, err)
+	}
+}
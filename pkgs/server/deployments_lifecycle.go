@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+type deploymentLifecycleAction string
+
+const (
+	deploymentActionRestart deploymentLifecycleAction = "restart"
+	deploymentActionStop    deploymentLifecycleAction = "stop"
+	deploymentActionStart   deploymentLifecycleAction = "start"
+)
+
+// stoppedReplicasLabel remembers the replica count of a swarm service that was
+// scaled to zero by a stop, so that start can bring it back to the same size.
+const stoppedReplicasLabel = "jig.stopped-replicas"
+
+// applyLifecycleToSwarmSpec mutates spec for the given action and reports
+// whether the service needs to be updated at all.
+func applyLifecycleToSwarmSpec(spec *swarm.ServiceSpec, action deploymentLifecycleAction) (bool, error) {
+	switch action {
+	case deploymentActionRestart:
+		spec.TaskTemplate.ForceUpdate++
+	case deploymentActionStop:
+		if spec.Mode.Replicated == nil || spec.Mode.Replicated.Replicas == nil {
+			return false, errors.New("Stopping is only supported for replicated services")
+		}
+		if *spec.Mode.Replicated.Replicas == 0 {
+			return false, nil
+		}
+		if spec.Labels == nil {
+			spec.Labels = map[string]string{}
+		}
+		spec.Labels[stoppedReplicasLabel] = strconv.FormatUint(*spec.Mode.Replicated.Replicas, 10)
+		replicas := uint64(0)
+		spec.Mode.Replicated.Replicas = &replicas
+	case deploymentActionStart:
+		if spec.Mode.Replicated == nil {
+			return false, errors.New("Starting is only supported for replicated services")
+		}
+		if spec.Mode.Replicated.Replicas != nil && *spec.Mode.Replicated.Replicas > 0 {
+			return false, nil
+		}
+		replicas := uint64(1)
+		if stored := spec.Labels[stoppedReplicasLabel]; stored != "" {
+			if parsed, err := strconv.ParseUint(stored, 10, 64); err == nil && parsed > 0 {
+				replicas = parsed
+			}
+		}
+		delete(spec.Labels, stoppedReplicasLabel)
+		spec.Mode.Replicated.Replicas = &replicas
+	}
+	return true, nil
+}
+
+func applySwarmLifecycleAction(cli *client.Client, service swarm.Service, action deploymentLifecycleAction) error {
+	inspected, _, err := cli.ServiceInspectWithRaw(context.Background(), service.ID, types.ServiceInspectOptions{})
+	if err != nil {
+		return err
+	}
+	spec := inspected.Spec
+	changed, err := applyLifecycleToSwarmSpec(&spec, action)
+	if err != nil || !changed {
+		return err
+	}
+
+	_, err = cli.ServiceUpdate(context.Background(), inspected.ID, inspected.Version, spec, types.ServiceUpdateOptions{})
+	return err
+}
+
+func applyContainerLifecycleAction(cli *client.Client, containerInfo types.Container, action deploymentLifecycleAction) error {
+	switch action {
+	case deploymentActionRestart:
+		return cli.ContainerRestart(context.Background(), containerInfo.ID, container.StopOptions{})
+	case deploymentActionStop:
+		if containerInfo.State != "running" {
+			return nil
+		}
+		return cli.ContainerStop(context.Background(), containerInfo.ID, container.StopOptions{})
+	case deploymentActionStart:
+		if containerInfo.State == "running" {
+			return nil
+		}
+		return cli.ContainerStart(context.Background(), containerInfo.ID, container.StartOptions{})
+	}
+	return nil
+}
+
+func (action deploymentLifecycleAction) desiredState() string {
+	if action == deploymentActionStop {
+		return desiredStateStopped
+	}
+	return desiredStateRunning
+}
+
+// findSwarmLifecycleTargets resolves a name to the swarm services a lifecycle
+// action applies to: a stack service, every service of a stack, or a single
+// service deployment.
+func findSwarmLifecycleTargets(cli *client.Client, name string) ([]swarm.Service, error) {
+	if stackName, serviceName, found := strings.Cut(name, ":"); found && stackName != "" && serviceName != "" {
+		service, err := findSwarmServiceByStackAndServiceName(cli, stackName, serviceName)
+		if err != nil || service == nil {
+			return nil, err
+		}
+		return []swarm.Service{*service}, nil
+	}
+	stackServices, err := findSwarmServicesByStack(cli, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(stackServices) > 0 {
+		return stackServices, nil
+	}
+	service, err := findSwarmServiceByDeploymentName(cli, name)
+	if err != nil || service == nil {
+		return nil, err
+	}
+	return []swarm.Service{*service}, nil
+}
+
+func (dr *DeploymentsRouter) lifecycleHandler(action deploymentLifecycleAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if dr.usesSwarm() {
+			services, err := findSwarmLifecycleTargets(dr.cli, name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(services) > 0 {
+				for _, service := range services {
+					if err := applySwarmLifecycleAction(dr.cli, service, action); err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+				dr.recordDesiredState(name, action.desiredState())
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		target, err := resolveDeploymentTarget(dr.cli, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(target.containers) == 0 {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		for _, containerInfo := range target.containers {
+			// The rollback container of a single deployment is kept stopped on purpose
+			if target.kind == deploymentTargetSingle && isRollbackContainer(name, containerInfo) {
+				continue
+			}
+			if err := applyContainerLifecycleAction(dr.cli, containerInfo, action); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		dr.recordDesiredState(name, action.desiredState())
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// errRecreateComposeUnsupported is returned for compose deployments and swarm
+// stacks, their services are configured by the compose file. Redeploys render
+// the kept project as a whole instead, see redeployProject.
+var errRecreateComposeUnsupported = errors.New("Compose deployments and swarm stacks are configured by their compose file, change it and run jig deploy again")
+
+// currentDeployment is the running revision of a single-container or swarm
+// service deployment, as recorded in its jig.config label.
+type currentDeployment struct {
+	config    jigtypes.DeploymentConfig
+	image     string
+	service   *swarm.Service
+	container *types.Container
+}
+
+func loadCurrentDeployment(cli *client.Client, backend deploymentBackend, name string) (*currentDeployment, error) {
+	if backend == deploymentBackendSwarm {
+		if stackName, serviceName, found := strings.Cut(name, ":"); found && stackName != "" && serviceName != "" {
+			return nil, errRecreateComposeUnsupported
+		}
+		stackServices, err := findSwarmServicesByStack(cli, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(stackServices) > 0 {
+			return nil, errRecreateComposeUnsupported
+		}
+		service, err := findSwarmServiceByDeploymentName(cli, name)
+		if err != nil {
+			return nil, err
+		}
+		if service != nil {
+			inspected, _, err := cli.ServiceInspectWithRaw(context.Background(), service.ID, types.ServiceInspectOptions{})
+			if err != nil {
+				return nil, err
+			}
+			config, err := deploymentConfigFromLabels(inspected.Spec.Labels)
+			if err != nil {
+				return nil, fmt.Errorf("invalid deployment config on service: %w", err)
+			}
+			return &currentDeployment{
+				config:  config,
+				image:   inspected.Spec.TaskTemplate.ContainerSpec.Image,
+				service: &inspected,
+			}, nil
+		}
+	}
+
+	target, err := resolveDeploymentTarget(cli, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(target.containers) == 0 {
+		return nil, nil
+	}
+	if target.kind != deploymentTargetSingle || target.containers[0].Labels["jig.deployment-kind"] == "compose" {
+		return nil, errRecreateComposeUnsupported
+	}
+	current := pickContainerByExactName(target.containers, "/"+name)
+	if current == nil {
+		return nil, nil
+	}
+	config, err := deploymentConfigFromLabels(current.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deployment config on container: %w", err)
+	}
+	if config.Name == "" {
+		config.Name = name
+	}
+	return &currentDeployment{
+		config:    config,
+		image:     current.ImageID,
+		container: current,
+	}, nil
+}
+
+// recreate replaces the deployment with a new revision that runs the current
+// image with config. Containers keep the replaced one as the rollback target,
+// swarm services keep it as the previous spec.
+func (c *currentDeployment) recreate(cli *client.Client, config jigtypes.DeploymentConfig, envs []string, files []secretFile) error {
+	if c.service != nil {
+		spec, err := makeSwarmServiceSpec(config, c.image, envs)
+		if err != nil {
+			return err
+		}
+		if err := attachSwarmSecrets(cli, &spec, files); err != nil {
+			return err
+		}
+		spec.Mode = c.service.Spec.Mode
+		// A stopped service stays stopped and can still be started again
+		if stopped, found := c.service.Spec.Labels[stoppedReplicasLabel]; found {
+			spec.Labels[stoppedReplicasLabel] = stopped
+		}
+		_, err = cli.ServiceUpdate(context.Background(), c.service.ID, c.service.Version, spec, types.ServiceUpdateOptions{})
+		if err != nil {
+			return err
+		}
+		pruneSwarmSecrets(cli, config.Name)
+		return nil
+	}
+
+	hostConfig, err := makeContainerHostConfig(config)
+	if err != nil {
+		return err
+	}
+	if err := rotateDeploymentContainers(cli, config.Name, nil); err != nil {
+		return err
+	}
+	return createDeploymentContainer(cli, config, c.image, envs, files, hostConfig)
+}
+
+func (c *currentDeployment) storedKind() string {
+	if c.service != nil {
+		return storedKindSwarm
+	}
+	return storedKindContainer
+}
+
+func (dr *DeploymentsRouter) loadCurrentDeploymentOrFail(w http.ResponseWriter, name string) *currentDeployment {
+	current, err := loadCurrentDeployment(dr.cli, dr.backend, name)
+	if err != nil {
+		if errors.Is(err, errRecreateComposeUnsupported) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if current == nil {
+		http.Error(w, "Deployment not found", http.StatusNotFound)
+		return nil
+	}
+	return current
+}
+
+func applyEnvUpdate(envs map[string]string, update jigtypes.DeploymentEnvUpdateRequest) (map[string]string, error) {
+	patched := make(map[string]string, len(envs)+len(update.Set))
+	for key, value := range envs {
+		patched[key] = value
+	}
+	for key, value := range update.Set {
+		if key == "" || strings.Contains(key, "=") {
+			return nil, fmt.Errorf("invalid environment variable name %q", key)
+		}
+		patched[key] = value
+	}
+	for _, key := range update.Unset {
+		delete(patched, key)
+	}
+	return patched, nil
+}
+
+func (dr *DeploymentsRouter) getDeploymentEnv(w http.ResponseWriter, r *http.Request) {
+	current := dr.loadCurrentDeploymentOrFail(w, r.PathValue("name"))
+	if current == nil {
+		return
+	}
+	envs := current.config.Envs
+	if envs == nil {
+		envs = map[string]string{}
+	}
+	respondWithJson(w, http.StatusOK, jigtypes.DeploymentEnvResponse{Envs: envs})
+}
+
+func (dr *DeploymentsRouter) updateDeploymentEnv(w http.ResponseWriter, r *http.Request) {
+	var update jigtypes.DeploymentEnvUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid env update request", http.StatusBadRequest)
+		return
+	}
+
+	current := dr.loadCurrentDeploymentOrFail(w, r.PathValue("name"))
+	if current == nil {
+		return
+	}
+
+	patchedEnvs, err := applyEnvUpdate(current.config.Envs, update)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config := current.config
+	config.Envs = patchedEnvs
+
+	envs, files, err := resolveDeploymentSecrets(config, secretsForDeployment(dr.secret_db, config.Name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := current.recreate(dr.cli, config, envs, files); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dr.recordDeployment(current.storedKind(), config, current.image)
+
+	respondWithJson(w, http.StatusOK, jigtypes.DeploymentEnvResponse{Envs: patchedEnvs})
+}
+
+func (dr *DeploymentsRouter) redeployDeployment(w http.ResponseWriter, r *http.Request) {
+	project, err := dr.storedProject(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if project != nil {
+		dr.redeployProject(w, r, *project)
+		return
+	}
+
+	current := dr.loadCurrentDeploymentOrFail(w, r.PathValue("name"))
+	if current == nil {
+		return
+	}
+
+	envs, files, err := resolveDeploymentSecrets(current.config, secretsForDeployment(dr.secret_db, current.config.Name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := current.recreate(dr.cli, current.config, envs, files); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dr.recordDeployment(current.storedKind(), current.config, current.image)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storedProject returns the stored compose deployment or swarm stack called
+// name, or nil for every other deployment.
+func (dr *DeploymentsRouter) storedProject(name string) (*storedDeployment, error) {
+	if dr.store == nil {
+		return nil, nil
+	}
+	stored, err := dr.store.Get(name)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	if stored.Kind != storedKindCompose && stored.Kind != storedKindSwarmStack {
+		return nil, nil
+	}
+	return stored, nil
+}
+
+// redeployProject renders the compose project kept by the last deploy again,
+// with the current values of its secrets, and applies it like a deploy
+// without building images.
+func (dr *DeploymentsRouter) redeployProject(w http.ResponseWriter, r *http.Request, stored storedDeployment) {
+	config := stored.Config
+	workdir := deploymentProjectFilesDir(config.Name)
+	if _, err := os.Stat(filepath.Join(workdir, config.ComposeFile)); err != nil {
+		http.Error(w, "The compose project of "+config.Name+" is not kept on the server, run jig deploy again", http.StatusBadRequest)
+		return
+	}
+
+	project, err := loadComposeProject(workdir, config.ComposeFile)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parse compose file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	services, err := listComposeServices(workdir, config.ComposeFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	managedServices, err := composeManagedServices(project, config, services, secretsForDeployment(dr.secret_db, config.Name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, service := range managedServices {
+		if !canAccessDeployment(r, service.Config.Name) {
+			http.Error(w, "Token is not scoped to deployment "+service.Config.Name, http.StatusForbidden)
+			return
+		}
+	}
+
+	if stored.Kind == storedKindSwarmStack {
+		buildOverrideFile := ""
+		if _, err := os.Stat(filepath.Join(workdir, swarmBuildOverrideFile)); err == nil {
+			buildOverrideFile = swarmBuildOverrideFile
+		}
+		overrideContents, err := makeSwarmStackOverride(managedServices)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dr.deployStack(workdir, config, buildOverrideFile, overrideContents, managedServices, func(string) {}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if _, err := dr.upComposeProject(workdir, config, managedServices); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dr.recordStackDeployment(stored.Kind, config, managedServices)
+
+	w.WriteHeader(http.StatusNoContent)
+}
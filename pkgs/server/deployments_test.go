@@ -3,15 +3,18 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"maps"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	jigtypes "askh.at/jig/v2/pkgs/types"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/swarm"
 )
 
@@ -635,6 +638,23 @@ func TestMakeSwarmServiceSpec(t *testing.T) {
 	}
 }
 
+func TestDeploymentHealth(t *testing.T) {
+	for _, test := range []struct {
+		state, status, expected string
+	}{
+		{"running", "Up 2 minutes", "healthy"},
+		{"running", "Up 2 minutes (healthy)", "healthy"},
+		{"running", "Up 2 minutes (unhealthy)", "unhealthy"},
+		{"restarting", "Restarting (1) 5 seconds ago", "unhealthy"},
+		{"exited", "Exited (137) 1 minute ago", "stopped"},
+		{"created", "Created", "stopped"},
+	} {
+		if health := deploymentHealth(types.Container{State: test.state, Status: test.status}); health != test.expected {
+			t.Fatalf("expected %s for %s %q, got %s", test.expected, test.state, test.status, health)
+		}
+	}
+}
+
 func TestBuildDeploymentsGroupsComposeStack(t *testing.T) {
 	containers := []types.Container{
 		{
@@ -893,3 +913,364 @@ func TestBuildDeploymentsIgnoresSwarmContainers(t *testing.T) {
 		t.Fatalf("expected service kind, got %#v", deployments[0])
 	}
 }
+
+func TestApplyLifecycleToSwarmSpec(t *testing.T) {
+	replicas := uint64(3)
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Labels: map[string]string{"jig.name": "app"}},
+		Mode:        swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+	}
+
+	changed, err := applyLifecycleToSwarmSpec(&spec, deploymentActionStop)
+	if err != nil || !changed {
+		t.Fatalf("stop: changed=%v err=%v", changed, err)
+	}
+	if *spec.Mode.Replicated.Replicas != 0 {
+		t.Fatalf("expected 0 replicas after stop, got %d", *spec.Mode.Replicated.Replicas)
+	}
+	if spec.Labels[stoppedReplicasLabel] != "3" {
+		t.Fatalf("expected stopped replicas label, got %#v", spec.Labels)
+	}
+
+	changed, err = applyLifecycleToSwarmSpec(&spec, deploymentActionStop)
+	if err != nil || changed {
+		t.Fatalf("second stop should be a no-op: changed=%v err=%v", changed, err)
+	}
+
+	changed, err = applyLifecycleToSwarmSpec(&spec, deploymentActionStart)
+	if err != nil || !changed {
+		t.Fatalf("start: changed=%v err=%v", changed, err)
+	}
+	if *spec.Mode.Replicated.Replicas != 3 {
+		t.Fatalf("expected replicas to be restored to 3, got %d", *spec.Mode.Replicated.Replicas)
+	}
+	if _, ok := spec.Labels[stoppedReplicasLabel]; ok {
+		t.Fatalf("expected stopped replicas label to be removed, got %#v", spec.Labels)
+	}
+
+	changed, err = applyLifecycleToSwarmSpec(&spec, deploymentActionRestart)
+	if err != nil || !changed || spec.TaskTemplate.ForceUpdate != 1 {
+		t.Fatalf("restart: changed=%v err=%v forceUpdate=%d", changed, err, spec.TaskTemplate.ForceUpdate)
+	}
+
+	global := swarm.ServiceSpec{Mode: swarm.ServiceMode{Global: &swarm.GlobalService{}}}
+	if _, err := applyLifecycleToSwarmSpec(&global, deploymentActionStop); err == nil {
+		t.Fatal("expected stop of a global service to fail")
+	}
+}
+
+func TestApplyEnvUpdate(t *testing.T) {
+	original := map[string]string{"APP_ENV": "prod", "TOKEN": "@token", "DEBUG": "1"}
+	patched, err := applyEnvUpdate(original, jigtypes.DeploymentEnvUpdateRequest{
+		Set:   map[string]string{"APP_ENV": "staging", "NEW": "value"},
+		Unset: []string{"DEBUG", "MISSING"},
+	})
+	if err != nil {
+		t.Fatalf("applyEnvUpdate: %v", err)
+	}
+	expected := map[string]string{"APP_ENV": "staging", "TOKEN": "@token", "NEW": "value"}
+	if !maps.Equal(patched, expected) {
+		t.Fatalf("unexpected envs %#v", patched)
+	}
+	if original["APP_ENV"] != "prod" || original["DEBUG"] != "1" {
+		t.Fatalf("expected original envs to be left untouched, got %#v", original)
+	}
+
+	if _, err := applyEnvUpdate(original, jigtypes.DeploymentEnvUpdateRequest{Set: map[string]string{"A=B": "x"}}); err == nil {
+		t.Fatal("expected invalid env name to fail")
+	}
+}
+
+func TestMakeVolumeMountsNamedVolumes(t *testing.T) {
+	mounts, err := makeVolumeMounts(jigtypes.DeploymentConfig{
+		Volumes: []string{"/srv/data:/data"},
+		NamedVolumes: []jigtypes.DeploymentVolume{
+			{Name: "app-cache", Target: "/cache", ReadOnly: true},
+			{Name: "app-media", Target: "/media", Driver: "local", DriverOpts: map[string]string{"type": "nfs"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("makeVolumeMounts: %v", err)
+	}
+	if len(mounts) != 3 {
+		t.Fatalf("expected 3 mounts, got %#v", mounts)
+	}
+	if mounts[0].Type != mount.TypeBind || mounts[0].Source != "/srv/data" {
+		t.Fatalf("unexpected bind mount %#v", mounts[0])
+	}
+	cache := mounts[1]
+	if cache.Type != mount.TypeVolume || cache.Source != "app-cache" || cache.Target != "/cache" || !cache.ReadOnly {
+		t.Fatalf("unexpected cache mount %#v", cache)
+	}
+	if cache.VolumeOptions == nil || cache.VolumeOptions.Labels[jigVolumeLabel] != "true" || cache.VolumeOptions.DriverConfig != nil {
+		t.Fatalf("unexpected cache volume options %#v", cache.VolumeOptions)
+	}
+	media := mounts[2]
+	if media.VolumeOptions.DriverConfig == nil || media.VolumeOptions.DriverConfig.Name != "local" || media.VolumeOptions.DriverConfig.Options["type"] != "nfs" {
+		t.Fatalf("unexpected media volume options %#v", media.VolumeOptions)
+	}
+
+	if _, err := makeVolumeMounts(jigtypes.DeploymentConfig{NamedVolumes: []jigtypes.DeploymentVolume{{Name: "missing-target"}}}); err == nil {
+		t.Fatal("expected named volume without target to fail")
+	}
+}
+
+func TestValidateSwarmConfigAllowsNamedVolumesWithoutPlacement(t *testing.T) {
+	err := validateSwarmConfig(jigtypes.DeploymentConfig{
+		Name:         "app",
+		NamedVolumes: []jigtypes.DeploymentVolume{{Name: "app-data", Target: "/data"}},
+	})
+	if err != nil {
+		t.Fatalf("validateSwarmConfig: %v", err)
+	}
+}
+
+func TestValidateDeploymentName(t *testing.T) {
+	for _, name := range []string{"api", "shop-web", "app_2.staging"} {
+		if err := validateDeploymentName(name); err != nil {
+			t.Fatalf("expected %q to be valid: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../etc", "a/b", "-api", ".hidden", "api name"} {
+		if err := validateDeploymentName(name); err == nil {
+			t.Fatalf("expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestPruneVolumeBackups(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if err := os.WriteFile(filepath.Join(dir, volumeBackupFilename("app", base.Add(time.Duration(i)*time.Hour))), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	otherVolume := volumeBackupFilename("app-cache", base)
+	if err := os.WriteFile(filepath.Join(dir, otherVolume), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pruneVolumeBackups(dir, "app", 2); err != nil {
+		t.Fatalf("pruneVolumeBackups returned error: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := []string{}
+	for _, entry := range entries {
+		remaining = append(remaining, entry.Name())
+	}
+	expected := []string{
+		"app-20240101T020000Z.tar.gz",
+		"app-20240101T030000Z.tar.gz",
+		otherVolume,
+	}
+	if strings.Join(remaining, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected remaining backups: %v", remaining)
+	}
+}
+
+func TestParseSecretReference(t *testing.T) {
+	cases := map[string]struct {
+		name    string
+		version int
+	}{
+		"db":         {"db", 0},
+		"db:3":       {"db", 3},
+		"db:latest":  {"db:latest", 0},
+		"db:0":       {"db:0", 0},
+		"scope:db:2": {"scope:db", 2},
+	}
+	for reference, want := range cases {
+		name, version := parseSecretReference(reference)
+		if name != want.name || version != want.version {
+			t.Fatalf("parseSecretReference(%q) = %q, %d, expected %q, %d", reference, name, version, want.name, want.version)
+		}
+	}
+}
+
+func TestInterpolateSecrets(t *testing.T) {
+	secrets := map[string]string{"db_password": "p@ss", "user": "app", "db_password:2": "old"}
+	lookup := func(reference string) (string, error) {
+		value, found := secrets[reference]
+		if !found {
+			return "", errors.New("Secret not found: @" + reference)
+		}
+		return value, nil
+	}
+
+	cases := map[string]string{
+		"plain": "plain",
+		"postgres://${@user}:${@db_password}@db:5432/app": "postgres://app:p@ss@db:5432/app",
+		"pinned ${@db_password:2}":                        "pinned old",
+		"literal $${@db_password}":                        "literal ${@db_password}",
+		"shell ${HOME} and $PATH":                         "shell ${HOME} and $PATH",
+	}
+	for value, want := range cases {
+		got, err := interpolateSecrets(value, lookup)
+		if err != nil || got != want {
+			t.Fatalf("interpolateSecrets(%q) = %q, %v, expected %q", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"${@missing}", "${@user", "${@}"} {
+		if _, err := interpolateSecrets(value, lookup); err == nil {
+			t.Fatalf("expected interpolateSecrets(%q) to fail", value)
+		}
+	}
+
+	// Compose interpolates the result again, escapes stay escapes for it and
+	// only the secret text is escaped
+	secrets["db_password"] = "pa$$word"
+	composeCases := map[string]string{
+		"postgres://${DB_USER}:${@db_password}@db": "postgres://${DB_USER}:pa$$$$word@db",
+		"literal $${VAR}":                          "literal $${VAR}",
+		"literal $${@db_password}":                 "literal $${@db_password}",
+		"shell $PATH":                              "shell $PATH",
+	}
+	for value, want := range composeCases {
+		got, err := interpolateComposeSecrets(value, lookup)
+		if err != nil || got != want {
+			t.Fatalf("interpolateComposeSecrets(%q) = %q, %v, expected %q", value, got, err, want)
+		}
+	}
+
+	if escaped := escapeComposeInterpolation("a$b${c}"); escaped != "a$$b$${c}" {
+		t.Fatalf("expected $ to be escaped for compose, got %q", escaped)
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	db, err := createOrOpenDb(filepath.Join(t.TempDir(), "secrets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	secrets, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.Insert("gcp_sa", `{"type": "service_account"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secretFiles := range []map[string]string{
+		{"relative/key.json": "@gcp_sa"},
+		{"/run/secrets/../key.json": "@gcp_sa"},
+		{"/run/secrets/key.json": "plain value"},
+		{"/run/secrets/key.json": "@missing"},
+	} {
+		if _, err := makeSecretFiles(secretFiles, secrets); err == nil {
+			t.Fatalf("expected makeSecretFiles(%v) to fail", secretFiles)
+		}
+	}
+
+	files, err := makeSecretFiles(map[string]string{"/run/secrets/gcp.json": "@gcp_sa"}, secrets)
+	if err != nil || len(files) != 1 || files[0].Value != `{"type": "service_account"}` {
+		t.Fatalf("unexpected secret files %+v, %v", files, err)
+	}
+
+	t.Setenv("JIG_SECRET_FILES_DIR", t.TempDir())
+	mounts, err := writeSecretFiles("api", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || !mounts[0].ReadOnly || mounts[0].Target != "/run/secrets/gcp.json" {
+		t.Fatalf("unexpected mounts %+v", mounts)
+	}
+	if contents, err := os.ReadFile(mounts[0].Source); err != nil || string(contents) != files[0].Value {
+		t.Fatalf("expected the secret to be written to %s, got %q, %v", mounts[0].Source, contents, err)
+	}
+
+	services := []composeManagedService{{
+		StackName:   "shop",
+		ServiceName: "api",
+		DisplayName: "api",
+		Config:      jigtypes.DeploymentConfig{Name: "shop-api"},
+		SecretFiles: files,
+	}}
+	override := makeComposeOverride(services)
+	if !strings.Contains(override, `source: "`+secretFileHostPath("shop-api", files[0])+`"`) || !strings.Contains(override, "read_only: true") {
+		t.Fatalf("expected compose override to bind mount the secret file, got:\n%s", override)
+	}
+
+	stackOverride, err := makeSwarmStackOverride(services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretName := swarmSecretName("shop-api", files[0])
+	if !strings.Contains(stackOverride, "source: "+secretName) || !strings.Contains(stackOverride, "external: true") {
+		t.Fatalf("expected stack override to reference docker secret %s, got:\n%s", secretName, stackOverride)
+	}
+	if strings.Contains(stackOverride, "service_account") {
+		t.Fatal("expected the secret value to stay out of the stack override")
+	}
+
+	if name := swarmSecretName(strings.Repeat("a", 80), files[0]); len(name) != 64 {
+		t.Fatalf("expected docker secret names to be cut to 64 characters, got %d", len(name))
+	}
+}
+
+func TestRestoreSecretFiles(t *testing.T) {
+	db, err := createOrOpenDb(filepath.Join(t.TempDir(), "secrets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	secrets, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := InitDeploymentStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.Insert("gcp_sa", "service account"); err != nil {
+		t.Fatal(err)
+	}
+	secretFiles := map[string]string{"/run/secrets/gcp.json": "@gcp_sa"}
+	for _, deployment := range []storedDeployment{
+		{Name: "api", Kind: storedKindContainer, Config: jigtypes.DeploymentConfig{Name: "api", SecretFiles: secretFiles}},
+		{Name: "shop", Kind: storedKindCompose, Config: jigtypes.DeploymentConfig{Name: "shop"}, Services: map[string]jigtypes.DeploymentConfig{
+			"web":    {Name: "shop-web", SecretFiles: secretFiles},
+			"worker": {Name: "shop-worker"},
+		}},
+		{Name: "billing", Kind: storedKindSwarm, Config: jigtypes.DeploymentConfig{Name: "billing", SecretFiles: secretFiles}},
+	} {
+		if err := store.Save(deployment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The containers were created with the first value, the secret changed
+	// before the reboot
+	file := secretFile{Target: "/run/secrets/gcp.json", Value: "service account"}
+	if _, err := secrets.Put("gcp_sa", "rotated account", ""); err != nil {
+		t.Fatal(err)
+	}
+	mounted := map[string][]mountedSecretFile{
+		"api":      {{Target: file.Target, Digest: file.digest()}},
+		"shop-web": {{Target: file.Target, Digest: file.digest()}},
+		"billing":  {{Target: file.Target, Digest: file.digest()}},
+		"gone":     {{Target: file.Target, Digest: file.digest()}},
+	}
+
+	t.Setenv("JIG_SECRET_FILES_DIR", t.TempDir())
+	restoreMountedSecretFiles(store, secrets, mounted)
+
+	for _, name := range []string{"api", "shop-web"} {
+		if contents, err := os.ReadFile(secretFileHostPath(name, file)); err != nil || string(contents) != file.Value {
+			t.Fatalf("expected the mounted secret file of %s to be restored, got %q, %v", name, contents, err)
+		}
+		if _, err := os.Stat(secretFileHostPath(name, secretFile{Target: file.Target, Value: "rotated account"})); err == nil {
+			t.Fatalf("expected only the mounted file of %s to be written", name)
+		}
+	}
+	// Swarm services read docker secrets, nothing is written for them
+	if _, err := os.Stat(filepath.Join(secretFilesDir(), "billing")); err == nil {
+		t.Fatal("expected no secret files for a swarm service")
+	}
+}
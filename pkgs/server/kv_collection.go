@@ -11,9 +11,11 @@ type Collection struct {
 	name string
 }
 
-func (c *Collection) Init() {
-	c.db.Exec("CREATE TABLE IF NOT EXISTS " + c.name + " (name TEXT PRIMARY KEY, value TEXT)")
-	c.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS uniqname ON " + c.name + " (name)")
+// Init creates the collection table, name is already the primary key so it
+// needs no separate unique index.
+func (c *Collection) Init() error {
+	_, err := c.db.Exec("CREATE TABLE IF NOT EXISTS " + c.name + " (name TEXT PRIMARY KEY, value TEXT)")
+	return err
 }
 
 type KVError struct {
@@ -25,7 +27,7 @@ func (c *Collection) Insert(name, value string) error {
 	_, err := c.db.Exec("INSERT INTO "+c.name+" (name, value) VALUES (?, ?)", name, value)
 
 	if err != nil {
-		if (err.(*sqlite.Error)).Code() == 19 {
+		if sqliteError, ok := err.(*sqlite.Error); ok && sqliteError.Code()&0xff == 19 {
 			return ErrSecretExists
 		}
 	}
@@ -403,8 +403,12 @@ var tokens *tokenStorage
 
 type AppRouter struct {
 	cli         *client.Client
-	secretStore *Secrets
+	secretStore SecretStore
 	tokenStore  *tokenStorage
+	deployments *deploymentStore
+	audit       *auditLog
+	federation  *oidcFederation
+	db          *sql.DB
 	backend     deploymentBackend
 }
 
@@ -413,14 +417,28 @@ func (a *AppRouter) mainRouter() chi.Router {
 
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	if a.audit != nil {
+		r.Use(a.audit.auditRequests)
+	}
+
+	deployments := DeploymentsRouter{cli: a.cli, secret_db: a.secretStore, store: a.deployments, backend: a.backend}
+
+	r.With(a.ensureAuth, requirePermissionByMethod(PermissionsSecretsRead, PermissionsSecretsWrite, PermissionsSecretsWrite)).Mount("/secrets", SecretRouter{secret_db: a.secretStore, deployments: &deployments}.Router())
+
+	r.With(a.ensureAuth, requirePermissionByMethod(PermissionsRead, PermissionsDeploy, PermissionsDelete)).Mount("/deployments", deployments.Router())
+
+	r.With(a.ensureAuth, requirePermission(PermissionsClusterAdmin)).Mount("/cluster", ClusterRouter{cli: a.cli, backend: a.backend}.Router())
 
-	r.With(a.ensureAuth).Mount("/secrets", SecretRouter{a.secretStore}.Router())
+	r.With(a.ensureAuth, requirePermissionByMethod(PermissionsRead, PermissionsDeploy, PermissionsDelete)).Mount("/volumes", VolumeRouter{cli: a.cli, backend: a.backend}.Router())
 
-	r.With(a.ensureAuth).Mount("/deployments", DeploymentsRouter{cli: a.cli, secret_db: a.secretStore, backend: a.backend}.Router())
+	r.With(a.ensureAuth, requirePermission(PermissionsTokensAdmin)).Mount("/tokens", TokenRouter{a.tokenStore}.Router())
 
-	r.With(a.ensureAuth).Mount("/cluster", ClusterRouter{cli: a.cli, backend: a.backend}.Router())
+	// An export holds every token and secret value
+	r.With(a.ensureAuth, requirePermission(PermissionsClusterAdmin|PermissionsTokensAdmin|PermissionsRevealSecrets)).Mount("/admin", AdminRouter{cli: a.cli, db: a.db, backend: a.backend, secrets: a.secretStore, tokens: a.tokenStore, deployments: a.deployments}.Router())
 
-	r.With(a.ensureAuth).Mount("/tokens", TokenRouter{a.tokenStore}.Router())
+	if a.audit != nil {
+		r.With(a.ensureAuth, requirePermission(PermissionsClusterAdmin)).Mount("/audit", AuditRouter{log: a.audit}.Router())
+	}
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hewwo!"))
@@ -440,45 +458,138 @@ func respondWithJson(w http.ResponseWriter, statusCode int, data any) {
 	}
 }
 
+type contextKey string
+
+const tokenContextKey contextKey = "token"
+
+// tokenFromContext returns the token that authenticated the request, or nil
+// when the route is not behind ensureAuth.
+func tokenFromContext(ctx context.Context) *Token {
+	token, _ := ctx.Value(tokenContextKey).(*Token)
+	return token
+}
+
 func (a *AppRouter) ensureAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		parts := strings.Split(r.Header.Get("Authorization"), " ")
-		if len(parts) != 2 {
-			log.Println("Invalid Authorization header")
-			http.Error(w, "Invalid Authorization header", http.StatusUnauthorized)
-			return
-		}
+		var token *Token
+		var err error
+		header := r.Header.Get("Authorization")
+		// A verified client certificate stands in for a token when no bearer
+		// token is sent, see tls.go
+		if identity := certificateIdentity(r); identity != "" && header == "" {
+			token, err = a.tokenStore.GetByName(identity)
+			if err != nil {
+				log.Println("Failed to fetch token from storage")
+				http.Error(w, "Failed to fetch token from storage", http.StatusInternalServerError)
+				return
+			}
+			if token == nil {
+				log.Println("No token for client certificate", identity)
+				http.Error(w, "No token for client certificate "+identity, http.StatusUnauthorized)
+				return
+			}
+		} else {
+			parts := strings.Split(header, " ")
+			if len(parts) != 2 {
+				log.Println("Invalid Authorization header")
+				http.Error(w, "Invalid Authorization header", http.StatusUnauthorized)
+				return
+			}
 
-		if parts[0] != "Bearer" {
-			log.Println("Invalid Authorization header")
-			http.Error(w, "Invalid Authorization header", http.StatusUnauthorized)
-			return
-		}
+			if parts[0] != "Bearer" {
+				log.Println("Invalid Authorization header")
+				http.Error(w, "Invalid Authorization header", http.StatusUnauthorized)
+				return
+			}
 
-		tokenString := parts[1]
+			tokenString := parts[1]
 
-		token, err := a.tokenStore.Get(tokenString)
-		if token == nil {
-			log.Println("Token not found")
-			http.Error(w, "Token not found", http.StatusUnauthorized)
-			return
+			// JWTs of trusted issuers stand in for a token, see oidc.go
+			if a.federation != nil && looksLikeJWT(tokenString) {
+				token, err = a.federation.Authenticate(tokenString)
+				if err != nil {
+					log.Println("Rejected federated token:", err)
+					http.Error(w, "Invalid federated token", http.StatusUnauthorized)
+					return
+				}
+			} else {
+				token, err = a.tokenStore.Get(tokenString)
+				if token == nil {
+					log.Println("Token not found")
+					http.Error(w, "Token not found", http.StatusUnauthorized)
+					return
+				}
+				if err != nil {
+					log.Println("Failed to fetch token from storage")
+					http.Error(w, "Failed to fetch token from storage", http.StatusInternalServerError)
+					return
+				}
+			}
 		}
-		if err != nil {
-			log.Println("Failed to fetch token from storage")
-			http.Error(w, "Failed to fetch token from storage", http.StatusInternalServerError)
+		if token.Expired(time.Now()) {
+			log.Println("Token expired:", token.Name)
+			http.Error(w, "Token expired", http.StatusUnauthorized)
 			return
 		}
 
-		type contextKey string
+		setAuditActor(r.Context(), token.Name)
+		ctx := context.WithValue(r.Context(), tokenContextKey, token)
+		r = r.WithContext(ctx)
+		next.ServeHTTP(w, r)
+	})
+}
 
-		const tokenKey contextKey = "token"
+// requirePermission refuses requests whose token lacks any of the permissions
+// in the mask. It runs after ensureAuth.
+func requirePermission(permissions int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := tokenFromContext(r.Context())
+			if token == nil || !token.Has(permissions) {
+				http.Error(w, "Token lacks permission "+strings.Join(permissionList(permissions), ", "), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-		ctx := context.WithValue(r.Context(), tokenKey, token)
-		r = r.WithContext(ctx)
+// requireDeploymentScope refuses requests for a {name} deployment outside the
+// scopes of the token.
+func requireDeploymentScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := chi.URLParam(r, "name"); name != "" && !canAccessDeployment(r, name) {
+			http.Error(w, "Token is not scoped to deployment "+name, http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+func canAccessDeployment(r *http.Request, name string) bool {
+	token := tokenFromContext(r.Context())
+	return token == nil || token.CanAccessDeployment(name)
+}
+
+// requirePermissionByMethod asks for read on GET requests, remove on DELETE
+// requests and write on everything else.
+func requirePermissionByMethod(read, write, remove int) func(http.Handler) http.Handler {
+	readCheck, writeCheck, removeCheck := requirePermission(read), requirePermission(write), requirePermission(remove)
+	return func(next http.Handler) http.Handler {
+		readNext, writeNext, removeNext := readCheck(next), writeCheck(next), removeCheck(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead:
+				readNext.ServeHTTP(w, r)
+			case http.MethodDelete:
+				removeNext.ServeHTTP(w, r)
+			default:
+				writeNext.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
 func serve() {
 
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -515,6 +626,11 @@ func serve() {
 		log.Printf("Swarm registry is running at %s", swarmRegistryHost())
 	}
 
+	if err := startScheduledVolumeBackups(cli, backend); err != nil {
+		log.Println("Failed to schedule volume backups")
+		panic(err)
+	}
+
 	db, err := createOrOpenDb("/var/jig/secrets.db")
 	if err != nil {
 		log.Println("Failed to initialize embeded db")
@@ -529,16 +645,67 @@ func serve() {
 
 	defer secretStore.Close()
 
+	key, err := loadMasterKey()
+	if errors.Is(err, errMasterKeyNotConfigured) {
+		// A generated key on the container filesystem would be lost with the
+		// container, and every secret encrypted with it
+		log.Printf("Secrets are not encrypted: %s", err)
+	} else if err != nil {
+		log.Println("Failed to load master key")
+		panic(err)
+	} else {
+		encrypted, err := secretStore.EnableEncryption(key)
+		if err != nil {
+			log.Println("Failed to encrypt secrets")
+			panic(err)
+		}
+		if encrypted > 0 {
+			log.Printf("Encrypted %d plaintext secrets", encrypted)
+		}
+	}
+	secretStore.WithProviders(secretProvidersFromEnv())
+
 	tokens, err = InitTokenStorage(db)
 	if err != nil {
 		log.Println("Failed to initialize tokens storage")
 		panic(err)
 	}
 
+	deployments, err := InitDeploymentStore(db)
+	if err != nil {
+		log.Println("Failed to initialize deployment storage")
+		panic(err)
+	}
+
+	audit, err := InitAuditLog(db)
+	if err != nil {
+		log.Println("Failed to initialize audit log")
+		panic(err)
+	}
+
+	federation, err := configureFederation()
+	if err != nil {
+		log.Println("Failed to load OIDC trust policies")
+		panic(err)
+	}
+
+	if backend == deploymentBackendContainers {
+		restoreSecretFiles(cli, deployments, secretStore)
+	}
+	go trackProviderSecrets(deployments, secretStore)
+	if err := startReconciler(&reconciler{cli: cli, backend: backend, secrets: secretStore, store: deployments}); err != nil {
+		log.Println("Failed to start reconciler")
+		panic(err)
+	}
+
 	app := &AppRouter{
 		cli:         cli,
 		secretStore: secretStore,
 		tokenStore:  tokens,
+		deployments: deployments,
+		audit:       audit,
+		federation:  federation,
+		db:          db,
 		backend:     backend,
 	}
 
@@ -568,7 +735,19 @@ func serve() {
 
 		}
 	}()
-	log.Println("Listening on 5000")
-	http.ListenAndServe("0.0.0.0:5000", router)
+	settings := tlsSettingsFromEnv()
+	if !settings.enabled() {
+		log.Println("Listening on 5000")
+		http.ListenAndServe("0.0.0.0:5000", router)
+		return
+	}
+	tlsConfig, err := settings.config()
+	if err != nil {
+		log.Println("Failed to configure TLS")
+		panic(err)
+	}
+	server := &http.Server{Addr: "0.0.0.0:5000", Handler: router, TLSConfig: tlsConfig}
+	log.Println("Listening with TLS on 5000")
+	server.ListenAndServeTLS(settings.certFile, settings.keyFile)
 
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+)
+
+// migration is one step of the server database schema. Migrations run in order
+// inside a transaction and are recorded in schema_migrations, so every step is
+// applied exactly once. The early steps use IF NOT EXISTS because databases
+// created before migrations existed already have those tables.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+	return nil
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create secrets",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"CREATE TABLE IF NOT EXISTS secrets (id INTEGER PRIMARY KEY, name TEXT, value TEXT)",
+				// uniqname used to be shared by secrets and tokens, only the first
+				// table to claim it ever got a unique index
+				"DROP INDEX IF EXISTS uniqname",
+				"CREATE UNIQUE INDEX IF NOT EXISTS uniqsecretname ON secrets (name)",
+			)
+		},
+	},
+	{
+		version: 2,
+		name:    "create tokens",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"CREATE TABLE IF NOT EXISTS tokens (id integer primary key, token TEXT, name TEXT, created_at TEXT, permissions INTEGER, valid_until TEXT)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS uniqtoken ON tokens (token)",
+				// Token names were never unique, keep the oldest and rename the rest
+				"UPDATE tokens SET name = name || '-' || id WHERE id NOT IN (SELECT MIN(id) FROM tokens GROUP BY name)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS uniqtokenname ON tokens (name)",
+			)
+		},
+	},
+	{
+		version: 3,
+		name:    "create deployments",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"CREATE TABLE IF NOT EXISTS deployments (id integer primary key, name TEXT, kind TEXT, config TEXT, image TEXT, desired_state TEXT, updated_at TEXT)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS uniqdeployment ON deployments (name)",
+			)
+		},
+	},
+	{
+		version: 4,
+		name:    "add secret versions",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"ALTER TABLE secrets ADD COLUMN version INTEGER NOT NULL DEFAULT 1",
+				"CREATE TABLE secret_versions (id integer primary key, name TEXT, version INTEGER, value TEXT, created_at TEXT, created_by TEXT)",
+				"CREATE UNIQUE INDEX uniqsecretversion ON secret_versions (name, version)",
+				// Existing secrets become version 1 of their history
+				"INSERT INTO secret_versions (name, version, value, created_at, created_by) SELECT name, 1, value, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), '' FROM secrets",
+			)
+		},
+	},
+	{
+		version: 5,
+		name:    "add write-only secrets",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"ALTER TABLE secrets ADD COLUMN write_only INTEGER NOT NULL DEFAULT 0",
+				// Every token could read secret values before, they keep doing so
+				fmt.Sprintf("UPDATE tokens SET permissions = permissions | %d", PermissionsRevealSecrets),
+			)
+		},
+	},
+	{
+		version: 6,
+		name:    "add compose service configs",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"ALTER TABLE deployments ADD COLUMN services TEXT NOT NULL DEFAULT '{}'",
+			)
+		},
+	},
+	{
+		version: 7,
+		name:    "add token permissions",
+		up: func(tx *sql.Tx) error {
+			// Permissions were not enforced before, existing tokens keep what they could do
+			return execAll(tx,
+				fmt.Sprintf("UPDATE tokens SET permissions = permissions | %d", PermissionsSecretsRead|PermissionsSecretsWrite|PermissionsTokensAdmin|PermissionsClusterAdmin),
+			)
+		},
+	},
+	{
+		version: 8,
+		name:    "add token scopes",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"ALTER TABLE tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT '[]'",
+			)
+		},
+	},
+	{
+		version: 9,
+		name:    "add token rotation",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"ALTER TABLE tokens ADD COLUMN previous_token TEXT",
+				"ALTER TABLE tokens ADD COLUMN previous_valid_until TEXT",
+			)
+		},
+	},
+	{
+		version: 10,
+		name:    "hash tokens",
+		up: func(tx *sql.Tx) error {
+			err := execAll(tx,
+				"ALTER TABLE tokens ADD COLUMN token_prefix TEXT",
+				"ALTER TABLE tokens ADD COLUMN token_salt TEXT",
+				"ALTER TABLE tokens ADD COLUMN token_hash TEXT",
+				"ALTER TABLE tokens ADD COLUMN previous_token_prefix TEXT",
+				"ALTER TABLE tokens ADD COLUMN previous_token_salt TEXT",
+				"ALTER TABLE tokens ADD COLUMN previous_token_hash TEXT",
+			)
+			if err != nil {
+				return err
+			}
+			if err := hashPlaintextTokens(tx); err != nil {
+				return err
+			}
+			return execAll(tx,
+				"DROP INDEX IF EXISTS uniqtoken",
+				"CREATE INDEX IF NOT EXISTS tokenprefix ON tokens (token_prefix)",
+				"CREATE INDEX IF NOT EXISTS previoustokenprefix ON tokens (previous_token_prefix)",
+			)
+		},
+	},
+	{
+		version: 11,
+		name:    "create audit log",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"CREATE TABLE audit_log (id integer primary key, created_at TEXT, actor TEXT, method TEXT, route TEXT, target TEXT, status INTEGER)",
+				"CREATE INDEX auditcreatedat ON audit_log (created_at)",
+			)
+		},
+	},
+}
+
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at TEXT)"); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		appliedAtTime, err := time.Parse(time.RFC3339, appliedAt)
+		if err != nil {
+			log.Printf("Failed to parse applied_at for migration %d: %s", version, err)
+		}
+		applied[version] = appliedAtTime
+	}
+	return applied, rows.Err()
+}
+
+func applyMigration(db *sql.DB, step migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := step.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		step.version, step.name, time.Now().UTC().Format(time.RFC3339),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runMigrations brings the database schema up to date. It is safe to call more
+// than once, every store runs it before touching its tables.
+func runMigrations(db *sql.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, step := range migrations {
+		if _, done := applied[step.version]; done {
+			continue
+		}
+		if err := applyMigration(db, step); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", step.version, step.name, err)
+		}
+		log.Printf("Applied database migration %d: %s", step.version, step.name)
+	}
+	return nil
+}
+
+func schemaStatus(db *sql.DB) (jigtypes.SchemaStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return jigtypes.SchemaStatus{}, err
+	}
+	status := jigtypes.SchemaStatus{Migrations: []jigtypes.SchemaMigration{}}
+	for _, step := range migrations {
+		entry := jigtypes.SchemaMigration{Version: step.version, Name: step.name}
+		if appliedAt, done := applied[step.version]; done {
+			entry.Applied = true
+			entry.AppliedAt = appliedAt.Format(time.RFC3339)
+			status.Version = step.version
+		}
+		status.Migrations = append(status.Migrations, entry)
+	}
+	status.Latest = migrations[len(migrations)-1].version
+	return status, nil
+}
+
+func (ar AdminRouter) getSchema(w http.ResponseWriter, r *http.Request) {
+	status, err := schemaStatus(ar.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJson(w, http.StatusOK, status)
+}
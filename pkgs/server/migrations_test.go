@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRunMigrationsUpgradesLegacyDatabase(t *testing.T) {
+	db, err := createOrOpenDb("./testing-migrations.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-migrations.db")
+
+	// The schema as it was created before migrations, including the index name
+	// clash that left token names without a unique index
+	for _, statement := range []string{
+		"CREATE TABLE secrets (id INTEGER PRIMARY KEY, name TEXT, value TEXT)",
+		"create unique index uniqname on secrets (name);",
+		"CREATE TABLE IF NOT EXISTS tokens (id integer primary key, token TEXT, name TEXT, created_at TEXT, permissions INTEGER, valid_until TEXT)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS uniqtoken ON tokens (token);",
+		"INSERT INTO secrets (name, value) VALUES ('db', 'secret')",
+		"INSERT INTO tokens (token, name, created_at, permissions) VALUES ('a', 'default', '2024-01-01T00:00:00Z', 7)",
+		"INSERT INTO tokens (token, name, created_at, permissions) VALUES ('b', 'default', '2024-01-01T00:00:00Z', 7)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	if err := runMigrations(db); err != nil {
+		t.Fatalf("runMigrations returned error: %v", err)
+	}
+	if err := runMigrations(db); err != nil {
+		t.Fatalf("second runMigrations returned error: %v", err)
+	}
+
+	status, err := schemaStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != status.Latest || len(status.Migrations) != len(migrations) {
+		t.Fatalf("expected schema to be at the latest version, got %+v", status)
+	}
+	for _, entry := range status.Migrations {
+		if !entry.Applied || entry.AppliedAt == "" {
+			t.Fatalf("expected migration %d to be applied, got %+v", entry.Version, entry)
+		}
+	}
+
+	secrets := &Secrets{db: db}
+	if value, err := secrets.GetValue("db"); err != nil || value != "secret" {
+		t.Fatalf("expected existing secret to survive, got %q, %v", value, err)
+	}
+	if err := secrets.Insert("db", "other"); err != ErrSecretExists {
+		t.Fatalf("expected secret names to stay unique, got %v", err)
+	}
+	if versions, err := secrets.Versions("db"); err != nil || len(versions) != 1 || versions[0].Version != 1 {
+		t.Fatalf("expected existing secret to become version 1, got %+v, %v", versions, err)
+	}
+
+	var names []string
+	rows, err := db.Query("SELECT name FROM tokens ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if len(names) != 2 || names[0] != "default" || names[1] != "default-2" {
+		t.Fatalf("expected duplicate token names to be renamed, got %v", names)
+	}
+	if _, err := db.Exec("INSERT INTO tokens (token, name, created_at, permissions) VALUES ('c', 'default', '2024-01-01T00:00:00Z', 7)"); err == nil {
+		t.Fatal("expected token names to be unique after migrating")
+	}
+
+	// Secrets stored before tokens were hashed keep working, but are gone from disk
+	tokenStore := &tokenStorage{db: db}
+	if token, err := tokenStore.Get("b"); err != nil || token == nil || token.Name != "default-2" || token.Prefix != "b" {
+		t.Fatalf("expected the legacy token to be found by its secret, got %+v, %v", token, err)
+	}
+	var plaintext int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tokens WHERE token IS NOT NULL").Scan(&plaintext); err != nil || plaintext != 0 {
+		t.Fatalf("expected no plaintext tokens to remain, got %d, %v", plaintext, err)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const defaultFederationConfig = "/var/jig/oidc.json"
+
+// jwksRefreshInterval is how long keys fetched from a JWKS URL are trusted
+// before they are fetched again, jwksRetryInterval keeps unknown key ids from
+// hammering the issuer.
+const (
+	jwksRefreshInterval = time.Hour
+	jwksRetryInterval   = time.Minute
+)
+
+var jwtSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+var ErrNoTrustPolicy = errors.New("no trust policy matches the token")
+
+// federationConfig lists the issuers whose JWTs are accepted instead of a jig
+// token, and the trust policies that turn their claims into permissions.
+type federationConfig struct {
+	Issuers  []trustedIssuer `json:"issuers"`
+	Policies []trustPolicy   `json:"policies"`
+}
+
+type trustedIssuer struct {
+	Issuer string `json:"issuer"`
+	// Audience has to be in the aud claim, so tokens minted for other
+	// services are not accepted
+	Audience string `json:"audience"`
+	// JWKSURL or JWKSFile provide the signing keys
+	JWKSURL  string `json:"jwksUrl,omitempty"`
+	JWKSFile string `json:"jwksFile,omitempty"`
+}
+
+// trustPolicy grants permissions and scopes to tokens of an issuer whose
+// claims match every glob in Claims, for example
+// {"repository": "acme/billing", "ref": "refs/heads/main"}.
+type trustPolicy struct {
+	Name        string            `json:"name"`
+	Issuer      string            `json:"issuer"`
+	Claims      map[string]string `json:"claims"`
+	Permissions []string          `json:"permissions,omitempty"`
+	Scopes      []string          `json:"scopes,omitempty"`
+	permissions int
+}
+
+// oidcFederation authenticates JWTs of trusted issuers.
+type oidcFederation struct {
+	issuers  map[string]*issuerKeys
+	policies []trustPolicy
+}
+
+// configureFederation loads the trust policies from JIG_OIDC_CONFIG, or from
+// /var/jig/oidc.json when it exists. Without either, only jig tokens work.
+func configureFederation() (*oidcFederation, error) {
+	configPath := strings.TrimSpace(os.Getenv("JIG_OIDC_CONFIG"))
+	if configPath == "" {
+		if _, err := os.Stat(defaultFederationConfig); err != nil {
+			return nil, nil
+		}
+		configPath = defaultFederationConfig
+	}
+	configBytes, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var config federationConfig
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", configPath, err)
+	}
+	federation, err := newOidcFederation(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	log.Printf("Accepting JWTs of %d issuers with %d trust policies", len(federation.issuers), len(federation.policies))
+	return federation, nil
+}
+
+func newOidcFederation(config federationConfig) (*oidcFederation, error) {
+	federation := &oidcFederation{issuers: map[string]*issuerKeys{}}
+	for _, issuer := range config.Issuers {
+		if issuer.Issuer == "" {
+			return nil, errors.New("issuers need an issuer")
+		}
+		if issuer.Audience == "" {
+			return nil, fmt.Errorf("issuer %s needs an audience", issuer.Issuer)
+		}
+		if (issuer.JWKSURL == "") == (issuer.JWKSFile == "") {
+			return nil, fmt.Errorf("issuer %s needs either a jwksUrl or a jwksFile", issuer.Issuer)
+		}
+		keys := &issuerKeys{config: issuer, client: &http.Client{Timeout: 10 * time.Second}}
+		if issuer.JWKSFile != "" {
+			document, err := os.ReadFile(issuer.JWKSFile)
+			if err != nil {
+				return nil, err
+			}
+			if keys.keys, err = parseJWKS(document); err != nil {
+				return nil, fmt.Errorf("%s: %w", issuer.JWKSFile, err)
+			}
+		}
+		federation.issuers[issuer.Issuer] = keys
+	}
+	for _, policy := range config.Policies {
+		if policy.Name == "" {
+			return nil, errors.New("trust policies need a name")
+		}
+		if _, found := federation.issuers[policy.Issuer]; !found {
+			return nil, fmt.Errorf("trust policy %s uses unknown issuer %q", policy.Name, policy.Issuer)
+		}
+		// Issuers like GitHub sign tokens for every repository, a policy has
+		// to say which ones it trusts
+		if len(policy.Claims) == 0 {
+			return nil, fmt.Errorf("trust policy %s needs at least one claim", policy.Name)
+		}
+		for claim, pattern := range policy.Claims {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("trust policy %s: invalid pattern for %s: %w", policy.Name, claim, err)
+			}
+		}
+		policy.permissions = permissionsDefault
+		if len(policy.Permissions) > 0 {
+			var err error
+			if policy.permissions, err = parsePermissions(policy.Permissions); err != nil {
+				return nil, fmt.Errorf("trust policy %s: %w", policy.Name, err)
+			}
+		}
+		if err := validateScopes(policy.Scopes); err != nil {
+			return nil, fmt.Errorf("trust policy %s: %w", policy.Name, err)
+		}
+		federation.policies = append(federation.policies, policy)
+	}
+	return federation, nil
+}
+
+// looksLikeJWT tells JWTs apart from jig token secrets, which have no dots.
+func looksLikeJWT(secret string) bool {
+	return strings.Count(secret, ".") == 2
+}
+
+// Authenticate verifies a JWT and returns a token with the permissions and
+// scopes of the first trust policy its claims match. The token is named after
+// the policy and expires with the JWT.
+func (f *oidcFederation) Authenticate(raw string) (*Token, error) {
+	unverified, _, err := jwt.NewParser().ParseUnverified(raw, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	issuerName, err := unverified.Claims.GetIssuer()
+	if err != nil {
+		return nil, err
+	}
+	issuer, found := f.issuers[issuerName]
+	if !found {
+		return nil, fmt.Errorf("untrusted issuer %q", issuerName)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, issuer.keyFunc,
+		jwt.WithValidMethods(jwtSigningMethods),
+		jwt.WithIssuer(issuerName),
+		jwt.WithAudience(issuer.config.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, policy := range f.policies {
+		if policy.Issuer == issuerName && policy.matches(claims) {
+			return &Token{
+				Name:        "oidc:" + policy.Name,
+				CreatedAt:   time.Now(),
+				Permissions: policy.permissions,
+				Scopes:      policy.Scopes,
+				ValidUntil:  expiresAt.Time,
+			}, nil
+		}
+	}
+	return nil, ErrNoTrustPolicy
+}
+
+func (p trustPolicy) matches(claims jwt.MapClaims) bool {
+	for claim, pattern := range p.Claims {
+		value, found := claims[claim]
+		if !found {
+			return false
+		}
+		text, ok := value.(string)
+		if !ok {
+			text = fmt.Sprint(value)
+		}
+		if matched, _ := path.Match(pattern, text); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// issuerKeys holds the signing keys of an issuer by key id.
+type issuerKeys struct {
+	config    trustedIssuer
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+func (k *issuerKeys) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if k.config.JWKSURL != "" && k.claimFetch(kid) {
+		// The issuer is fetched without holding the lock, and the last fetched
+		// keys stay in use while it can not be reached
+		keys, err := k.fetch()
+		k.mu.Lock()
+		if err != nil {
+			log.Printf("OIDC: %s", err)
+			k.fetchedAt = time.Now().Add(jwksRetryInterval - jwksRefreshInterval)
+		} else {
+			k.keys = keys
+		}
+		k.mu.Unlock()
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, found := k.lookup(kid)
+	if !found {
+		return nil, fmt.Errorf("issuer %s has no key %q", k.config.Issuer, kid)
+	}
+	return key, nil
+}
+
+// claimFetch reports whether the keys need to be fetched for kid. It marks
+// them as fetched, so that concurrent requests do not fetch them as well.
+func (k *issuerKeys) claimFetch(kid string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, known := k.lookup(kid)
+	age := time.Since(k.fetchedAt)
+	if age > jwksRefreshInterval || (!known && age > jwksRetryInterval) {
+		k.fetchedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// lookup finds a key by id, a token without one can only use the only key.
+func (k *issuerKeys) lookup(kid string) (any, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, found := k.keys[kid]
+	return key, found
+}
+
+func (k *issuerKeys) fetch() (map[string]any, error) {
+	resp, err := k.client.Get(k.config.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetch keys of %s: %w", k.config.Issuer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch keys of %s: %s", k.config.Issuer, resp.Status)
+	}
+	var document json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return nil, fmt.Errorf("decode keys of %s: %w", k.config.Issuer, err)
+	}
+	keys, err := parseJWKS(document)
+	if err != nil {
+		return nil, fmt.Errorf("keys of %s: %w", k.config.Issuer, err)
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS reads the public signing keys of a JSON Web Key Set. Keys of
+// other types or uses are skipped.
+func parseJWKS(document []byte) (map[string]any, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(document, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]any{}
+	for _, webKey := range set.Keys {
+		if webKey.Use != "" && webKey.Use != "sig" {
+			continue
+		}
+		key, err := webKey.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", webKey.Kid, err)
+		}
+		if key != nil {
+			keys[webKey.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeKeyNumber(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeKeyNumber(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, found := curves[k.Crv]
+		if !found {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeKeyNumber(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeKeyNumber(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeKeyNumber(encoded string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
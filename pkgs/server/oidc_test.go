@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func rsaJWKS(t *testing.T, kid string, key *rsa.PrivateKey) []byte {
+	t.Helper()
+	document, err := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kid": kid,
+		"kty": "RSA",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return document
+}
+
+func TestOidcFederation(t *testing.T) {
+	ciKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One issuer serves its keys, the other one is configured with a file
+	fetches := 0
+	issuerDown := false
+	issuerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if issuerDown {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(rsaJWKS(t, "ci", ciKey))
+	}))
+	defer issuerServer.Close()
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, rsaJWKS(t, "static", otherKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	federation, err := newOidcFederation(federationConfig{
+		Issuers: []trustedIssuer{
+			{Issuer: "https://ci.example.com", Audience: "jig", JWKSURL: issuerServer.URL},
+			{Issuer: "https://static.example.com", Audience: "jig", JWKSFile: jwksFile},
+		},
+		Policies: []trustPolicy{
+			{Name: "billing-main", Issuer: "https://ci.example.com", Claims: map[string]string{"repository": "acme/billing", "ref": "refs/heads/main"}, Permissions: []string{"read", "deploy"}, Scopes: []string{"billing-*"}},
+			{Name: "billing-branches", Issuer: "https://ci.example.com", Claims: map[string]string{"repository": "acme/billing", "ref": "refs/heads/*"}, Permissions: []string{"read"}},
+			{Name: "static", Issuer: "https://static.example.com", Claims: map[string]string{"sub": "deployer"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	expires := time.Now().Add(10 * time.Minute)
+	ciClaims := func(ref string) jwt.MapClaims {
+		return jwt.MapClaims{"iss": "https://ci.example.com", "aud": "jig", "exp": expires.Unix(), "repository": "acme/billing", "ref": ref}
+	}
+
+	token, err := federation.Authenticate(sign(ciKey, "ci", ciClaims("refs/heads/main")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Name != "oidc:billing-main" || token.Permissions != PermissionsRead|PermissionsDeploy || !token.CanAccessDeployment("billing-api") || token.CanAccessDeployment("shop") {
+		t.Fatalf("expected the billing-main policy to apply, got %+v", token)
+	}
+	if token.ValidUntil.Unix() != expires.Unix() {
+		t.Fatalf("expected the token to expire with the JWT, got %s", token.ValidUntil)
+	}
+	if token, err := federation.Authenticate(sign(ciKey, "ci", ciClaims("refs/heads/feature"))); err != nil || token.Name != "oidc:billing-branches" {
+		t.Fatalf("expected the branch policy to apply, got %+v, %v", token, err)
+	}
+	if token, err := federation.Authenticate(sign(otherKey, "static", jwt.MapClaims{"iss": "https://static.example.com", "aud": "jig", "exp": expires.Unix(), "sub": "deployer"})); err != nil || token.Name != "oidc:static" || token.Permissions != permissionsDefault {
+		t.Fatalf("expected a static key to be accepted, got %+v, %v", token, err)
+	}
+	if fetches != 1 {
+		t.Fatalf("expected the keys to be fetched once, got %d", fetches)
+	}
+
+	// Stale keys are kept while the issuer can not be reached
+	issuerDown = true
+	ciKeys := federation.issuers["https://ci.example.com"]
+	ciKeys.fetchedAt = time.Now().Add(-2 * jwksRefreshInterval)
+	if token, err := federation.Authenticate(sign(ciKey, "ci", ciClaims("refs/heads/main"))); err != nil || token.Name != "oidc:billing-main" {
+		t.Fatalf("expected the last fetched keys to be used, got %+v, %v", token, err)
+	}
+	if fetches != 2 || time.Since(ciKeys.fetchedAt) < jwksRefreshInterval-jwksRetryInterval {
+		t.Fatalf("expected a failed refresh to be retried soon, got %d fetches at %s", fetches, ciKeys.fetchedAt)
+	}
+	issuerDown = false
+
+	rejected := map[string]string{
+		"other repository": sign(ciKey, "ci", jwt.MapClaims{"iss": "https://ci.example.com", "aud": "jig", "exp": expires.Unix(), "repository": "acme/shop", "ref": "refs/heads/main"}),
+		"other audience":   sign(ciKey, "ci", jwt.MapClaims{"iss": "https://ci.example.com", "aud": "vault", "exp": expires.Unix(), "repository": "acme/billing", "ref": "refs/heads/main"}),
+		"expired":          sign(ciKey, "ci", jwt.MapClaims{"iss": "https://ci.example.com", "aud": "jig", "exp": time.Now().Add(-time.Hour).Unix(), "repository": "acme/billing", "ref": "refs/heads/main"}),
+		"no expiry":        sign(ciKey, "ci", jwt.MapClaims{"iss": "https://ci.example.com", "aud": "jig", "repository": "acme/billing", "ref": "refs/heads/main"}),
+		"wrong key":        sign(otherKey, "ci", ciClaims("refs/heads/main")),
+		"unknown issuer":   sign(ciKey, "ci", jwt.MapClaims{"iss": "https://evil.example.com", "aud": "jig", "exp": expires.Unix(), "repository": "acme/billing", "ref": "refs/heads/main"}),
+		"unsigned": func() string {
+			raw, _ := jwt.NewWithClaims(jwt.SigningMethodNone, ciClaims("refs/heads/main")).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return raw
+		}(),
+	}
+	for name, raw := range rejected {
+		if token, err := federation.Authenticate(raw); err == nil {
+			t.Fatalf("expected %s to be rejected, got %+v", name, token)
+		}
+	}
+
+	app := &AppRouter{federation: federation}
+	handler := app.ensureAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(tokenFromContext(r.Context()).Name))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+sign(ciKey, "ci", ciClaims("refs/heads/main")))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "oidc:billing-main" {
+		t.Fatalf("expected ensureAuth to accept the JWT, got %d: %s", w.Code, w.Body.String())
+	}
+	req.Header.Set("Authorization", "Bearer "+rejected["other repository"])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected ensureAuth to refuse the JWT, got %d", w.Code)
+	}
+
+	for name, config := range map[string]federationConfig{
+		"no audience":    {Issuers: []trustedIssuer{{Issuer: "https://ci.example.com", JWKSURL: issuerServer.URL}}},
+		"no keys":        {Issuers: []trustedIssuer{{Issuer: "https://ci.example.com", Audience: "jig"}}},
+		"no claims":      {Issuers: []trustedIssuer{{Issuer: "https://ci.example.com", Audience: "jig", JWKSURL: issuerServer.URL}}, Policies: []trustPolicy{{Name: "any", Issuer: "https://ci.example.com"}}},
+		"bad issuer":     {Policies: []trustPolicy{{Name: "any", Issuer: "https://ci.example.com", Claims: map[string]string{"sub": "x"}}}},
+		"bad permission": {Issuers: []trustedIssuer{{Issuer: "https://ci.example.com", Audience: "jig", JWKSURL: issuerServer.URL}}, Policies: []trustPolicy{{Name: "any", Issuer: "https://ci.example.com", Claims: map[string]string{"sub": "x"}, Permissions: []string{"root"}}}},
+	} {
+		if _, err := newOidcFederation(config); err == nil {
+			t.Fatalf("expected a config with %s to be rejected", name)
+		}
+	}
+}
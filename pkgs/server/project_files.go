@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// defaultProjectFilesDir is where the files that @file: references point at
+// are kept per deployment. They are copied out of the upload on deploy, since
+// restarts and the reconciler resolve secrets without one. The files are the
+// SOPS encrypted ones, never their plaintext. Compose deployments keep their
+// whole project, which redeploys render again.
+const defaultProjectFilesDir = "/var/jig/projects"
+
+func projectFilesDir() string {
+	if configured := strings.TrimSpace(os.Getenv("JIG_PROJECT_FILES_DIR")); configured != "" {
+		return configured
+	}
+	return defaultProjectFilesDir
+}
+
+func deploymentProjectFilesDir(deploymentName string) string {
+	return filepath.Join(projectFilesDir(), deploymentName)
+}
+
+// projectSecretStore resolves @file: references against the files of one
+// project and everything else against the store it wraps.
+type projectSecretStore struct {
+	SecretStore
+	root string
+}
+
+func (p projectSecretStore) Provider(scheme string) (SecretProvider, bool) {
+	provider, found := p.SecretStore.Provider(scheme)
+	if files, isFiles := provider.(*sopsFileProvider); isFiles {
+		return &sopsFileProvider{root: p.root, decrypt: files.decrypt}, true
+	}
+	return provider, found
+}
+
+// secretsForProject reads @file: references from root, the directory an upload
+// was extracted to.
+func secretsForProject(secretDb SecretStore, root string) SecretStore {
+	if secretDb == nil {
+		return nil
+	}
+	return projectSecretStore{SecretStore: secretDb, root: root}
+}
+
+// secretsForDeployment reads @file: references from the files kept for a
+// deployment by its last deploy.
+func secretsForDeployment(secretDb SecretStore, deploymentName string) SecretStore {
+	return secretsForProject(secretDb, deploymentProjectFilesDir(deploymentName))
+}
+
+// fileSecretPaths returns the paths that @file: references of the value maps
+// point at.
+func fileSecretPaths(valueMaps ...map[string]string) []string {
+	paths := []string{}
+	follow := func(reference string) (string, error) {
+		if scheme, path, _, _, external := parseProviderReference(reference); external && scheme == "file" && path != "" {
+			if path = filepath.Clean(path); !slices.Contains(paths, path) {
+				paths = append(paths, path)
+			}
+		}
+		return "", nil
+	}
+	for _, values := range valueMaps {
+		for _, value := range values {
+			if strings.HasPrefix(value, "@") {
+				follow(value[1:])
+				continue
+			}
+			interpolateSecrets(value, follow)
+		}
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// readProjectFiles reads paths from the project directory root.
+func readProjectFiles(root string, paths []string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	for _, path := range paths {
+		if !filepath.IsLocal(path) {
+			return nil, fmt.Errorf("secret file %s must be a relative path inside the project", path)
+		}
+		contents, err := os.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			return nil, fmt.Errorf("secret file %s: %w", path, err)
+		}
+		files[path] = contents
+	}
+	return files, nil
+}
+
+// readProjectFilesFromTar is readProjectFiles for an upload that is streamed
+// on to docker instead of extracted. It reads the tarball to its end.
+func readProjectFilesFromTar(upload io.Reader, paths []string) (map[string][]byte, error) {
+	defer io.Copy(io.Discard, upload)
+	files := map[string][]byte{}
+	tr := tar.NewReader(upload)
+	for len(files) < len(paths) {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Clean(header.Name)
+		if header.Typeflag != tar.TypeReg || !slices.Contains(paths, name) {
+			continue
+		}
+		if files[name], err = io.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range paths {
+		if _, found := files[path]; !found {
+			return nil, fmt.Errorf("secret file %s is not part of the upload", path)
+		}
+	}
+	return files, nil
+}
+
+// stageProjectFiles writes files to a new directory next to the kept ones, so
+// that keepProjectFiles can move it in place.
+func stageProjectFiles(files map[string][]byte) (string, error) {
+	if err := os.MkdirAll(projectFilesDir(), 0700); err != nil {
+		return "", err
+	}
+	staged, err := os.MkdirTemp(projectFilesDir(), ".staged-")
+	if err != nil {
+		return "", err
+	}
+	for path, contents := range files {
+		target := filepath.Join(staged, path)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			os.RemoveAll(staged)
+			return "", err
+		}
+		if err := os.WriteFile(target, contents, 0600); err != nil {
+			os.RemoveAll(staged)
+			return "", err
+		}
+	}
+	return staged, nil
+}
+
+// stageProjectDir copies the extracted project at root to a new directory next
+// to the kept ones, like stageProjectFiles.
+func stageProjectDir(root string) (string, error) {
+	if err := os.MkdirAll(projectFilesDir(), 0700); err != nil {
+		return "", err
+	}
+	staged, err := os.MkdirTemp(projectFilesDir(), ".staged-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.CopyFS(staged, os.DirFS(root)); err != nil {
+		os.RemoveAll(staged)
+		return "", err
+	}
+	return staged, nil
+}
+
+// keepProjectFiles replaces the kept files of a deployment with the staged
+// ones. Docker has already been changed at this point, so failures are only
+// logged.
+func keepProjectFiles(deploymentName, staged string) {
+	if err := validateDeploymentName(deploymentName); err != nil {
+		log.Printf("Failed to keep project files: %s", err)
+		return
+	}
+	dir := deploymentProjectFilesDir(deploymentName)
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to replace project files of %s: %s", deploymentName, err)
+		return
+	}
+	if err := os.Rename(staged, dir); err != nil {
+		log.Printf("Failed to keep project files of %s: %s", deploymentName, err)
+	}
+}
+
+func removeProjectFiles(deploymentName string) {
+	if validateDeploymentName(deploymentName) != nil {
+		return
+	}
+	os.RemoveAll(deploymentProjectFilesDir(deploymentName))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+const defaultReconcileInterval = time.Minute
+
+// deploymentChanges is held for reading by every request that changes
+// deployments. The reconciler takes it exclusively so that it never mistakes a
+// deployment in the middle of a rotation for a missing one.
+var deploymentChanges sync.RWMutex
+
+func holdDeploymentChanges(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deploymentChanges.RLock()
+		defer deploymentChanges.RUnlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+type reconcileAction string
+
+const (
+	reconcileRecreate reconcileAction = "recreate"
+	reconcileStart    reconcileAction = "start"
+)
+
+type reconcileStep struct {
+	deployment storedDeployment
+	action     reconcileAction
+}
+
+// planReconcile decides what to do about drifted deployments. Compose projects
+// are left alone, they are only redeployed on request. Unhealthy deployments
+// are only reported, starting a deployment that is still running would not
+// heal it.
+func planReconcile(desired []storedDeployment, observed []jigtypes.Deployment) []reconcileStep {
+	drift := map[string]string{}
+	for _, deployment := range mergeDesiredDeployments(observed, desired) {
+		drift[deployment.Name] = deployment.Drift
+	}
+
+	steps := []reconcileStep{}
+	for _, deployment := range desired {
+		if deployment.DesiredState != desiredStateRunning {
+			continue
+		}
+		if deployment.Kind != storedKindContainer && deployment.Kind != storedKindSwarm {
+			continue
+		}
+		switch drift[deployment.Name] {
+		case "missing":
+			steps = append(steps, reconcileStep{deployment: deployment, action: reconcileRecreate})
+		case "stopped unexpectedly":
+			steps = append(steps, reconcileStep{deployment: deployment, action: reconcileStart})
+		}
+	}
+	return steps
+}
+
+type reconciler struct {
+	cli     *client.Client
+	backend deploymentBackend
+	secrets SecretStore
+	store   *deploymentStore
+}
+
+func (rc *reconciler) observedDeployments() ([]jigtypes.Deployment, error) {
+	deployments, err := listContainerDeployments(rc.cli)
+	if err != nil {
+		return nil, err
+	}
+	if rc.backend == deploymentBackendSwarm {
+		swarmDeployments, err := listSwarmDeployments(rc.cli)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, swarmDeployments...)
+	}
+	return deployments, nil
+}
+
+func (rc *reconciler) recreate(deployment storedDeployment) error {
+	if deployment.Image == "" {
+		return fmt.Errorf("no image recorded")
+	}
+	if _, _, err := rc.cli.ImageInspectWithRaw(context.Background(), deployment.Image); err != nil {
+		return fmt.Errorf("image %s is not available: %w", deployment.Image, err)
+	}
+	envs, files, err := resolveDeploymentSecrets(deployment.Config, secretsForDeployment(rc.secrets, deployment.Name))
+	if err != nil {
+		return err
+	}
+
+	if deployment.Kind == storedKindSwarm {
+		spec, err := makeSwarmServiceSpec(deployment.Config, deployment.Image, envs)
+		if err != nil {
+			return err
+		}
+		if err := attachSwarmSecrets(rc.cli, &spec, files); err != nil {
+			return err
+		}
+		_, err = rc.cli.ServiceCreate(context.Background(), spec, types.ServiceCreateOptions{})
+		return err
+	}
+
+	hostConfig, err := makeContainerHostConfig(deployment.Config)
+	if err != nil {
+		return err
+	}
+	return createDeploymentContainer(rc.cli, deployment.Config, deployment.Image, envs, files, hostConfig)
+}
+
+func (rc *reconciler) start(deployment storedDeployment) error {
+	if deployment.Kind == storedKindSwarm {
+		service, err := findSwarmServiceByDeploymentName(rc.cli, deployment.Name)
+		if err != nil || service == nil {
+			return err
+		}
+		return applySwarmLifecycleAction(rc.cli, *service, deploymentActionStart)
+	}
+	current, err := containerExistsWithName(rc.cli, deployment.Name)
+	if err != nil || current == nil {
+		return err
+	}
+	return applyContainerLifecycleAction(rc.cli, *current, deploymentActionStart)
+}
+
+// reattachNetworks connects single-container deployments that lost their jig
+// network back to it, with the same alias they were created with.
+func (rc *reconciler) reattachNetworks(desired []storedDeployment) {
+	for _, deployment := range desired {
+		if deployment.Kind != storedKindContainer || deployment.DesiredState != desiredStateRunning {
+			continue
+		}
+		inspected, err := rc.cli.ContainerInspect(context.Background(), deployment.Name)
+		if err != nil || inspected.NetworkSettings == nil {
+			continue
+		}
+		if _, connected := inspected.NetworkSettings.Networks["jig"]; connected {
+			continue
+		}
+		log.Printf("Reconcile: reattaching %s to the jig network", deployment.Name)
+		err = rc.cli.NetworkConnect(context.Background(), "jig", inspected.ID, &network.EndpointSettings{
+			Aliases: []string{internalHostname(deployment.Config)},
+		})
+		if err != nil {
+			log.Printf("Reconcile: failed to reattach %s: %s", deployment.Name, err)
+		}
+	}
+}
+
+func (rc *reconciler) reconcile() {
+	if !deploymentChanges.TryLock() {
+		// A deployment is being changed right now, try again next round
+		return
+	}
+	defer deploymentChanges.Unlock()
+
+	if err := ensureNetworkIsUp(rc.cli, rc.backend); err != nil {
+		log.Println("Reconcile: failed to ensure deployment network is running", err)
+	}
+	if err := ensureTraefikRunning(rc.cli, rc.backend); err != nil {
+		log.Println("Reconcile: failed to ensure traefik is running", err)
+	}
+	if rc.backend == deploymentBackendSwarm {
+		if err := ensureSwarmRegistryRunning(rc.cli); err != nil {
+			log.Println("Reconcile: failed to ensure swarm registry is running", err)
+		}
+	}
+
+	desired, err := rc.store.List()
+	if err != nil {
+		log.Println("Reconcile: failed to list desired deployments", err)
+		return
+	}
+	observed, err := rc.observedDeployments()
+	if err != nil {
+		log.Println("Reconcile: failed to list deployments", err)
+		return
+	}
+
+	for _, step := range planReconcile(desired, observed) {
+		log.Printf("Reconcile: %s %s", step.action, step.deployment.Name)
+		var err error
+		switch step.action {
+		case reconcileRecreate:
+			err = rc.recreate(step.deployment)
+		case reconcileStart:
+			err = rc.start(step.deployment)
+		}
+		if err != nil {
+			log.Printf("Reconcile: failed to %s %s: %s", step.action, step.deployment.Name, err)
+		}
+	}
+
+	rc.reattachNetworks(desired)
+}
+
+// startReconciler runs the reconciler every JIG_RECONCILE_INTERVAL, one minute
+// by default. An interval of 0 turns it off.
+func startReconciler(rc *reconciler) error {
+	interval := defaultReconcileInterval
+	if intervalString := strings.TrimSpace(os.Getenv("JIG_RECONCILE_INTERVAL")); intervalString != "" {
+		parsed, err := time.ParseDuration(intervalString)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid JIG_RECONCILE_INTERVAL %q", intervalString)
+		}
+		interval = parsed
+	}
+	if interval == 0 {
+		log.Println("Reconciliation is disabled")
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			rc.reconcile()
+		}
+	}()
+	log.Printf("Reconciling deployments every %s", interval)
+	return nil
+}
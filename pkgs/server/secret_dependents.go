@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// secretReferences returns the names of the secrets that env or secret file
+// maps follow, both whole @name values and ${@name} interpolations. Pinned
+// references like @name:3 are left out since a new version does not change
+// them, and so are references to external providers.
+func secretReferences(valueMaps ...map[string]string) []string {
+	return storeSecretReferences(false, valueMaps...)
+}
+
+// storeSecretReferences returns the names of the store secrets referenced by
+// the value maps, with pinned references counted by name when includePinned
+// is set.
+func storeSecretReferences(includePinned bool, valueMaps ...map[string]string) []string {
+	names := []string{}
+	follow := func(reference string) (string, error) {
+		if _, _, _, _, external := parseProviderReference(reference); external {
+			return "", nil
+		}
+		name, version := parseSecretReference(reference)
+		if version > 0 && !includePinned {
+			return "", nil
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+		return "", nil
+	}
+	for _, values := range valueMaps {
+		for _, value := range values {
+			if strings.HasPrefix(value, "@") {
+				follow(value[1:])
+				continue
+			}
+			// Malformed values fail when deploying, they reference nothing here
+			interpolateSecrets(value, follow)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// secretUsages lists the deployments whose config references a secret, pinned
+// versions included. Compose deployments and swarm stacks are reported per
+// managed service.
+func secretUsages(deployments []storedDeployment, name string) []jigtypes.SecretUsage {
+	usages := []jigtypes.SecretUsage{}
+	for _, deployment := range deployments {
+		if len(deployment.Services) == 0 {
+			if slices.Contains(storeSecretReferences(true, deployment.Config.Envs, deployment.Config.SecretFiles), name) {
+				usages = append(usages, jigtypes.SecretUsage{Deployment: deployment.Name, Kind: deployment.Kind})
+			}
+			continue
+		}
+		services := make([]string, 0, len(deployment.Services))
+		for service := range deployment.Services {
+			services = append(services, service)
+		}
+		slices.Sort(services)
+		for _, service := range services {
+			config := deployment.Services[service]
+			if slices.Contains(storeSecretReferences(true, config.Envs, config.SecretFiles), name) {
+				usages = append(usages, jigtypes.SecretUsage{Deployment: deployment.Name, Service: service, Kind: deployment.Kind})
+			}
+		}
+	}
+	return usages
+}
+
+// secretDependencyIndex maps every secret name to the stored deployments that
+// reference it.
+func secretDependencyIndex(deployments []storedDeployment) map[string][]storedDeployment {
+	index := map[string][]storedDeployment{}
+	for _, deployment := range deployments {
+		for _, name := range secretReferences(deployment.Config.Envs, deployment.Config.SecretFiles) {
+			index[name] = append(index[name], deployment)
+		}
+	}
+	return index
+}
+
+// secretRestartTargets picks the dependents of a secret that opted into
+// restartOnSecretChange and can be recreated in place.
+func secretRestartTargets(dependents []storedDeployment) []storedDeployment {
+	targets := []storedDeployment{}
+	for _, deployment := range dependents {
+		if !deployment.Config.RestartOnSecretChange || deployment.DesiredState != desiredStateRunning {
+			continue
+		}
+		if deployment.Kind != storedKindContainer && deployment.Kind != storedKindSwarm {
+			continue
+		}
+		targets = append(targets, deployment)
+	}
+	return targets
+}
+
+// restartSecretDependents recreates the deployments that follow any of the
+// secrets from their current image, so they pick up the new values. Each
+// deployment is recreated once. It returns the names of the recreated
+// deployments and an error message for each one that failed.
+func (d *DeploymentsRouter) restartSecretDependents(secrets ...string) ([]string, []string) {
+	if d.store == nil || len(secrets) == 0 {
+		return nil, nil
+	}
+	secret := strings.Join(secrets, ", ")
+	deployments, err := d.store.List()
+	if err != nil {
+		log.Printf("Failed to list deployments depending on secret %s: %s", secret, err)
+		return nil, []string{err.Error()}
+	}
+	index := secretDependencyIndex(deployments)
+	targets := []storedDeployment{}
+	for _, name := range secrets {
+		for _, target := range secretRestartTargets(index[name]) {
+			if !slices.ContainsFunc(targets, func(existing storedDeployment) bool { return existing.Name == target.Name }) {
+				targets = append(targets, target)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	deploymentChanges.RLock()
+	defer deploymentChanges.RUnlock()
+
+	restarted := []string{}
+	failures := []string{}
+	for _, target := range targets {
+		if err := d.restartForSecretChange(target.Name); err != nil {
+			log.Printf("Failed to restart %s after secret %s changed: %s", target.Name, secret, err)
+			failures = append(failures, fmt.Sprintf("%s: %s", target.Name, err))
+			continue
+		}
+		log.Printf("Restarted %s after secret %s changed", target.Name, secret)
+		restarted = append(restarted, target.Name)
+	}
+	return restarted, failures
+}
+
+// labeledDeployments rebuilds deployments from the jig.config labels of their
+// containers or services. Compose containers and swarm stack services are
+// grouped by their stack, the rest are keyed by jig.name.
+func labeledDeployments(labelSets []map[string]string) []storedDeployment {
+	deployments := []storedDeployment{}
+	byName := map[string]int{}
+	for _, labels := range labelSets {
+		config, err := deploymentConfigFromLabels(labels)
+		if err != nil {
+			continue
+		}
+		name, service := labels["jig.name"], ""
+		var kind string
+		switch labels["jig.deployment-kind"] {
+		case "compose":
+			kind, name, service = storedKindCompose, labels["jig.stack"], labels["jig.service"]
+		case "swarm-stack-service":
+			kind, name, service = storedKindSwarmStack, labels["jig.stack"], labels["jig.service"]
+		case "swarm":
+			kind = storedKindSwarm
+		default:
+			kind = storedKindContainer
+		}
+		if name == "" {
+			continue
+		}
+		index, found := byName[name]
+		if !found {
+			index = len(deployments)
+			byName[name] = index
+			deployments = append(deployments, storedDeployment{Name: name, Kind: kind, Config: config})
+		}
+		if service == "" {
+			continue
+		}
+		if deployments[index].Services == nil {
+			deployments[index].Config = jigtypes.DeploymentConfig{Name: name}
+			deployments[index].Services = map[string]jigtypes.DeploymentConfig{}
+		}
+		if _, seen := deployments[index].Services[service]; !seen {
+			deployments[index].Services[service] = config
+		}
+	}
+	return deployments
+}
+
+// liveDeployments reads the deployments docker runs from their labels, for
+// those that were deployed before the store existed.
+func (d *DeploymentsRouter) liveDeployments() ([]storedDeployment, error) {
+	labelSets := []map[string]string{}
+	containers, err := d.cli.ContainerList(context.Background(), container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", "jig.name")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		labelSets = append(labelSets, container.Labels)
+	}
+	if d.backend == deploymentBackendSwarm {
+		services, err := d.cli.ServiceList(context.Background(), types.ServiceListOptions{
+			Filters: filters.NewArgs(filters.Arg("label", "jig.name")),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, service := range services {
+			labelSets = append(labelSets, service.Spec.Labels)
+		}
+	}
+	return labeledDeployments(labelSets), nil
+}
+
+// secretUsage lists the deployments that reference a secret. The store is
+// completed with the live deployments it has no record of.
+func (d *DeploymentsRouter) secretUsage(name string) ([]jigtypes.SecretUsage, error) {
+	if d.store == nil {
+		return []jigtypes.SecretUsage{}, nil
+	}
+	deployments, err := d.store.List()
+	if err != nil {
+		return nil, err
+	}
+	if d.cli != nil {
+		live, err := d.liveDeployments()
+		if err != nil {
+			return nil, err
+		}
+		for _, deployment := range live {
+			if !slices.ContainsFunc(deployments, func(stored storedDeployment) bool { return stored.Name == deployment.Name }) {
+				deployments = append(deployments, deployment)
+			}
+		}
+	}
+	return secretUsages(deployments, name), nil
+}
+
+func (d *DeploymentsRouter) restartForSecretChange(name string) error {
+	current, err := loadCurrentDeployment(d.cli, d.backend, name)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("deployment is not running")
+	}
+	envs, files, err := resolveDeploymentSecrets(current.config, secretsForDeployment(d.secret_db, current.config.Name))
+	if err != nil {
+		return err
+	}
+	if err := current.recreate(d.cli, current.config, envs, files); err != nil {
+		return err
+	}
+	d.recordDeployment(current.storedKind(), current.config, current.image)
+	return nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// defaultSecretFilesDir is where secret files for single-container and compose
+// deployments are written. /run is a tmpfs on most hosts, so the values never
+// reach the disk. The jig server needs it mounted at the same path on the host,
+// since the docker daemon resolves bind mount sources there.
+const defaultSecretFilesDir = "/run/jig/secrets"
+
+const jigSecretFileLabel = "jig.secret-file"
+
+// secretFile is an entry of secretFiles with its secret resolved.
+type secretFile struct {
+	Target string
+	Value  string
+}
+
+func secretFilesDir() string {
+	if configured := strings.TrimSpace(os.Getenv("JIG_SECRET_FILES_DIR")); configured != "" {
+		return configured
+	}
+	return defaultSecretFilesDir
+}
+
+// makeSecretFiles resolves the secretFiles of a deployment, a map of absolute
+// paths inside the container to secret references like @gcp_sa or @gcp_sa:2.
+func makeSecretFiles(secretFiles map[string]string, secretDb SecretStore) ([]secretFile, error) {
+	files := []secretFile{}
+	for target, reference := range secretFiles {
+		if !path.IsAbs(target) || path.Clean(target) != target {
+			return nil, fmt.Errorf("secret file %q must be an absolute path", target)
+		}
+		if !strings.HasPrefix(reference, "@") {
+			return nil, fmt.Errorf("secret file %s must reference a secret with @name", target)
+		}
+		value, err := resolveSecretReference(secretDb, reference[1:])
+		if err != nil {
+			return nil, fmt.Errorf("secret file %s: %w", target, err)
+		}
+		files = append(files, secretFile{Target: target, Value: value})
+	}
+	slices.SortFunc(files, func(a, b secretFile) int {
+		return strings.Compare(a.Target, b.Target)
+	})
+	return files, nil
+}
+
+// digest identifies the contents of a secret file. Files are never changed in
+// place, a new value gets a new file so the rollback revision keeps the old one.
+func (f secretFile) digest() string {
+	sum := sha256.Sum256([]byte(f.Target + "\x00" + f.Value))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func secretFileHostPath(deploymentName string, file secretFile) string {
+	return filepath.Join(secretFilesDir(), deploymentName, file.digest())
+}
+
+// writeSecretFiles writes the files of a deployment to the secret files
+// directory and returns the read-only bind mounts that expose them.
+func writeSecretFiles(deploymentName string, files []secretFile) ([]mount.Mount, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if err := validateDeploymentName(deploymentName); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(secretFilesDir(), deploymentName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	mounts := []mount.Mount{}
+	for _, file := range files {
+		hostPath := secretFileHostPath(deploymentName, file)
+		if _, err := os.Stat(hostPath); errors.Is(err, os.ErrNotExist) {
+			// The directory keeps other users out, the file has to be readable
+			// by whichever user the container runs as
+			if err := os.WriteFile(hostPath, []byte(file.Value), 0444); err != nil {
+				return nil, err
+			}
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   hostPath,
+			Target:   file.Target,
+			ReadOnly: true,
+		})
+	}
+	return mounts, nil
+}
+
+// pruneSecretFiles removes the files of a deployment that none of its
+// containers, including the rollback one, mount anymore.
+func pruneSecretFiles(cli *client.Client, deploymentName string) {
+	dir := filepath.Join(secretFilesDir(), deploymentName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	containers, err := cli.ContainerList(context.Background(), container.ListOptions{All: true})
+	if err != nil {
+		log.Printf("Failed to prune secret files of %s: %s", deploymentName, err)
+		return
+	}
+	inUse := map[string]bool{}
+	for _, containerInfo := range containers {
+		if containerInfo.Labels["jig.name"] != deploymentName {
+			continue
+		}
+		for _, mountPoint := range containerInfo.Mounts {
+			inUse[mountPoint.Source] = true
+		}
+	}
+	for _, entry := range entries {
+		hostPath := filepath.Join(dir, entry.Name())
+		if inUse[hostPath] {
+			continue
+		}
+		if err := os.Remove(hostPath); err != nil {
+			log.Printf("Failed to remove secret file %s: %s", hostPath, err)
+		}
+	}
+}
+
+func removeSecretFiles(deploymentName string) {
+	if validateDeploymentName(deploymentName) != nil {
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(secretFilesDir(), deploymentName)); err != nil {
+		log.Printf("Failed to remove secret files of %s: %s", deploymentName, err)
+	}
+}
+
+// swarmSecretName names the docker secret holding a file. Docker secrets can
+// not be updated, so the name changes with the contents.
+func swarmSecretName(deploymentName string, file secretFile) string {
+	suffix := "-" + file.digest()
+	// Docker limits secret names to 64 characters
+	if len(deploymentName)+len(suffix) > 64 {
+		deploymentName = deploymentName[:64-len(suffix)]
+	}
+	return deploymentName + suffix
+}
+
+// ensureSwarmSecrets creates the docker secrets for the files of a deployment
+// and returns references that mount them at their targets.
+func ensureSwarmSecrets(cli *client.Client, deploymentName string, files []secretFile) ([]*swarm.SecretReference, error) {
+	references := []*swarm.SecretReference{}
+	for _, file := range files {
+		name := swarmSecretName(deploymentName, file)
+		existing, err := cli.SecretList(context.Background(), types.SecretListOptions{
+			Filters: filters.NewArgs(filters.Arg("name", name)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		secretID := ""
+		for _, secret := range existing {
+			if secret.Spec.Name == name {
+				secretID = secret.ID
+			}
+		}
+		if secretID == "" {
+			created, err := cli.SecretCreate(context.Background(), swarm.SecretSpec{
+				Annotations: swarm.Annotations{
+					Name:   name,
+					Labels: map[string]string{"jig.name": deploymentName, jigSecretFileLabel: "true"},
+				},
+				Data: []byte(file.Value),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("create docker secret for %s: %w", file.Target, err)
+			}
+			secretID = created.ID
+		}
+		references = append(references, &swarm.SecretReference{
+			File:       &swarm.SecretReferenceFileTarget{Name: file.Target, UID: "0", GID: "0", Mode: 0444},
+			SecretID:   secretID,
+			SecretName: name,
+		})
+	}
+	return references, nil
+}
+
+// attachSwarmSecrets mounts the secret files of a deployment into its service.
+func attachSwarmSecrets(cli *client.Client, spec *swarm.ServiceSpec, files []secretFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	references, err := ensureSwarmSecrets(cli, spec.Name, files)
+	if err != nil {
+		return err
+	}
+	spec.TaskTemplate.ContainerSpec.Secrets = references
+	return nil
+}
+
+func swarmSpecSecretNames(spec *swarm.ServiceSpec, names map[string]bool) {
+	if spec == nil || spec.TaskTemplate.ContainerSpec == nil {
+		return
+	}
+	for _, reference := range spec.TaskTemplate.ContainerSpec.Secrets {
+		names[reference.SecretName] = true
+	}
+}
+
+// pruneSwarmSecrets removes the docker secrets of a deployment that neither the
+// current nor the previous spec of its services references.
+func pruneSwarmSecrets(cli *client.Client, deploymentName string) {
+	secrets, err := cli.SecretList(context.Background(), types.SecretListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("label", "jig.name="+deploymentName),
+			filters.Arg("label", jigSecretFileLabel),
+		),
+	})
+	if err != nil || len(secrets) == 0 {
+		return
+	}
+	services, err := cli.ServiceList(context.Background(), types.ServiceListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", "jig.name="+deploymentName)),
+	})
+	if err != nil {
+		log.Printf("Failed to prune docker secrets of %s: %s", deploymentName, err)
+		return
+	}
+	inUse := map[string]bool{}
+	for _, service := range services {
+		swarmSpecSecretNames(&service.Spec, inUse)
+		swarmSpecSecretNames(service.PreviousSpec, inUse)
+	}
+	for _, secret := range secrets {
+		if inUse[secret.Spec.Name] {
+			continue
+		}
+		if err := cli.SecretRemove(context.Background(), secret.ID); err != nil {
+			log.Printf("Failed to remove docker secret %s: %s", secret.Spec.Name, err)
+		}
+	}
+}
+
+// resolveDeploymentSecrets resolves everything a single deployment reads from
+// the secret store: its env values and its secret files.
+func resolveDeploymentSecrets(config jigtypes.DeploymentConfig, secretDb SecretStore) ([]string, []secretFile, error) {
+	envs, err := makeEnvs(config.Envs, secretDb)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := makeSecretFiles(config.SecretFiles, secretDb)
+	if err != nil {
+		return nil, nil, err
+	}
+	return envs, files, nil
+}
+
+// mountedSecretFile is a secret file that a container bind mounts, known by
+// its target and the digest its host path was named after.
+type mountedSecretFile struct {
+	Target string
+	Digest string
+}
+
+// mountedSecretFiles lists the secret files that the containers of every
+// deployment mount, the rollback ones included, by deployment name.
+func mountedSecretFiles(cli *client.Client) (map[string][]mountedSecretFile, error) {
+	containers, err := cli.ContainerList(context.Background(), container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", "jig.name")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	mounted := map[string][]mountedSecretFile{}
+	for _, containerInfo := range containers {
+		name := containerInfo.Labels["jig.name"]
+		dir := filepath.Join(secretFilesDir(), name)
+		for _, mountPoint := range containerInfo.Mounts {
+			if filepath.Dir(mountPoint.Source) != dir {
+				continue
+			}
+			file := mountedSecretFile{Target: mountPoint.Destination, Digest: filepath.Base(mountPoint.Source)}
+			if !slices.Contains(mounted[name], file) {
+				mounted[name] = append(mounted[name], file)
+			}
+		}
+	}
+	return mounted, nil
+}
+
+// restoreSecretFiles writes the secret files of single-container and compose
+// deployments again when the server starts, the secret files directory does
+// not survive a reboot and docker refuses to start containers whose bind
+// mounts are missing.
+func restoreSecretFiles(cli *client.Client, store *deploymentStore, secretDb SecretStore) {
+	mounted, err := mountedSecretFiles(cli)
+	if err != nil {
+		log.Println("Failed to list containers to restore secret files", err)
+		return
+	}
+	restoreMountedSecretFiles(store, secretDb, mounted)
+}
+
+// restoreMountedSecretFiles writes the files that containers mount. Secrets
+// may have changed since the containers were created, so the value of each
+// file is the version of its secret that matches the digest in its path, not
+// the current one.
+func restoreMountedSecretFiles(store *deploymentStore, secretDb SecretStore, mounted map[string][]mountedSecretFile) {
+	deployments, err := store.List()
+	if err != nil {
+		log.Println("Failed to list deployments to restore secret files", err)
+		return
+	}
+	for _, deployment := range deployments {
+		// Compose services mount files written under their own deployment name
+		configs := []jigtypes.DeploymentConfig{}
+		switch deployment.Kind {
+		case storedKindContainer:
+			configs = append(configs, deployment.Config)
+			configs[0].Name = deployment.Name
+		case storedKindCompose:
+			for _, service := range deployment.Services {
+				configs = append(configs, service)
+			}
+		}
+		// @file: references are read from the project of the whole deployment
+		projectSecrets := secretsForDeployment(secretDb, deployment.Name)
+		for _, config := range configs {
+			for _, file := range mounted[config.Name] {
+				hostPath := filepath.Join(secretFilesDir(), config.Name, file.Digest)
+				if _, err := os.Stat(hostPath); err == nil {
+					continue
+				}
+				restored, err := mountedSecretFileValue(config.SecretFiles[file.Target], file, projectSecrets)
+				if err == nil {
+					_, err = writeSecretFiles(config.Name, []secretFile{restored})
+				}
+				if err != nil {
+					log.Printf("Failed to restore secret file %s of %s: %s", file.Target, config.Name, err)
+				}
+			}
+		}
+	}
+}
+
+// mountedSecretFileValue finds the value of reference that a mounted file was
+// written with. Store secrets are searched through all of their versions,
+// other providers only have their current value.
+func mountedSecretFileValue(reference string, file mountedSecretFile, secretDb SecretStore) (secretFile, error) {
+	if !strings.HasPrefix(reference, "@") {
+		return secretFile{}, errors.New("the deployment config no longer has this secret file")
+	}
+	candidates := []string{}
+	if _, _, _, _, external := parseProviderReference(reference[1:]); external {
+		value, err := resolveSecretReference(secretDb, reference[1:])
+		if err != nil {
+			return secretFile{}, err
+		}
+		candidates = append(candidates, value)
+	} else {
+		name, _ := parseSecretReference(reference[1:])
+		versions, err := secretDb.VersionValues(name)
+		if err != nil {
+			return secretFile{}, err
+		}
+		for _, version := range versions {
+			candidates = append(candidates, version.Value)
+		}
+	}
+	for _, value := range candidates {
+		if candidate := (secretFile{Target: file.Target, Value: value}); candidate.digest() == file.Digest {
+			return candidate, nil
+		}
+	}
+	return secretFile{}, fmt.Errorf("no value of %s matches the mounted file", reference)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecretProvider reads secrets that live outside of jig, addressed as
+// @<scheme>:<path>#<key> with an optional :<version> pin.
+type SecretProvider interface {
+	// Lookup returns key of the secret at path, version 0 is the latest
+	Lookup(path, key string, version int) (string, error)
+}
+
+// secretProviderSchemes are recognised even when they are not configured, so a
+// missing provider is reported instead of a missing store secret.
+var secretProviderSchemes = []string{"vault", "file"}
+
+// secretProvidersFromEnv builds the providers the server environment
+// configures, they are handed to the secret store on startup.
+func secretProvidersFromEnv() map[string]SecretProvider {
+	providers := map[string]SecretProvider{
+		"file": &sopsFileProvider{decrypt: decryptSopsFile},
+	}
+	if address := firstEnv("JIG_VAULT_ADDR", "VAULT_ADDR"); address != "" {
+		providers["vault"] = &vaultProvider{
+			address: strings.TrimSuffix(address, "/"),
+			token:   firstEnv("JIG_VAULT_TOKEN", "VAULT_TOKEN"),
+			client:  &http.Client{Timeout: 10 * time.Second},
+		}
+		log.Println("Resolving @vault: secrets from", address)
+	}
+	return providers
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseProviderReference splits a reference like "vault:secret/app#password:2"
+// into its scheme, path, key and version. ok is false for store references.
+func parseProviderReference(reference string) (scheme, path, key string, version int, ok bool) {
+	scheme, rest, found := strings.Cut(reference, ":")
+	if !found || !isSecretProviderScheme(scheme) {
+		return "", "", "", 0, false
+	}
+	rest, version = parseSecretReference(rest)
+	path, key, _ = strings.Cut(rest, "#")
+	return scheme, path, key, version, true
+}
+
+// usesSecretProviders reports whether any value of the maps references a
+// provider, whole or interpolated.
+func usesSecretProviders(valueMaps ...map[string]string) bool {
+	found := false
+	follow := func(reference string) (string, error) {
+		if _, _, _, _, external := parseProviderReference(reference); external {
+			found = true
+		}
+		return "", nil
+	}
+	for _, values := range valueMaps {
+		for _, value := range values {
+			if strings.HasPrefix(value, "@") {
+				follow(value[1:])
+				continue
+			}
+			interpolateSecrets(value, follow)
+		}
+	}
+	return found
+}
+
+func isSecretProviderScheme(scheme string) bool {
+	return slices.Contains(secretProviderSchemes, scheme)
+}
+
+func lookupProviderSecret(secretDb SecretStore, scheme, path, key string, version int) (string, error) {
+	var provider SecretProvider
+	configured := false
+	if secretDb != nil {
+		provider, configured = secretDb.Provider(scheme)
+	}
+	if !configured {
+		return "", fmt.Errorf("the %s secret provider is not configured", scheme)
+	}
+	if path == "" || key == "" {
+		return "", fmt.Errorf("expected @%s:<path>#<key>", scheme)
+	}
+	return provider.Lookup(path, key, version)
+}
+
+// vaultProvider reads the KV version 2 engine of Vault, or anything that
+// speaks its HTTP API. The first path segment is the mount, so
+// @vault:secret/app#password reads secret/data/app.
+type vaultProvider struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+func (v *vaultProvider) Lookup(path, key string, version int) (string, error) {
+	mount, secretPath, found := strings.Cut(strings.Trim(path, "/"), "/")
+	if !found || secretPath == "" {
+		return "", fmt.Errorf("vault path %q must be <mount>/<path>", path)
+	}
+	endpoint := v.address + "/v1/" + mount + "/data/" + secretPath
+	if version > 0 {
+		endpoint += "?" + url.Values{"version": {strconv.Itoa(version)}}.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("vault secret %s not found", path)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode vault response for %s: %w", path, err)
+	}
+	value, found := body.Data.Data[key]
+	if !found {
+		return "", fmt.Errorf("vault secret %s has no key %s", path, key)
+	}
+	return secretValueString(value)
+}
+
+// sopsFileProvider reads SOPS encrypted files of the project a deployment was
+// uploaded from. The key to decrypt them, for example SOPS_AGE_KEY_FILE, comes
+// from the server environment. The store holds it without a root, see
+// secretsForProject for how a deployment gets its own.
+type sopsFileProvider struct {
+	root string
+	// decrypt returns the plaintext of a file as JSON
+	decrypt func(path string) ([]byte, error)
+}
+
+func (f *sopsFileProvider) Lookup(path, key string, version int) (string, error) {
+	if version > 0 {
+		return "", errors.New("file secrets can not be pinned to a version")
+	}
+	if f.root == "" {
+		return "", errors.New("file secrets are read from the uploaded project, this deployment has none")
+	}
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("secret file %s must be a relative path inside the project", path)
+	}
+	plaintext, err := f.decrypt(filepath.Join(f.root, path))
+	if err != nil {
+		return "", fmt.Errorf("decrypt %s: %w", path, err)
+	}
+	var document map[string]any
+	if err := json.Unmarshal(plaintext, &document); err != nil {
+		return "", fmt.Errorf("decode %s: %w", path, err)
+	}
+	value, found := lookupDocumentKey(document, key)
+	if !found {
+		return "", fmt.Errorf("%s has no key %s", path, key)
+	}
+	return secretValueString(value)
+}
+
+// lookupDocumentKey finds key in a decrypted document, nested keys are
+// separated with dots, for example database.password.
+func lookupDocumentKey(document map[string]any, key string) (any, bool) {
+	if value, found := document[key]; found {
+		return value, true
+	}
+	head, rest, nested := strings.Cut(key, ".")
+	if !nested {
+		return nil, false
+	}
+	child, ok := document[head].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return lookupDocumentKey(child, rest)
+}
+
+// secretValueString turns a value of a decoded document into an env value.
+// Strings are used as they are, anything else as JSON.
+func secretValueString(value any) (string, error) {
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+func decryptSopsFile(path string) ([]byte, error) {
+	cmd := exec.Command("sops", "--decrypt", "--output-type", "json", path)
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return output, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+)
+
+const redactedSecret = "[redacted]"
+
+// minRedactedSecretLength keeps short values like "1" or "yes" from turning
+// every output line into noise.
+const minRedactedSecretLength = 4
+
+// maxRedactionBuffer bounds how much of an unterminated line is held back
+// before it is written anyway.
+const maxRedactionBuffer = 64 * 1024
+
+// secretRedactor replaces known secret values in output with [redacted].
+type secretRedactor struct {
+	replacer *strings.Replacer
+}
+
+// newSecretRedactor builds a redactor for values, both as they are and as they
+// appear inside JSON strings, since the deploy stream relays docker's JSON
+// messages.
+func newSecretRedactor(values []string) *secretRedactor {
+	patterns := []string{}
+	for _, value := range values {
+		if len(value) < minRedactedSecretLength {
+			continue
+		}
+		patterns = append(patterns, value)
+		if encoded, err := json.Marshal(value); err == nil {
+			patterns = append(patterns, string(encoded[1:len(encoded)-1]))
+		}
+	}
+	slices.Sort(patterns)
+	patterns = slices.Compact(patterns)
+	// The replacer tries patterns in order, longer values must win over values
+	// they contain
+	slices.SortStableFunc(patterns, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	if len(patterns) == 0 {
+		return &secretRedactor{}
+	}
+	pairs := make([]string, 0, len(patterns)*2)
+	for _, pattern := range patterns {
+		pairs = append(pairs, pattern, redactedSecret)
+	}
+	return &secretRedactor{replacer: strings.NewReplacer(pairs...)}
+}
+
+func (r *secretRedactor) redact(text string) string {
+	if r.replacer == nil {
+		return text
+	}
+	return r.replacer.Replace(text)
+}
+
+// redactingResponseWriter holds output back until a line is complete, so a
+// secret split across two writes is still caught, and redacts it on the way out.
+type redactingResponseWriter struct {
+	http.ResponseWriter
+	redactor *secretRedactor
+	pending  []byte
+	// resolved returns the values read from providers, a deploy resolves new
+	// ones while it writes output. The redactor is rebuilt when they change.
+	resolved      func() []string
+	storeValues   []string
+	resolvedCount int
+}
+
+func (w *redactingResponseWriter) refreshRedactor() {
+	if w.resolved == nil {
+		return
+	}
+	resolved := w.resolved()
+	if w.redactor != nil && len(resolved) == w.resolvedCount {
+		return
+	}
+	w.resolvedCount = len(resolved)
+	w.redactor = newSecretRedactor(append(slices.Clone(w.storeValues), resolved...))
+}
+
+func (w *redactingResponseWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	complete := bytes.LastIndexByte(w.pending, '\n') + 1
+	if complete == 0 && len(w.pending) > maxRedactionBuffer {
+		complete = len(w.pending)
+	}
+	if complete == 0 {
+		return len(p), nil
+	}
+	w.refreshRedactor()
+	if _, err := w.ResponseWriter.Write([]byte(w.redactor.redact(string(w.pending[:complete])))); err != nil {
+		return 0, err
+	}
+	w.pending = append(w.pending[:0], w.pending[complete:]...)
+	return len(p), nil
+}
+
+func (w *redactingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish writes whatever is left once the handler is done.
+func (w *redactingResponseWriter) finish() {
+	if len(w.pending) == 0 {
+		return
+	}
+	w.refreshRedactor()
+	w.ResponseWriter.Write([]byte(w.redactor.redact(string(w.pending))))
+	w.pending = nil
+}
+
+// redactSecrets keeps the values of every secret, including old versions and
+// values read from providers, out of the response. Deploy output and container
+// logs can echo env values.
+func (dr DeploymentsRouter) redactSecrets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dr.secret_db == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		values, err := dr.secret_db.Values()
+		if err != nil {
+			log.Println("Failed to load secrets for redaction", err)
+			http.Error(w, "Failed to load secrets for redaction", http.StatusInternalServerError)
+			return
+		}
+		redacting := &redactingResponseWriter{ResponseWriter: w, storeValues: values, resolved: dr.secret_db.ResolvedValues}
+		defer redacting.finish()
+		next.ServeHTTP(redacting, r)
+	})
+}
+
+// trackProviderSecrets resolves the configs of every stored deployment once
+// when the server starts. Values read from providers are only known after
+// they were resolved, and logs of deployments from before the start would
+// show them otherwise.
+func trackProviderSecrets(store *deploymentStore, secretDb SecretStore) {
+	deployments, err := store.List()
+	if err != nil {
+		log.Println("Failed to list deployments to track provider secrets", err)
+		return
+	}
+	for _, deployment := range deployments {
+		configs := []jigtypes.DeploymentConfig{deployment.Config}
+		for _, service := range deployment.Services {
+			configs = append(configs, service)
+		}
+		for _, config := range configs {
+			if !usesSecretProviders(config.Envs, config.SecretFiles) {
+				continue
+			}
+			if _, _, err := resolveDeploymentSecrets(config, secretsForDeployment(secretDb, deployment.Name)); err != nil {
+				log.Printf("Failed to resolve provider secrets of %s: %s", deployment.Name, err)
+			}
+		}
+	}
+}
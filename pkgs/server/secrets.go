@@ -3,25 +3,104 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	jigtypes "askh.at/jig/v2/pkgs/types"
 	"github.com/go-chi/chi/v5"
 )
 
 type SecretRouter struct {
-	secret_db *Secrets
+	secret_db SecretStore
+	// deployments recreates the dependents of a secret after it changes
+	deployments *DeploymentsRouter
 }
 
 func (sr SecretRouter) Router() chi.Router {
 	router := chi.NewRouter()
 	router.Post("/", sr.createSecret)
 	router.Get("/", sr.listSecrets)
-	router.Delete("/{name}", sr.deleteSecret)
-	router.Get("/{name}", sr.getSecret)
+	router.Post("/batch", sr.batchSecrets)
+	router.Get("/export", sr.exportSecrets)
+	router.Group(func(router chi.Router) {
+		router.Use(sr.requireSecretScope)
+		router.Delete("/{name}", sr.deleteSecret)
+		router.Get("/{name}", sr.getSecret)
+		router.Put("/{name}", sr.updateSecret)
+		router.Get("/{name}/versions", sr.listSecretVersions)
+		router.Get("/{name}/usage", sr.getSecretUsage)
+		router.Post("/{name}/rollback", sr.rollbackSecret)
+		router.Post("/{name}/write-only", sr.makeSecretWriteOnly)
+	})
 	return router
 }
 
+// secretOutOfScope names a deployment outside the scopes of the token behind
+// the request that uses the secret, or is empty. Changing such a secret would
+// reach into deployments the token can not touch, while secrets that nothing
+// uses are open to every token.
+func (sr SecretRouter) secretOutOfScope(r *http.Request, name string) (string, error) {
+	token := tokenFromContext(r.Context())
+	if token == nil || len(token.Scopes) == 0 {
+		return "", nil
+	}
+	usages, err := sr.secretUsage(name)
+	if err != nil {
+		return "", err
+	}
+	for _, usage := range usages {
+		if !token.CanAccessDeployment(usage.Deployment) {
+			return formatSecretUsage(usage), nil
+		}
+	}
+	return "", nil
+}
+
+// refuseSecretOutOfScope writes a 403 and returns true when the secret is out
+// of the scopes of the token, see secretOutOfScope.
+func (sr SecretRouter) refuseSecretOutOfScope(w http.ResponseWriter, r *http.Request, name string) bool {
+	outside, err := sr.secretOutOfScope(r, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	if outside != "" {
+		http.Error(w, fmt.Sprintf("Secret %s is used by %s, which this token is not scoped to", name, outside), http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// requireSecretScope refuses requests for a {name} secret outside the scopes
+// of the token.
+func (sr SecretRouter) requireSecretScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sr.refuseSecretOutOfScope(w, r, chi.URLParam(r, "name")) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestAuthor names the token behind a request, it is recorded with every
+// secret version.
+func requestAuthor(r *http.Request) string {
+	if token := tokenFromContext(r.Context()); token != nil {
+		return token.Name
+	}
+	return ""
+}
+
+// canRevealSecrets reports whether the token behind a request may read secret
+// values back, deployments can use any secret either way.
+func canRevealSecrets(r *http.Request) bool {
+	token := tokenFromContext(r.Context())
+	return token != nil && token.CanRevealSecrets()
+}
+
 func (sr SecretRouter) createSecret(w http.ResponseWriter, r *http.Request) {
 	secret_db := sr.secret_db
 
@@ -30,8 +109,12 @@ func (sr SecretRouter) createSecret(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	setAuditTarget(r, body.Name)
+	if sr.refuseSecretOutOfScope(w, r, body.Name) {
+		return
+	}
 
-	if err := secret_db.Insert(body.Name, body.Value); err != nil {
+	if err := secret_db.InsertAs(body.Name, body.Value, requestAuthor(r), body.WriteOnly); err != nil {
 		switch {
 		case errors.Is(err, ErrSecretExists):
 			http.Error(w, err.Error(), http.StatusConflict)
@@ -56,7 +139,13 @@ func (sr SecretRouter) listSecrets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	secretList := jigtypes.SecretList{Secrets: secrets}
+	writeOnly, err := secret_db.ListWriteOnly()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	secretList := jigtypes.SecretList{Secrets: secrets, WriteOnly: writeOnly}
 
 	secretsJson, err := json.Marshal(secretList)
 	if err != nil {
@@ -73,6 +162,23 @@ func (sr SecretRouter) deleteSecret(w http.ResponseWriter, r *http.Request) {
 
 	name := r.PathValue("name")
 
+	// Deleting a secret that deployments reference breaks their next deploy
+	if r.URL.Query().Get("force") != "true" {
+		usages, err := sr.secretUsage(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(usages) > 0 {
+			users := make([]string, 0, len(usages))
+			for _, usage := range usages {
+				users = append(users, formatSecretUsage(usage))
+			}
+			http.Error(w, fmt.Sprintf("Secret %s is used by %s, force the deletion to remove it anyway", name, strings.Join(users, ", ")), http.StatusConflict)
+			return
+		}
+	}
+
 	err := secret_db.Delete(name)
 	if err != nil {
 		println("Failed to delete secret", err.Error())
@@ -83,10 +189,60 @@ func (sr SecretRouter) deleteSecret(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (sr SecretRouter) secretUsage(name string) ([]jigtypes.SecretUsage, error) {
+	if sr.deployments == nil {
+		return []jigtypes.SecretUsage{}, nil
+	}
+	return sr.deployments.secretUsage(name)
+}
+
+func formatSecretUsage(usage jigtypes.SecretUsage) string {
+	if usage.Service != "" {
+		return usage.Deployment + "/" + usage.Service
+	}
+	return usage.Deployment
+}
+
+func (sr SecretRouter) getSecretUsage(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	if _, err := sr.secret_db.CurrentVersion(name); err != nil {
+		if errors.Is(err, ErrSecretNotFound) {
+			http.Error(w, "Secret not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	usages, err := sr.secretUsage(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJson(w, http.StatusOK, jigtypes.SecretUsageResponse{Name: name, Usages: usages})
+}
+
 func (sr SecretRouter) getSecret(w http.ResponseWriter, r *http.Request) {
 	secret_db := sr.secret_db
 
 	name := r.PathValue("name")
+	if !canRevealSecrets(r) {
+		http.Error(w, "This token can not reveal secret values", http.StatusForbidden)
+		return
+	}
+	writeOnly, err := secret_db.IsWriteOnly(name)
+	if errors.Is(err, ErrSecretNotFound) {
+		http.Error(w, "Secret not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if writeOnly {
+		http.Error(w, "Secret is write-only", http.StatusForbidden)
+		return
+	}
 	secret, found, err := secret_db.Get(name)
 	if err != nil {
 		println("Failed to get secret", err.Error())
@@ -95,6 +251,7 @@ func (sr SecretRouter) getSecret(w http.ResponseWriter, r *http.Request) {
 	}
 	if !found {
 		http.Error(w, "Secret not found", http.StatusNotFound)
+		return
 	}
 
 	var secretList jigtypes.SecretInspect = jigtypes.SecretInspect{Value: secret}
@@ -108,3 +265,175 @@ func (sr SecretRouter) getSecret(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(secretJson)
 }
+
+func (sr SecretRouter) updateSecret(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var body jigtypes.UpdateSecretBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := sr.secret_db.Put(name, body.Value, requestAuthor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, sr.afterSecretChange(name, version))
+}
+
+// afterSecretChange restarts the deployments that asked to follow the secret
+// and reports the outcome together with the new version.
+func (sr SecretRouter) afterSecretChange(name string, version int) jigtypes.SecretVersionResponse {
+	response := jigtypes.SecretVersionResponse{Name: name, Version: version}
+	if sr.deployments != nil {
+		response.Restarted, response.RestartErrors = sr.deployments.restartSecretDependents(name)
+	}
+	return response
+}
+
+func (sr SecretRouter) listSecretVersions(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	current, err := sr.secret_db.CurrentVersion(name)
+	if err != nil {
+		if errors.Is(err, ErrSecretNotFound) {
+			http.Error(w, "Secret not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	versions, err := sr.secret_db.Versions(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	versionList := jigtypes.SecretVersionList{Name: name, Current: current, Versions: []jigtypes.SecretVersion{}}
+	for _, version := range versions {
+		versionList.Versions = append(versionList.Versions, jigtypes.SecretVersion{
+			Version:   version.Version,
+			CreatedAt: version.CreatedAt.Format(time.RFC3339),
+			CreatedBy: version.CreatedBy,
+		})
+	}
+	respondWithJson(w, http.StatusOK, versionList)
+}
+
+func (sr SecretRouter) rollbackSecret(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var body jigtypes.SecretRollbackBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := sr.secret_db.Rollback(name, body.Version, requestAuthor(r))
+	if err != nil {
+		if errors.Is(err, ErrSecretVersionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, sr.afterSecretChange(name, version))
+}
+
+func (sr SecretRouter) makeSecretWriteOnly(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	if err := sr.secret_db.SetWriteOnly(name); err != nil {
+		if errors.Is(err, ErrSecretNotFound) {
+			http.Error(w, "Secret not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (sr SecretRouter) batchSecrets(w http.ResponseWriter, r *http.Request) {
+	var body jigtypes.SecretBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := make([]string, 0, len(body.Secrets))
+	for name := range body.Secrets {
+		if name == "" {
+			http.Error(w, "Secret names can not be empty", http.StatusBadRequest)
+			return
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	setAuditTarget(r, strings.Join(names, ","))
+	for _, name := range names {
+		if sr.refuseSecretOutOfScope(w, r, name) {
+			return
+		}
+	}
+
+	result, err := sr.secret_db.PutBatch(body.Secrets, body.Overwrite, requestAuthor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := jigtypes.SecretBatchResponse{
+		Created: len(result.Created),
+		Updated: len(result.Updated),
+		Skipped: len(result.Skipped),
+	}
+	if sr.deployments != nil {
+		response.Restarted, response.RestartErrors = sr.deployments.restartSecretDependents(result.Updated...)
+	}
+	respondWithJson(w, http.StatusOK, response)
+}
+
+func (sr SecretRouter) exportSecrets(w http.ResponseWriter, r *http.Request) {
+	if !canRevealSecrets(r) {
+		http.Error(w, "This token can not reveal secret values", http.StatusForbidden)
+		return
+	}
+	names, err := sr.secret_db.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeOnly, err := sr.secret_db.ListWriteOnly()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	export := jigtypes.SecretExport{Secrets: map[string]string{}, WriteOnly: writeOnly}
+	for _, name := range names {
+		if slices.Contains(writeOnly, name) {
+			continue
+		}
+		// Scoped tokens only export the secrets they could change
+		outside, err := sr.secretOutOfScope(r, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if outside != "" {
+			continue
+		}
+		value, err := sr.secret_db.GetValue(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		export.Secrets[name] = value
+	}
+	respondWithJson(w, http.StatusOK, export)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultMasterKeyFile is kept apart from /var/jig, so that a copy of the state
+// directory with the database does not carry the key that decrypts it. It is
+// only read, a key is generated only where JIG_MASTER_KEY_FILE points, since
+// the server can not tell whether a path outlives its container.
+const defaultMasterKeyFile = "/etc/jig/master.key"
+
+// legacyMasterKeyFile is where older versions generated the key, it is still
+// used while it exists and no key has been moved to the default path.
+const legacyMasterKeyFile = "/var/jig/master.key"
+
+// encryptedSecretPrefix marks values written with envelope encryption: every
+// value has its own data key, which is stored wrapped with the master key.
+const encryptedSecretPrefix = "jig:v1:"
+
+var errMasterKeyMissing = errors.New("secret is encrypted but no master key is configured")
+
+var errMasterKeyNotConfigured = errors.New("no master key is configured, set JIG_MASTER_KEY or JIG_MASTER_KEY_FILE")
+
+type masterKey struct {
+	key []byte
+	// path is where the key was loaded from, it is empty when the key came from
+	// JIG_MASTER_KEY and can therefore not be rotated by the server.
+	path string
+}
+
+func parseMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+func generateMasterKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func writeMasterKeyFile(path string, key []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+}
+
+// loadMasterKey reads the master key from JIG_MASTER_KEY, or from the file in
+// JIG_MASTER_KEY_FILE, generating that file on first start. Without either it
+// falls back to an existing key file and fails with errMasterKeyNotConfigured
+// when there is none.
+func loadMasterKey() (*masterKey, error) {
+	if encoded := os.Getenv("JIG_MASTER_KEY"); encoded != "" {
+		key, err := parseMasterKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("JIG_MASTER_KEY: %w", err)
+		}
+		return &masterKey{key: key}, nil
+	}
+
+	path, configured := masterKeyFile()
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if !configured {
+			return nil, errMasterKeyNotConfigured
+		}
+		if legacy, err := os.ReadFile(legacyMasterKeyFile); err == nil && path != legacyMasterKeyFile {
+			// A new key would not decrypt what the old one encrypted
+			key, err := parseMasterKey(string(legacy))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", legacyMasterKeyFile, err)
+			}
+			if err := writeMasterKeyFile(path, key); err != nil {
+				return nil, err
+			}
+			log.Printf("Moved the master key from %s to %s, remove the old file once backups of it are no longer needed", legacyMasterKeyFile, path)
+			return &masterKey{key: key, path: path}, nil
+		}
+		key, err := generateMasterKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeMasterKeyFile(path, key); err != nil {
+			return nil, err
+		}
+		return &masterKey{key: key, path: path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseMasterKey(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &masterKey{key: key, path: path}, nil
+}
+
+// masterKeyFile returns the key file to read and whether the operator chose
+// it with JIG_MASTER_KEY_FILE.
+func masterKeyFile() (string, bool) {
+	if configured := strings.TrimSpace(os.Getenv("JIG_MASTER_KEY_FILE")); configured != "" {
+		return configured, true
+	}
+	if _, err := os.Stat(defaultMasterKeyFile); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(legacyMasterKeyFile); err == nil {
+			log.Printf("The master key is stored next to the database in %s, move it to %s and set JIG_MASTER_KEY_FILE", legacyMasterKeyFile, defaultMasterKeyFile)
+			return legacyMasterKeyFile, false
+		}
+	}
+	return defaultMasterKeyFile, false
+}
+
+func sealWithKey(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openWithKey(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func isEncryptedSecret(stored string) bool {
+	return strings.HasPrefix(stored, encryptedSecretPrefix)
+}
+
+func (m *masterKey) encrypt(plaintext string) (string, error) {
+	dataKey, err := generateMasterKey()
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := sealWithKey(m.key, dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealWithKey(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return encryptedSecretPrefix +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (m *masterKey) decrypt(stored string) (string, error) {
+	wrappedKeyString, ciphertextString, found := strings.Cut(strings.TrimPrefix(stored, encryptedSecretPrefix), ":")
+	if !found {
+		return "", errors.New("malformed encrypted secret")
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(wrappedKeyString)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextString)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := openWithKey(m.key, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key, wrong master key?: %w", err)
+	}
+	plaintext, err := openWithKey(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
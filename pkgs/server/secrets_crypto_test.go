@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMasterKeyEncryptDecrypt(t *testing.T) {
+	keyBytes, err := generateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &masterKey{key: keyBytes}
+
+	first, err := key.encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := key.encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedSecret(first) || strings.Contains(first, "hunter2") {
+		t.Fatalf("expected an encrypted value, got %q", first)
+	}
+	if first == second {
+		t.Fatal("expected every encryption to use a fresh data key and nonce")
+	}
+	if plaintext, err := key.decrypt(first); err != nil || plaintext != "hunter2" {
+		t.Fatalf("expected hunter2, got %q, %v", plaintext, err)
+	}
+
+	otherBytes, _ := generateMasterKey()
+	if _, err := (&masterKey{key: otherBytes}).decrypt(first); err == nil {
+		t.Fatal("expected decrypting with another master key to fail")
+	}
+}
+
+func TestLoadMasterKeyGeneratesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	t.Setenv("JIG_MASTER_KEY", "")
+	t.Setenv("JIG_MASTER_KEY_FILE", path)
+
+	generated, err := loadMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected master key file to be private, got %v", info.Mode().Perm())
+	}
+	loaded, err := loadMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded.key) != string(generated.key) || loaded.path != path {
+		t.Fatal("expected the generated key to be loaded again")
+	}
+
+	t.Setenv("JIG_MASTER_KEY", "too-short")
+	if _, err := loadMasterKey(); err == nil {
+		t.Fatal("expected an invalid JIG_MASTER_KEY to be rejected")
+	}
+
+	// Without configuration a key is only read, never generated
+	t.Setenv("JIG_MASTER_KEY", "")
+	t.Setenv("JIG_MASTER_KEY_FILE", "")
+	if _, err := os.Stat(defaultMasterKeyFile); err == nil {
+		return
+	}
+	if _, err := os.Stat(legacyMasterKeyFile); err == nil {
+		return
+	}
+	if _, err := loadMasterKey(); !errors.Is(err, errMasterKeyNotConfigured) {
+		t.Fatalf("expected a missing configuration to be reported, got %v", err)
+	}
+	if _, err := os.Stat(defaultMasterKeyFile); err == nil {
+		t.Fatal("expected no key to be generated at the default path")
+	}
+}
+
+func TestSecretsEncryptionAndRotation(t *testing.T) {
+	db, err := createOrOpenDb("./testing-encryption.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-encryption.db")
+
+	secrets, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.Insert("legacy", "plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "master.key")
+	t.Setenv("JIG_MASTER_KEY", "")
+	t.Setenv("JIG_MASTER_KEY_FILE", path)
+	key, err := loadMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := secrets.EnableEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted != 1 {
+		t.Fatalf("expected the plaintext row to be encrypted, got %d", encrypted)
+	}
+	if err := secrets.Insert("fresh", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStoredEncrypted := func() {
+		t.Helper()
+		rows, err := db.Query("SELECT value FROM secrets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var value string
+			rows.Scan(&value)
+			if !isEncryptedSecret(value) {
+				t.Fatalf("expected every stored value to be encrypted, got %q", value)
+			}
+		}
+	}
+	assertStoredEncrypted()
+
+	oldKey, _ := os.ReadFile(path)
+	rotated, err := secrets.RotateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 2 {
+		t.Fatalf("expected two secrets to be re-encrypted, got %d", rotated)
+	}
+	newKey, _ := os.ReadFile(path)
+	if string(oldKey) == string(newKey) {
+		t.Fatal("expected the key file to be replaced")
+	}
+	assertStoredEncrypted()
+
+	for name, want := range map[string]string{"legacy": "plain", "fresh": "value"} {
+		if value, err := secrets.GetValue(name); err != nil || value != want {
+			t.Fatalf("expected %s to decrypt to %q, got %q, %v", name, want, value, err)
+		}
+	}
+
+	// A restarted server only has the new key file
+	reloaded, err := loadMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := &Secrets{db: db}
+	if _, err := restarted.EnableEncryption(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := restarted.GetValue("legacy"); err != nil || value != "plain" {
+		t.Fatalf("expected the new key file to decrypt secrets, got %q, %v", value, err)
+	}
+
+	// A server that lost its key file must not go on with a different key
+	otherBytes, err := generateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Secrets{db: db}).EnableEncryption(&masterKey{key: otherBytes}); err == nil {
+		t.Fatal("expected a key that does not decrypt the stored secrets to be refused")
+	}
+}
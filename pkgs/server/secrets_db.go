@@ -3,57 +3,560 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
-	"strings"
+	"os"
+	"slices"
+	"sync"
+	"time"
 
 	"modernc.org/sqlite"
 )
 
 func InitSecrets(newDb *sql.DB) (*Secrets, error) {
-	_, err := newDb.Exec("CREATE TABLE secrets (id INTEGER PRIMARY KEY, name TEXT, value TEXT)")
-	if err != nil {
-		sqliteError := (err.(*sqlite.Error))
-		if sqliteError.Code() == 1 && strings.Contains(sqliteError.Error(), "table secrets already exists") {
-			log.Println("db.go initialized")
-			return &Secrets{db: newDb}, nil
-		}
-		log.Printf("Failed to create table: %v", err.Error())
-		return nil, err
-	}
-
-	if _, err = newDb.Exec("create unique index uniqname on secrets (name);"); err != nil {
-		sqliteError := (err.(*sqlite.Error))
-		if sqliteError.Code() == 1 && strings.Contains(sqliteError.Error(), " already exists") {
-			log.Println("db.go initialized")
-			return &Secrets{db: newDb}, nil
-		}
-		log.Printf("Failed to create unique index: %v", err.Error())
+	if err := runMigrations(newDb); err != nil {
+		log.Printf("Failed to migrate database: %v", err.Error())
 		return nil, err
 	}
 	log.Println("db.go initialized")
 	return &Secrets{db: newDb}, nil
 }
 
+// SecretStore holds the secrets of jig with their history, and resolves the
+// @scheme: references of deployments through the providers it was given. The
+// sqlite backed *Secrets is the default store.
+type SecretStore interface {
+	Get(name string) (string, bool, error)
+	GetValue(name string) (string, error)
+	GetVersion(name string, version int) (string, bool, error)
+	List() ([]string, error)
+	InsertAs(name, value, author string, writeOnly bool) error
+	Put(name, value, author string) (int, error)
+	PutBatch(values map[string]string, overwrite bool, author string) (SecretBatchResult, error)
+	Rollback(name string, version int, author string) (int, error)
+	Delete(name string) error
+	CurrentVersion(name string) (int, error)
+	Versions(name string) ([]SecretVersion, error)
+	VersionValues(name string) ([]SecretVersionValue, error)
+	ReplaceHistory(name string, versions []SecretVersionValue, writeOnly bool) error
+	SetWriteOnly(name string) error
+	IsWriteOnly(name string) (bool, error)
+	ListWriteOnly() ([]string, error)
+	// Values returns every value any secret has ever had, for redaction
+	Values() ([]string, error)
+	// TrackResolved remembers a value read from a provider, ResolvedValues
+	// returns them all for redaction
+	TrackResolved(value string)
+	ResolvedValues() []string
+	RotateMasterKey() (int, error)
+	// Provider returns the provider of a reference scheme like vault
+	Provider(scheme string) (SecretProvider, bool)
+}
+
+// Secrets stores the current value of every secret in the secrets table and
+// each value it ever had in secret_versions.
 type Secrets struct {
 	db *sql.DB
+	// mu guards masterKey, rotation swaps it while rewriting every row
+	mu        sync.RWMutex
+	masterKey *masterKey
+	// providers resolve references to secrets that live outside of jig
+	providers map[string]SecretProvider
+	// resolved holds the values providers returned since the server started,
+	// they are redacted like store secrets
+	resolvedMu sync.Mutex
+	resolved   map[string]bool
+}
+
+// WithProviders hands the store the providers @scheme: references are read
+// from, see secretProvidersFromEnv.
+func (secrets *Secrets) WithProviders(providers map[string]SecretProvider) *Secrets {
+	secrets.providers = providers
+	return secrets
+}
+
+func (secrets *Secrets) Provider(scheme string) (SecretProvider, bool) {
+	provider, found := secrets.providers[scheme]
+	return provider, found
+}
+
+func (secrets *Secrets) TrackResolved(value string) {
+	secrets.resolvedMu.Lock()
+	defer secrets.resolvedMu.Unlock()
+	if secrets.resolved == nil {
+		secrets.resolved = map[string]bool{}
+	}
+	secrets.resolved[value] = true
+}
+
+func (secrets *Secrets) ResolvedValues() []string {
+	secrets.resolvedMu.Lock()
+	defer secrets.resolvedMu.Unlock()
+	values := make([]string, 0, len(secrets.resolved))
+	for value := range secrets.resolved {
+		values = append(values, value)
+	}
+	return values
+}
+
+type SecretVersion struct {
+	Version   int
+	CreatedAt time.Time
+	CreatedBy string
 }
 
 var ErrSecretExists = errors.New("secret already exists")
+var ErrSecretNotFound = errors.New("secret not found")
+var ErrSecretVersionNotFound = errors.New("secret version not found")
+
+// secretValueTables are the tables whose value column holds secret values.
+var secretValueTables = []string{"secrets", "secret_versions"}
+
+// rewriteSecretValues passes every value of table through transform and stores
+// the result when transform reports a change. It returns the changed row count.
+func rewriteSecretValues(tx *sql.Tx, table string, transform func(string) (string, bool, error)) (int, error) {
+	rows, err := tx.Query("SELECT id, value FROM " + table)
+	if err != nil {
+		return 0, err
+	}
+	values := map[int]string{}
+	for rows.Next() {
+		var id int
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		values[id] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for id, value := range values {
+		rewritten, changes, err := transform(value)
+		if err != nil {
+			return 0, err
+		}
+		if !changes {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE "+table+" SET value = ? WHERE id = ?", rewritten, id); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// EnableEncryption makes the store encrypt values with key and encrypts the
+// rows that are still stored in plaintext. It reports the number of secrets
+// that had to be encrypted.
+func (secrets *Secrets) EnableEncryption(key *masterKey) (int, error) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+
+	tx, err := secrets.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	encryptPlaintext := func(value string) (string, bool, error) {
+		if isEncryptedSecret(value) {
+			// A different key would make every stored secret unreadable
+			if _, err := key.decrypt(value); err != nil {
+				return "", false, fmt.Errorf("the master key does not decrypt the stored secrets: %w", err)
+			}
+			return value, false, nil
+		}
+		encrypted, err := key.encrypt(value)
+		return encrypted, true, err
+	}
+	encrypted := 0
+	for _, table := range secretValueTables {
+		changed, err := rewriteSecretValues(tx, table, encryptPlaintext)
+		if err != nil {
+			return 0, err
+		}
+		if table == "secrets" {
+			encrypted = changed
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	secrets.masterKey = key
+	return encrypted, nil
+}
+
+// RotateMasterKey re-encrypts every secret with a freshly generated master key
+// and replaces the key file once the new values are committed.
+func (secrets *Secrets) RotateMasterKey() (int, error) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+
+	if secrets.masterKey == nil {
+		return 0, errors.New("secrets are not encrypted")
+	}
+	if secrets.masterKey.path == "" {
+		return 0, errors.New("the master key is set through JIG_MASTER_KEY, rotate it by re-encrypting with a new key file instead")
+	}
+	newKeyBytes, err := generateMasterKey()
+	if err != nil {
+		return 0, err
+	}
+	newKey := &masterKey{key: newKeyBytes, path: secrets.masterKey.path}
+
+	tx, err := secrets.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	reencrypt := func(value string) (string, bool, error) {
+		if isEncryptedSecret(value) {
+			decrypted, err := secrets.masterKey.decrypt(value)
+			if err != nil {
+				return "", false, err
+			}
+			value = decrypted
+		}
+		encrypted, err := newKey.encrypt(value)
+		return encrypted, true, err
+	}
+	rotated := 0
+	for _, table := range secretValueTables {
+		changed, err := rewriteSecretValues(tx, table, reencrypt)
+		if err != nil {
+			return 0, err
+		}
+		if table == "secrets" {
+			rotated = changed
+		}
+	}
+
+	// Write the new key next to the old one first, so that a failed commit
+	// leaves the old key in place and a failed rename can be fixed by hand
+	pendingPath := newKey.path + ".new"
+	if err := writeMasterKeyFile(pendingPath, newKey.key); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		os.Remove(pendingPath)
+		return 0, err
+	}
+	if err := os.Rename(pendingPath, newKey.path); err != nil {
+		log.Printf("Secrets are encrypted with the key in %s, failed to move it to %s: %s", pendingPath, newKey.path, err)
+		return 0, err
+	}
+	secrets.masterKey = newKey
+	return rotated, nil
+}
+
+func (secrets *Secrets) seal(value string) (string, error) {
+	if secrets.masterKey == nil {
+		return value, nil
+	}
+	return secrets.masterKey.encrypt(value)
+}
+
+func (secrets *Secrets) open(stored string) (string, error) {
+	if !isEncryptedSecret(stored) {
+		return stored, nil
+	}
+	if secrets.masterKey == nil {
+		return "", errMasterKeyMissing
+	}
+	return secrets.masterKey.decrypt(stored)
+}
+
+func isUniqueConstraintError(err error) bool {
+	// The driver reports extended result codes, SQLITE_CONSTRAINT is the primary code
+	sqliteError, ok := err.(*sqlite.Error)
+	return ok && sqliteError.Code()&0xff == 19
+}
+
+func insertSecretVersion(tx *sql.Tx, name string, version int, sealed, author string) error {
+	_, err := tx.Exec(
+		"INSERT INTO secret_versions (name, version, value, created_at, created_by) VALUES (?, ?, ?, ?, ?)",
+		name, version, sealed, time.Now().UTC().Format(time.RFC3339), author,
+	)
+	return err
+}
 
 func (secrets *Secrets) Insert(name, value string) error {
-	_, err := secrets.db.Exec("INSERT INTO secrets (name, value) VALUES (?, ?)", name, value)
+	return secrets.InsertAs(name, value, "", false)
+}
 
+// InsertAs creates a secret at version 1, author is the name of the token that
+// created it. A write-only secret is created as such, its value is never
+// readable through the API, not even for a moment.
+func (secrets *Secrets) InsertAs(name, value, author string, writeOnly bool) error {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	sealed, err := secrets.seal(value)
 	if err != nil {
-		if (err.(*sqlite.Error)).Code() == 19 {
+		return err
+	}
+
+	tx, err := secrets.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO secrets (name, value, version, write_only) VALUES (?, ?, 1, ?)", name, sealed, writeOnly); err != nil {
+		if isUniqueConstraintError(err) {
 			return ErrSecretExists
 		}
+		return err
 	}
-	return err
+	if err := insertSecretVersion(tx, name, 1, sealed, author); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Put stores value as a new version of the secret, creating the secret when it
+// does not exist yet, and returns the new version number.
+func (secrets *Secrets) Put(name, value, author string) (int, error) {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	sealed, err := secrets.seal(value)
+	if err != nil {
+		return 0, err
+	}
+	return secrets.putSealed(name, sealed, author)
+}
+
+func (secrets *Secrets) putSealed(name, sealed, author string) (int, error) {
+	tx, err := secrets.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := putSealedTx(tx, name, sealed, author)
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+func putSealedTx(tx *sql.Tx, name, sealed, author string) (int, error) {
+	var latest int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM secret_versions WHERE name = ?", name).Scan(&latest); err != nil {
+		return 0, err
+	}
+	version := latest + 1
+	var err error
+	if version == 1 {
+		_, err = tx.Exec("INSERT INTO secrets (name, value, version) VALUES (?, ?, ?)", name, sealed, version)
+	} else {
+		_, err = tx.Exec("UPDATE secrets SET value = ?, version = ? WHERE name = ?", sealed, version, name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := insertSecretVersion(tx, name, version, sealed, author); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+type SecretBatchResult struct {
+	Created []string
+	Updated []string
+	Skipped []string
+}
+
+// PutBatch stores many secrets in one transaction, either all of them are
+// written or none. Existing secrets get a new version when overwrite is set and
+// are skipped otherwise.
+func (secrets *Secrets) PutBatch(values map[string]string, overwrite bool, author string) (SecretBatchResult, error) {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+
+	result := SecretBatchResult{Created: []string{}, Updated: []string{}, Skipped: []string{}}
+	tx, err := secrets.db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM secrets WHERE name = ?)", name).Scan(&exists); err != nil {
+			return result, err
+		}
+		if exists && !overwrite {
+			result.Skipped = append(result.Skipped, name)
+			continue
+		}
+		sealed, err := secrets.seal(values[name])
+		if err != nil {
+			return result, err
+		}
+		if _, err := putSealedTx(tx, name, sealed, author); err != nil {
+			return result, fmt.Errorf("%s: %w", name, err)
+		}
+		if exists {
+			result.Updated = append(result.Updated, name)
+		} else {
+			result.Created = append(result.Created, name)
+		}
+	}
+	return result, tx.Commit()
+}
+
+// Rollback makes the value of an earlier version current again. The rollback is
+// recorded as a new version, so history is never rewritten.
+func (secrets *Secrets) Rollback(name string, version int, author string) (int, error) {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+
+	var sealed string
+	err := secrets.db.QueryRow("SELECT value FROM secret_versions WHERE name = ? AND version = ?", name, version).Scan(&sealed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrSecretVersionNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return secrets.putSealed(name, sealed, fmt.Sprintf("%s (rollback to %d)", author, version))
+}
+
+func (secrets *Secrets) Versions(name string) ([]SecretVersion, error) {
+	rows, err := secrets.db.Query("SELECT version, created_at, created_by FROM secret_versions WHERE name = ? ORDER BY version", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []SecretVersion{}
+	for rows.Next() {
+		var version SecretVersion
+		var createdAt string
+		if err := rows.Scan(&version.Version, &createdAt, &version.CreatedBy); err != nil {
+			return nil, err
+		}
+		version.CreatedAt, err = time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			log.Printf("Failed to parse created_at for secret %s version %d: %s", name, version.Version, err)
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// SecretVersionValue is a version of a secret together with its value.
+type SecretVersionValue struct {
+	SecretVersion
+	Value string
+}
+
+// VersionValues returns every version of the secret with its value, oldest
+// first.
+func (secrets *Secrets) VersionValues(name string) ([]SecretVersionValue, error) {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	rows, err := secrets.db.Query("SELECT version, value, created_at, created_by FROM secret_versions WHERE name = ? ORDER BY version", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []SecretVersionValue{}
+	for rows.Next() {
+		var version SecretVersionValue
+		var stored, createdAt string
+		if err := rows.Scan(&version.Version, &stored, &createdAt, &version.CreatedBy); err != nil {
+			return nil, err
+		}
+		if version.Value, err = secrets.open(stored); err != nil {
+			return nil, err
+		}
+		version.CreatedAt, err = time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			log.Printf("Failed to parse created_at for secret %s version %d: %s", name, version.Version, err)
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// ReplaceHistory overwrites the secret with versions, keeping their numbers so
+// pinned references like ${@name:3} resolve to the same values as on the
+// server they came from. The highest version becomes current. A write-only
+// secret stays write-only.
+func (secrets *Secrets) ReplaceHistory(name string, versions []SecretVersionValue, writeOnly bool) error {
+	if len(versions) == 0 {
+		return ErrSecretVersionNotFound
+	}
+	versions = slices.Clone(versions)
+	slices.SortFunc(versions, func(a, b SecretVersionValue) int { return a.Version - b.Version })
+
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	tx, err := secrets.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var wasWriteOnly bool
+	err = tx.QueryRow("SELECT write_only FROM secrets WHERE name = ?", name).Scan(&wasWriteOnly)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM secret_versions WHERE name = ?", name); err != nil {
+		return err
+	}
+	var sealed string
+	for _, version := range versions {
+		if sealed, err = secrets.seal(version.Value); err != nil {
+			return err
+		}
+		createdAt := version.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = time.Now()
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO secret_versions (name, version, value, created_at, created_by) VALUES (?, ?, ?, ?, ?)",
+			name, version.Version, sealed, createdAt.UTC().Format(time.RFC3339), version.CreatedBy,
+		); err != nil {
+			return err
+		}
+	}
+	current := versions[len(versions)-1].Version
+	if _, err := tx.Exec(
+		"INSERT INTO secrets (name, value, version, write_only) VALUES (?, ?, ?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value, version = excluded.version, write_only = excluded.write_only",
+		name, sealed, current, writeOnly || wasWriteOnly,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CurrentVersion returns the version number the secret currently resolves to.
+func (secrets *Secrets) CurrentVersion(name string) (int, error) {
+	var version int
+	err := secrets.db.QueryRow("SELECT version FROM secrets WHERE name = ?", name).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrSecretNotFound
+	}
+	return version, err
 }
 
 func (secrets *Secrets) Get(name string) (string, bool, error) {
-	var value string
-	err := secrets.db.QueryRow("SELECT value FROM secrets WHERE name = ?", name).Scan(&value)
+	value, err := secrets.GetValue(name)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return "", false, nil
@@ -64,20 +567,114 @@ func (secrets *Secrets) Get(name string) (string, bool, error) {
 }
 
 func (secrets *Secrets) GetValue(name string) (string, error) {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
 	var value string
 	err := secrets.db.QueryRow("SELECT value FROM secrets WHERE name = ?", name).Scan(&value)
-	return value, err
+	if err != nil {
+		return "", err
+	}
+	return secrets.open(value)
+}
+
+func (secrets *Secrets) GetVersion(name string, version int) (string, bool, error) {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	var value string
+	err := secrets.db.QueryRow("SELECT value FROM secret_versions WHERE name = ? AND version = ?", name, version).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	value, err = secrets.open(value)
+	return value, err == nil, err
+}
+
+// SetWriteOnly hides the value of a secret from the API for good. There is no
+// way back, the secret has to be deleted and created again instead.
+func (secrets *Secrets) SetWriteOnly(name string) error {
+	result, err := secrets.db.Exec("UPDATE secrets SET write_only = 1 WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if changed, err := result.RowsAffected(); err == nil && changed == 0 {
+		return ErrSecretNotFound
+	}
+	return nil
+}
+
+func (secrets *Secrets) IsWriteOnly(name string) (bool, error) {
+	var writeOnly bool
+	err := secrets.db.QueryRow("SELECT write_only FROM secrets WHERE name = ?", name).Scan(&writeOnly)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrSecretNotFound
+	}
+	return writeOnly, err
+}
+
+// ListWriteOnly returns the names of the write-only secrets.
+func (secrets *Secrets) ListWriteOnly() ([]string, error) {
+	rows, err := secrets.db.Query("SELECT name FROM secrets WHERE write_only = 1 ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Values returns every value any secret has ever had, a running container may
+// still use an old version.
+func (secrets *Secrets) Values() ([]string, error) {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	rows, err := secrets.db.Query("SELECT DISTINCT value FROM secret_versions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			return nil, err
+		}
+		value, err := secrets.open(stored)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
 }
 
 func (secrets *Secrets) Update(name, value string) error {
-	_, err := secrets.db.Exec("UPDATE secrets SET value = ? WHERE name = ?", value, name)
+	_, err := secrets.Put(name, value, "")
 	return err
 }
 
 func (secrets *Secrets) Delete(name string) error {
-	res, err := secrets.db.Exec("DELETE FROM secrets WHERE name = ?", name)
-	res.RowsAffected()
-	return err
+	tx, err := secrets.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM secrets WHERE name = ?", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM secret_versions WHERE name = ?", name); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (secrets *Secrets) List() ([]string, error) {
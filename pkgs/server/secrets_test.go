@@ -1,12 +1,14 @@
 package main
 
 import (
+	"archive/tar"
 	"encoding/json"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -209,3 +211,423 @@ func TestSecrets(t *testing.T) {
 		}
 	})
 }
+
+func TestSecretVersions(t *testing.T) {
+	db, err := createOrOpenDb("./testing-versions.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-versions.db")
+
+	secrets, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.InsertAs("db", "first", "ci", false); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := secrets.Put("db", "second", "alice"); err != nil || version != 2 {
+		t.Fatalf("expected version 2, got %d, %v", version, err)
+	}
+	if value, _ := secrets.GetValue("db"); value != "second" {
+		t.Fatalf("expected the latest value to be current, got %q", value)
+	}
+	if value, found, err := secrets.GetVersion("db", 1); err != nil || !found || value != "first" {
+		t.Fatalf("expected version 1 to keep its value, got %q, %v, %v", value, found, err)
+	}
+
+	version, err := secrets.Rollback("db", 1, "alice")
+	if err != nil || version != 3 {
+		t.Fatalf("expected rollback to create version 3, got %d, %v", version, err)
+	}
+	if value, _ := secrets.GetValue("db"); value != "first" {
+		t.Fatalf("expected rollback to restore the old value, got %q", value)
+	}
+	if _, err := secrets.Rollback("db", 9, "alice"); err != ErrSecretVersionNotFound {
+		t.Fatalf("expected a missing version to be reported, got %v", err)
+	}
+
+	versions, err := secrets.Versions("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].CreatedBy != "ci" || versions[2].CreatedBy != "alice (rollback to 1)" {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+	if current, err := secrets.CurrentVersion("db"); err != nil || current != 3 {
+		t.Fatalf("expected current version 3, got %d, %v", current, err)
+	}
+
+	envs, err := makeEnvs(map[string]string{"PINNED": "@db:2"}, secrets)
+	if err != nil || len(envs) != 1 || envs[0] != "PINNED=second" {
+		t.Fatalf("expected pinned reference to resolve version 2, got %v, %v", envs, err)
+	}
+
+	if err := secrets.Delete("db"); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := secrets.Put("db", "again", ""); err != nil || version != 1 {
+		t.Fatalf("expected a deleted secret to start over at version 1, got %d, %v", version, err)
+	}
+}
+
+func TestSecretsPutBatch(t *testing.T) {
+	db, err := createOrOpenDb("./testing-batch.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-batch.db")
+
+	secrets, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.Insert("app_existing", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := secrets.PutBatch(map[string]string{"app_existing": "new", "app_fresh": "value"}, false, "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Created) != 1 || len(result.Updated) != 0 || len(result.Skipped) != 1 {
+		t.Fatalf("expected one created and one skipped secret, got %+v", result)
+	}
+	if value, _ := secrets.GetValue("app_existing"); value != "old" {
+		t.Fatalf("expected a skipped secret to keep its value, got %q", value)
+	}
+
+	result, err = secrets.PutBatch(map[string]string{"app_existing": "new"}, true, "ci")
+	if err != nil || len(result.Updated) != 1 {
+		t.Fatalf("expected the existing secret to be updated, got %+v, %v", result, err)
+	}
+	if version, _ := secrets.CurrentVersion("app_existing"); version != 2 {
+		t.Fatalf("expected an overwrite to create version 2, got %d", version)
+	}
+
+	// A failing entry rolls back the whole batch
+	if _, err := db.Exec("CREATE TRIGGER reject_broken BEFORE INSERT ON secrets WHEN NEW.name = 'app_broken' BEGIN SELECT RAISE(ABORT, 'rejected'); END"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secrets.PutBatch(map[string]string{"app_another": "value", "app_broken": "value"}, false, "ci"); err == nil {
+		t.Fatal("expected the batch to fail")
+	}
+	if _, found, _ := secrets.Get("app_another"); found {
+		t.Fatal("expected a failed batch to leave no secrets behind")
+	}
+}
+
+func TestWriteOnlySecrets(t *testing.T) {
+	db, err := createOrOpenDb("./testing-write-only.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-write-only.db")
+
+	secretStore, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := InitTokenStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &AppRouter{secretStore: secretStore, tokenStore: tokens}
+	router := app.mainRouter()
+
+	admin, err := tokens.Make("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployer, err := tokens.MakeWithPermissions("deployer", permissionsDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, path string, token *Token) *http.Response {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Add("Authorization", "Bearer "+token.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	if err := secretStore.Insert("db_password", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	if err := secretStore.InsertAs("api_key", "sk-live-1234", "admin", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := request(http.MethodGet, "/secrets/db_password", admin); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the admin token to reveal a readable secret, got %d", res.StatusCode)
+	}
+	if res := request(http.MethodGet, "/secrets/db_password", deployer); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a token without reveal permission to be refused, got %d", res.StatusCode)
+	}
+	if res := request(http.MethodGet, "/secrets/api_key", admin); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a write-only secret to be refused, got %d", res.StatusCode)
+	}
+	if res := request(http.MethodGet, "/secrets/export", deployer); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected export without reveal permission to be refused, got %d", res.StatusCode)
+	}
+
+	res := request(http.MethodGet, "/secrets/export", admin)
+	var export jigtypes.SecretExport
+	if err := json.NewDecoder(res.Body).Decode(&export); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := export.Secrets["api_key"]; found || export.Secrets["db_password"] != "hunter22" || len(export.WriteOnly) != 1 {
+		t.Fatalf("expected export to leave out write-only secrets, got %+v", export)
+	}
+
+	if res := request(http.MethodPost, "/secrets/db_password/write-only", deployer); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected to make the secret write-only, got %d", res.StatusCode)
+	}
+	if res := request(http.MethodGet, "/secrets/db_password", admin); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the secret to stay hidden once write-only, got %d", res.StatusCode)
+	}
+	if res := request(http.MethodPost, "/secrets/missing/write-only", admin); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a missing secret to be reported, got %d", res.StatusCode)
+	}
+
+	// Deployments still resolve write-only secrets
+	if envs, err := makeEnvs(map[string]string{"API_KEY": "@api_key"}, secretStore); err != nil || envs[0] != "API_KEY=sk-live-1234" {
+		t.Fatalf("expected write-only secret to resolve for deployments, got %v, %v", envs, err)
+	}
+}
+
+func TestRedactingResponseWriter(t *testing.T) {
+	redactor := newSecretRedactor([]string{"hunter22", "hunter22-long", "abc", "line\nbreak"})
+	recorder := httptest.NewRecorder()
+	writer := &redactingResponseWriter{ResponseWriter: recorder, redactor: redactor}
+
+	// A secret split across writes is caught once its line is complete
+	writer.Write([]byte("password is hun"))
+	writer.Write([]byte("ter22\nlonger hunter22-long, short abc\n"))
+	writer.Write([]byte(`{"stream":"line\nbreak"}` + "\n"))
+	writer.Write([]byte("no newline hunter22"))
+	writer.finish()
+
+	expected := "password is [redacted]\nlonger [redacted], short abc\n" + `{"stream":"[redacted]"}` + "\nno newline [redacted]"
+	if recorder.Body.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, recorder.Body.String())
+	}
+}
+
+func TestSecretProviders(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/secret/data/app" {
+			http.NotFound(w, r)
+			return
+		}
+		password := "latest"
+		if r.URL.Query().Get("version") == "1" {
+			password = "first"
+		}
+		respondWithJson(w, http.StatusOK, map[string]any{
+			"data": map[string]any{"data": map[string]any{"password": password, "port": 5432}},
+		})
+	}))
+	defer vault.Close()
+
+	db, err := createOrOpenDb("./testing-providers.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-providers.db")
+	store, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := map[string]SecretProvider{
+		"vault": &vaultProvider{address: vault.URL, token: "root", client: vault.Client()},
+		"file": &sopsFileProvider{decrypt: func(path string) ([]byte, error) {
+			if path != "/repo/secrets.enc.yaml" {
+				return nil, os.ErrNotExist
+			}
+			return []byte(`{"api_key":"from-sops","database":{"password":"nested"},"fresh":"only-in-output"}`), nil
+		}},
+	}
+	// File secrets are read from the project the deployment came from
+	secretDb := secretsForProject(store.WithProviders(providers), "/repo")
+
+	envs, err := makeEnvMap(map[string]string{
+		"PASSWORD": "@vault:secret/app#password",
+		"PINNED":   "@vault:secret/app#password:1",
+		"PORT":     "@vault:secret/app#port",
+		"API_KEY":  "@file:secrets.enc.yaml#api_key",
+		"DB_URL":   "postgres://app:${@file:secrets.enc.yaml#database.password}@db/app",
+	}, secretDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"PASSWORD": "latest",
+		"PINNED":   "first",
+		"PORT":     "5432",
+		"API_KEY":  "from-sops",
+		"DB_URL":   "postgres://app:nested@db/app",
+	}
+	for key, value := range expected {
+		if envs[key] != value {
+			t.Fatalf("expected %s=%q, got %q", key, value, envs[key])
+		}
+	}
+
+	// Values read from providers are redacted like store secrets, also when
+	// they are first resolved while the output is written
+	if resolved := strings.Join(store.ResolvedValues(), ","); !strings.Contains(resolved, "latest") || !strings.Contains(resolved, "from-sops") {
+		t.Fatalf("expected provider values to be tracked, got %s", resolved)
+	}
+	redacted := DeploymentsRouter{secret_db: secretDb}.redactSecrets(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		envs, err := makeEnvMap(map[string]string{"TOKEN": "@file:secrets.enc.yaml#fresh", "OLD": "@vault:secret/app#password:1"}, secretDb)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte("token " + envs["TOKEN"] + ", old " + envs["OLD"] + "\n"))
+	}))
+	recorder := httptest.NewRecorder()
+	redacted.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := recorder.Body.String(); body != "token [redacted], old [redacted]\n" {
+		t.Fatalf("expected provider values to be redacted, got %q", body)
+	}
+
+	for _, reference := range []string{
+		"@vault:secret/missing#password",
+		"@vault:secret/app#missing",
+		"@vault:app#password",
+		"@file:../secrets.enc.yaml#api_key",
+		"@file:secrets.enc.yaml#api_key:2",
+		"@file:secrets.enc.yaml",
+	} {
+		if _, err := makeEnvs(map[string]string{"VALUE": reference}, secretDb); err == nil {
+			t.Fatalf("expected %s to fail", reference)
+		}
+	}
+	if _, err := makeEnvs(map[string]string{"VALUE": "@file:secrets.enc.yaml#api_key"}, store); err == nil {
+		t.Fatal("expected file secrets to need a project")
+	}
+
+	delete(providers, "vault")
+	if _, err := makeEnvs(map[string]string{"VALUE": "@vault:secret/app#password"}, secretDb); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Fatalf("expected an unconfigured provider to be reported, got %v", err)
+	}
+
+	// External references never make a deployment follow a store secret
+	if names := secretReferences(map[string]string{"A": "@file:secrets.enc.yaml#api_key", "B": "@db"}); len(names) != 1 || names[0] != "db" {
+		t.Fatalf("expected only the store secret to be followed, got %v", names)
+	}
+}
+
+func TestProjectFiles(t *testing.T) {
+	t.Setenv("JIG_PROJECT_FILES_DIR", t.TempDir())
+	paths := fileSecretPaths(map[string]string{
+		"A": "@file:./config/prod.enc.yaml#key",
+		"B": "url://${@file:config/prod.enc.yaml#other}",
+		"C": "@vault:secret/app#password",
+	}, map[string]string{"/run/key": "@file:keys.enc.json#key"})
+	if strings.Join(paths, ",") != "config/prod.enc.yaml,keys.enc.json" {
+		t.Fatalf("unexpected file secret paths %v", paths)
+	}
+
+	// The build context is streamed to docker, the files are taken out of it
+	upload, writer := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(writer)
+		for name, contents := range map[string]string{"Dockerfile": "FROM scratch", "./config/prod.enc.yaml": "encrypted", "keys.enc.json": "{}"} {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+			tw.Write([]byte(contents))
+		}
+		tw.Close()
+		writer.Close()
+	}()
+	files, err := readProjectFilesFromTar(upload, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["config/prod.enc.yaml"]) != "encrypted" || len(files) != 2 {
+		t.Fatalf("expected only the referenced files to be read, got %v", files)
+	}
+
+	upload, writer = io.Pipe()
+	go func() {
+		tw := tar.NewWriter(writer)
+		tw.Close()
+		writer.Close()
+	}()
+	if _, err := readProjectFilesFromTar(upload, paths); err == nil {
+		t.Fatal("expected a missing file to be reported")
+	}
+
+	project := t.TempDir()
+	if err := os.WriteFile(filepath.Join(project, "keys.enc.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readProjectFiles(project, []string{"../keys.enc.json"}); err == nil {
+		t.Fatal("expected a path outside the project to be refused")
+	}
+	files, err = readProjectFiles(project, []string{"keys.enc.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Staged files only replace the kept ones when the deployment succeeded
+	kept, err := stageProjectFiles(map[string][]byte{"keys.enc.json": []byte("old")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepProjectFiles("shop", kept)
+	staged, err := stageProjectFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := os.ReadFile(filepath.Join(deploymentProjectFilesDir("shop"), "keys.enc.json")); err != nil || string(contents) != "old" {
+		t.Fatalf("expected the kept file to survive staging, got %q, %v", contents, err)
+	}
+	keepProjectFiles("shop", staged)
+	if contents, err := os.ReadFile(filepath.Join(deploymentProjectFilesDir("shop"), "keys.enc.json")); err != nil || string(contents) != "{}" {
+		t.Fatalf("expected the staged file to be kept, got %q, %v", contents, err)
+	}
+	if _, err := os.Stat(staged); err == nil {
+		t.Fatal("expected the staged directory to be moved")
+	}
+
+	// Compose projects are kept whole
+	if err := os.MkdirAll(filepath.Join(project, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"docker-compose.yaml": "services: {}", "config/prod.enc.yaml": "encrypted"} {
+		if err := os.WriteFile(filepath.Join(project, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staged, err = stageProjectDir(project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepProjectFiles("shop", staged)
+	for _, name := range []string{"docker-compose.yaml", "config/prod.enc.yaml", "keys.enc.json"} {
+		if _, err := os.Stat(filepath.Join(deploymentProjectFilesDir("shop"), name)); err != nil {
+			t.Fatalf("expected %s to be kept, got %v", name, err)
+		}
+	}
+
+	// Names end up in paths, .. must not reach the parent directory
+	keepProjectFiles("..", t.TempDir())
+	removeProjectFiles("..")
+	if _, err := os.Stat(projectFilesDir()); err != nil {
+		t.Fatalf("expected the project files directory to survive, got %v", err)
+	}
+	removeProjectFiles("shop")
+	if _, err := os.Stat(deploymentProjectFilesDir("shop")); err == nil {
+		t.Fatal("expected the kept files to be removed")
+	}
+}
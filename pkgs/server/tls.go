@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// tlsSettings configure the API to serve TLS itself instead of relying on
+// Traefik or Tailscale in front of it. With a client CA, clients can
+// authenticate with a certificate whose common name is the name of a token.
+type tlsSettings struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	// requireClientCert refuses connections without a client certificate,
+	// otherwise bearer tokens keep working next to certificates
+	requireClientCert bool
+}
+
+func tlsSettingsFromEnv() tlsSettings {
+	return tlsSettings{
+		certFile:          strings.TrimSpace(os.Getenv("JIG_TLS_CERT")),
+		keyFile:           strings.TrimSpace(os.Getenv("JIG_TLS_KEY")),
+		clientCAFile:      strings.TrimSpace(os.Getenv("JIG_TLS_CLIENT_CA")),
+		requireClientCert: os.Getenv("JIG_TLS_REQUIRE_CLIENT_CERT") == "true",
+	}
+}
+
+func (s tlsSettings) enabled() bool {
+	return s.certFile != "" || s.keyFile != "" || s.clientCAFile != ""
+}
+
+func (s tlsSettings) config() (*tls.Config, error) {
+	if s.certFile == "" || s.keyFile == "" {
+		return nil, errors.New("JIG_TLS_CERT and JIG_TLS_KEY are both needed to serve TLS")
+	}
+	certificate, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if s.clientCAFile == "" {
+		if s.requireClientCert {
+			return nil, errors.New("JIG_TLS_REQUIRE_CLIENT_CERT needs JIG_TLS_CLIENT_CA")
+		}
+		return config, nil
+	}
+	caBytes, err := os.ReadFile(s.clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates in %s", s.clientCAFile)
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if s.requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certificateIdentity is the common name of a client certificate that was
+// verified against the client CA, or empty.
+func certificateIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	der         []byte
+}
+
+func issueTestCertificate(t *testing.T, commonName string, parent *testCertificate, usage x509.ExtKeyUsage) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{certificate: certificate, key: key, der: der}
+}
+
+func (c *testCertificate) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueTestCertificate(t, "jig ca", nil, x509.ExtKeyUsageAny)
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCertFile, serverKeyFile := issueTestCertificate(t, "jig", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	ciCertificate := issueTestCertificate(t, "ci", ca, x509.ExtKeyUsageClientAuth)
+	unknownCertificate := issueTestCertificate(t, "unknown", ca, x509.ExtKeyUsageClientAuth)
+	otherCA := issueTestCertificate(t, "other ca", nil, x509.ExtKeyUsageAny)
+	foreignCertificate := issueTestCertificate(t, "ci", otherCA, x509.ExtKeyUsageClientAuth)
+
+	if _, err := (tlsSettings{certFile: serverCertFile}).config(); err == nil {
+		t.Fatal("expected a certificate without a key to be rejected")
+	}
+	if _, err := (tlsSettings{certFile: serverCertFile, keyFile: serverKeyFile, requireClientCert: true}).config(); err == nil {
+		t.Fatal("expected requiring client certificates without a CA to be rejected")
+	}
+	tlsConfig, err := tlsSettings{certFile: serverCertFile, keyFile: serverKeyFile, clientCAFile: caFile}.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := createOrOpenDb("./testing-tls.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-tls.db")
+	tokenStore, err := InitTokenStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokenStore.MakeWithPermissions("ci", PermissionsRead); err != nil {
+		t.Fatal(err)
+	}
+	bearer, err := tokenStore.Make("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &AppRouter{tokenStore: tokenStore}
+	server := httptest.NewUnstartedServer(app.ensureAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(tokenFromContext(r.Context()).Name))
+	})))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	request := func(certificate *testCertificate, token string) (int, string) {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if certificate != nil {
+			clientConfig.Certificates = []tls.Certificate{certificate.tlsCertificate()}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		body := make([]byte, 64)
+		n, _ := resp.Body.Read(body)
+		return resp.StatusCode, string(body[:n])
+	}
+
+	if code, name := request(ciCertificate, ""); code != http.StatusOK || name != "ci" {
+		t.Fatalf("expected the certificate to authenticate as ci, got %d: %s", code, name)
+	}
+	if code, name := request(ciCertificate, bearer.Token); code != http.StatusOK || name != "admin" {
+		t.Fatalf("expected a bearer token to win over the certificate, got %d: %s", code, name)
+	}
+	if code, name := request(nil, bearer.Token); code != http.StatusOK || name != "admin" {
+		t.Fatalf("expected bearer tokens to work without a certificate, got %d: %s", code, name)
+	}
+	if code, _ := request(unknownCertificate, ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected a certificate without a token to be refused, got %d", code)
+	}
+	if code, _ := request(nil, ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected a request without credentials to be refused, got %d", code)
+	}
+	if code, _ := request(foreignCertificate, ""); code == http.StatusOK {
+		t.Fatal("expected a certificate of another CA to be refused")
+	}
+}
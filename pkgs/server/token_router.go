@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	jigtypes "askh.at/jig/v2/pkgs/types"
 	"github.com/go-chi/chi/v5"
@@ -19,6 +22,7 @@ func (t TokenRouter) Router() chi.Router {
 	router.Post("/", t.createToken)
 	router.Get("/", t.listTokens)
 	router.Delete("/{token}", t.deleteToken)
+	router.Post("/{name}/rotate", t.rotateToken)
 
 	return router
 }
@@ -31,14 +35,161 @@ func (t *TokenRouter) createToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
+	setAuditTarget(r, body.Name)
+	if strings.TrimSpace(body.Name) == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
 
-	newToken, err := t.storage.Make(body.Name)
+	permissions := permissionsDefault
+	if len(body.Permissions) > 0 {
+		permissions, err = parsePermissions(body.Permissions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.RevealSecrets {
+		permissions |= PermissionsRevealSecrets
+	}
+	if err := validateScopes(body.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newToken := &Token{Name: body.Name, Permissions: permissions, Scopes: body.Scopes}
+	if body.TTL != "" {
+		ttl, err := parseTokenDuration(body.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		newToken.ValidUntil = time.Now().Add(ttl).Truncate(time.Second)
+	}
+	// A token can not hand out permissions, deployments or time it does not
+	// hold itself
+	if message := grantError(tokenFromContext(r.Context()), newToken); message != "" {
+		http.Error(w, message, http.StatusForbidden)
+		return
+	}
+	existing, err := t.storage.GetByName(body.Name)
 	if err != nil {
+		log.Println("Failed to fetch token:", err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		http.Error(w, "A token named "+body.Name+" already exists", http.StatusConflict)
+		return
+	}
+	if err := t.storage.Create(newToken); err != nil {
 		log.Println("Failed to create token:", err)
 		http.Error(w, "Failed to create token", http.StatusInternalServerError)
 		return
 	}
-	respondWithJson(w, http.StatusCreated, jigtypes.TokenCreateResponse{Name: body.Name, Token: newToken.Token})
+	respondWithJson(w, http.StatusCreated, tokenCreateResponse(newToken))
+}
+
+func tokenCreateResponse(token *Token) jigtypes.TokenCreateResponse {
+	response := jigtypes.TokenCreateResponse{Name: token.Name, Token: token.Token}
+	if !token.ValidUntil.IsZero() {
+		response.ExpiresAt = token.ValidUntil.UTC().Format(time.RFC3339)
+	}
+	return response
+}
+
+// grantError explains why holder may not create or manage token, it is empty
+// when holder may.
+func grantError(holder *Token, token *Token) string {
+	if holder == nil {
+		return ""
+	}
+	if !holder.Has(token.Permissions) {
+		return "Tokens can not be granted permissions the creating token lacks"
+	}
+	if !scopesWithin(token.Scopes, holder.Scopes) {
+		return "Tokens can not be scoped wider than the creating token"
+	}
+	if !holder.ValidUntil.IsZero() && (token.ValidUntil.IsZero() || token.ValidUntil.After(holder.ValidUntil)) {
+		return "Tokens can not be valid longer than the creating token, which expires at " + holder.ValidUntil.UTC().Format(time.RFC3339)
+	}
+	return ""
+}
+
+// manageableToken loads the named token for rotating or deleting it. A token
+// can only manage tokens that hold no more than it does, otherwise rotating
+// would hand out the secret of a more powerful token. It writes the error
+// response and returns nil when the token can not be managed.
+func (t *TokenRouter) manageableToken(w http.ResponseWriter, r *http.Request, name string) *Token {
+	target, err := t.storage.GetByName(name)
+	if err != nil {
+		log.Println("Failed to fetch token:", err)
+		http.Error(w, "Failed to fetch token", http.StatusInternalServerError)
+		return nil
+	}
+	if target == nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return nil
+	}
+	if grantError(tokenFromContext(r.Context()), target) != "" {
+		http.Error(w, "Tokens can not manage tokens with more permissions, wider scopes or a later expiry", http.StatusForbidden)
+		return nil
+	}
+	return target
+}
+
+// rotateToken issues a new secret for a token, keeping its permissions, scopes
+// and expiry.
+func (t *TokenRouter) rotateToken(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if t.manageableToken(w, r, name) == nil {
+		return
+	}
+
+	var body jigtypes.TokenRotateRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+	}
+	var grace time.Duration
+	if body.Grace != "" {
+		var err error
+		grace, err = parseTokenDuration(body.Grace)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rotated, err := t.storage.Rotate(name, grace)
+	if err != nil {
+		log.Println("Failed to rotate token:", err)
+		http.Error(w, "Failed to rotate token", http.StatusInternalServerError)
+		return
+	}
+	if rotated == nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	respondWithJson(w, http.StatusOK, tokenCreateResponse(rotated))
+}
+
+// scopesWithin reports whether scopes are no wider than limit. An unscoped
+// limit allows anything, otherwise every scope has to be one of the limit.
+func scopesWithin(scopes, limit []string) bool {
+	if len(limit) == 0 {
+		return true
+	}
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(limit, scope) {
+			return false
+		}
+	}
+	return true
 }
 
 func (t *TokenRouter) listTokens(w http.ResponseWriter, r *http.Request) {
@@ -50,10 +201,22 @@ func (t *TokenRouter) listTokens(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := jigtypes.TokenListResponse{
-		TokenNames: make([]string, len(tokens)),
+		TokenNames:  make([]string, len(tokens)),
+		Permissions: map[string][]string{},
+		Scopes:      map[string][]string{},
+		Expires:     map[string]string{},
+		Prefixes:    map[string]string{},
 	}
 	for i, token := range tokens {
 		response.TokenNames[i] = token.Name
+		response.Permissions[token.Name] = permissionList(token.Permissions)
+		response.Prefixes[token.Name] = token.Prefix
+		if len(token.Scopes) > 0 {
+			response.Scopes[token.Name] = token.Scopes
+		}
+		if !token.ValidUntil.IsZero() {
+			response.Expires[token.Name] = token.ValidUntil.UTC().Format(time.RFC3339)
+		}
 	}
 
 	respondWithJson(w, http.StatusOK, response)
@@ -61,6 +224,9 @@ func (t *TokenRouter) listTokens(w http.ResponseWriter, r *http.Request) {
 
 func (t *TokenRouter) deleteToken(w http.ResponseWriter, r *http.Request) {
 	token := chi.URLParam(r, "token")
+	if t.manageableToken(w, r, token) == nil {
+		return
+	}
 
 	err := t.storage.Delete(token)
 	if err != nil {
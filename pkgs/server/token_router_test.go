@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"log"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	jigtypes "askh.at/jig/v2/pkgs/types"
 	"github.com/go-chi/chi/v5"
@@ -128,3 +130,369 @@ func TestTokenRouter(t *testing.T) {
 		}
 	})
 }
+
+func TestTokenPermissions(t *testing.T) {
+	db, err := createOrOpenDb("./testing-permissions.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-permissions.db")
+
+	secretStore, err := InitSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenStore, err := InitTokenStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := (&AppRouter{secretStore: secretStore, tokenStore: tokenStore}).mainRouter()
+
+	permissions, err := parsePermissions([]string{"read", " secrets:read"})
+	if err != nil || permissions != PermissionsRead|PermissionsSecretsRead {
+		t.Fatalf("unexpected permissions %d, %v", permissions, err)
+	}
+	if names := permissionList(permissions); strings.Join(names, ",") != "read,secrets:read" {
+		t.Fatalf("unexpected permission names %v", names)
+	}
+	if _, err := parsePermissions([]string{"root"}); err == nil {
+		t.Fatal("expected an unknown permission to be rejected")
+	}
+
+	admin, err := tokenStore.Make("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := tokenStore.MakeWithPermissions("reader", PermissionsRead|PermissionsSecretsRead|PermissionsTokensAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, path, body string, token *Token) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Add("Authorization", "Bearer "+token.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := request(http.MethodGet, "/secrets", "", reader); code != http.StatusOK {
+		t.Fatalf("expected secrets:read to list secrets, got %d", code)
+	}
+	if code := request(http.MethodPost, "/secrets", `{"name":"db","value":"secret"}`, reader); code != http.StatusForbidden {
+		t.Fatalf("expected creating a secret without secrets:write to be refused, got %d", code)
+	}
+	if code := request(http.MethodPost, "/secrets", `{"name":"db","value":"secret"}`, admin); code != http.StatusCreated {
+		t.Fatalf("expected the admin token to create a secret, got %d", code)
+	}
+	if code := request(http.MethodDelete, "/deployments/api", "", reader); code != http.StatusForbidden {
+		t.Fatalf("expected deleting a deployment without delete to be refused, got %d", code)
+	}
+	if code := request(http.MethodGet, "/volumes/data/backup", "", reader); code != http.StatusForbidden {
+		t.Fatalf("expected volume backups to need cluster:admin, got %d", code)
+	}
+	if code := request(http.MethodPost, "/volumes/data/restore", "", reader); code != http.StatusForbidden {
+		t.Fatalf("expected volume restores to need cluster:admin, got %d", code)
+	}
+	if code := request(http.MethodGet, "/admin/schema", "", reader); code != http.StatusForbidden {
+		t.Fatalf("expected admin routes to need admin permissions, got %d", code)
+	}
+
+	if code := request(http.MethodPost, "/tokens", `{"name":"ci","permissions":["read"]}`, reader); code != http.StatusCreated {
+		t.Fatalf("expected a token with a subset of permissions to be created, got %d", code)
+	}
+	if code := request(http.MethodPost, "/tokens", `{"name":"escalated","permissions":["deploy"]}`, reader); code != http.StatusForbidden {
+		t.Fatalf("expected granting a permission the creator lacks to be refused, got %d", code)
+	}
+	if code := request(http.MethodPost, "/tokens", `{"name":"typo","permissions":["deploys"]}`, admin); code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown permission to be rejected, got %d", code)
+	}
+	created, err := tokenStore.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range created {
+		if token.Name == "ci" && token.Permissions != PermissionsRead {
+			t.Fatalf("expected ci to only read, got %v", permissionList(token.Permissions))
+		}
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	scoped := &Token{Scopes: []string{"billing-*", "shop"}}
+	for name, expected := range map[string]bool{
+		"billing-api":    true,
+		"billing":        false,
+		"shop":           true,
+		"shop:web":       true,
+		"payments":       false,
+		"payments:shop":  false,
+		"billing-api:db": true,
+	} {
+		if scoped.CanAccessDeployment(name) != expected {
+			t.Fatalf("expected access to %s to be %v", name, expected)
+		}
+	}
+	usage := map[string][]string{"billing-data": {"billing-api"}, "shared": {"billing-api", "payments"}}
+	for name, expected := range map[string]bool{
+		"billing-data":  true,
+		"shared":        false,
+		"billing-cache": true,
+		"payments-data": false,
+	} {
+		if volumeInScope(scoped, name, usage) != expected {
+			t.Fatalf("expected access to volume %s to be %v", name, expected)
+		}
+	}
+	if !(&Token{}).CanAccessDeployment("anything") {
+		t.Fatal("expected a token without scopes to reach every deployment")
+	}
+	if err := validateScopes([]string{"billing-["}); err == nil {
+		t.Fatal("expected a malformed glob to be rejected")
+	}
+	if !scopesWithin([]string{"billing-*"}, []string{"billing-*", "shop"}) || scopesWithin(nil, []string{"shop"}) || scopesWithin([]string{"*"}, []string{"shop"}) {
+		t.Fatal("unexpected scope containment")
+	}
+
+	db, err := createOrOpenDb("./testing-scopes.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-scopes.db")
+	tokenStore, err := InitTokenStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, err := tokenStore.MakeScoped("ci", permissionsDefault, []string{"billing-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := tokenStore.Get(ci.Token)
+	if err != nil || stored == nil || len(stored.Scopes) != 1 || stored.Scopes[0] != "billing-*" {
+		t.Fatalf("expected scopes to be stored, got %+v, %v", stored, err)
+	}
+
+	router := chi.NewRouter()
+	router.With(requireDeploymentScope).Get("/deployments/{name}/logs", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), tokenContextKey, stored))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := request("/deployments/billing-api/logs"); code != http.StatusOK {
+		t.Fatalf("expected a deployment in scope to be reachable, got %d", code)
+	}
+	if code := request("/deployments/payments/logs"); code != http.StatusForbidden {
+		t.Fatalf("expected a deployment out of scope to be refused, got %d", code)
+	}
+
+	app := (&AppRouter{tokenStore: tokenStore}).mainRouter()
+	req := httptest.NewRequest(http.MethodPost, "/deployments", nil)
+	req.Header.Add("Authorization", "Bearer "+ci.Token)
+	req.Header.Add("x-jig-config", `{"name":"payments"}`)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected deploying outside the scopes to be refused, got %d", w.Code)
+	}
+
+	scopedAdmin, err := tokenStore.MakeScoped("billing-admin", permissionsAll, []string{"billing-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for body, expected := range map[string]int{
+		`{"name":"wider","scopes":["*"]}`:            http.StatusForbidden,
+		`{"name":"unscoped"}`:                        http.StatusForbidden,
+		`{"name":"narrower","scopes":["billing-*"]}`: http.StatusCreated,
+	} {
+		req = httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(body))
+		req.Header.Add("Authorization", "Bearer "+scopedAdmin.Token)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Fatalf("expected %s to return %d, got %d", body, expected, w.Code)
+		}
+	}
+
+	// Rotating would hand out the secret of a wider token, deleting it would
+	// lock its holder out
+	if _, err := tokenStore.Make("root"); err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range []struct {
+		method, path string
+		expected     int
+	}{
+		{http.MethodPost, "/tokens/root/rotate", http.StatusForbidden},
+		{http.MethodDelete, "/tokens/root", http.StatusForbidden},
+		{http.MethodPost, "/tokens/narrower/rotate", http.StatusOK},
+		{http.MethodDelete, "/tokens/narrower", http.StatusNoContent},
+		{http.MethodDelete, "/tokens/missing", http.StatusNotFound},
+	} {
+		req = httptest.NewRequest(route.method, route.path, nil)
+		req.Header.Add("Authorization", "Bearer "+scopedAdmin.Token)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		if w.Code != route.expected {
+			t.Fatalf("expected %s %s to return %d, got %d", route.method, route.path, route.expected, w.Code)
+		}
+	}
+	if root, err := tokenStore.GetByName("root"); err != nil || root == nil {
+		t.Fatalf("expected the wider token to survive, got %+v, %v", root, err)
+	}
+}
+
+func TestTokenExpiryAndRotation(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+	} {
+		duration, err := parseTokenDuration(value)
+		if err != nil || duration != expected {
+			t.Fatalf("expected %s to parse as %s, got %s, %v", value, expected, duration, err)
+		}
+	}
+	for _, value := range []string{"", "d", "-1d", "0h", "soon"} {
+		if _, err := parseTokenDuration(value); err == nil {
+			t.Fatalf("expected %q to be rejected", value)
+		}
+	}
+
+	db, err := createOrOpenDb("./testing-rotation.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-rotation.db")
+	tokenStore, err := InitTokenStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiring := &Token{Name: "expiring", Permissions: permissionsDefault, ValidUntil: time.Now().Add(-time.Minute)}
+	if err := tokenStore.Create(expiring); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := tokenStore.Get(expiring.Token)
+	if err != nil || stored == nil || !stored.Expired(time.Now()) {
+		t.Fatalf("expected the stored token to be expired, got %+v, %v", stored, err)
+	}
+	app := &AppRouter{tokenStore: tokenStore}
+	handler := app.ensureAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	authenticate := func(secret string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := authenticate(expiring.Token); code != http.StatusUnauthorized {
+		t.Fatalf("expected an expired token to be refused, got %d", code)
+	}
+
+	ci, err := tokenStore.MakeScoped("ci", permissionsDefault, []string{"billing-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	graced, err := tokenStore.Rotate("ci", time.Hour)
+	if err != nil || graced == nil || graced.Token == ci.Token || len(graced.Scopes) != 1 {
+		t.Fatalf("expected a new secret with the same scopes, got %+v, %v", graced, err)
+	}
+	if authenticate(ci.Token) != http.StatusOK || authenticate(graced.Token) != http.StatusOK {
+		t.Fatal("expected both secrets to work during the grace period")
+	}
+	rotated, err := tokenStore.Rotate("ci", 0)
+	if err != nil || rotated == nil {
+		t.Fatal(err)
+	}
+	for _, old := range []string{ci.Token, graced.Token} {
+		if code := authenticate(old); code != http.StatusUnauthorized {
+			t.Fatalf("expected a rotated secret to be refused without grace, got %d", code)
+		}
+	}
+	if authenticate(rotated.Token) != http.StatusOK {
+		t.Fatal("expected the new secret to work")
+	}
+	if missing, err := tokenStore.Rotate("missing", 0); err != nil || missing != nil {
+		t.Fatalf("expected no token to rotate, got %+v, %v", missing, err)
+	}
+
+	// A token with a TTL can not create or manage tokens that outlive it
+	shortLived := &Token{Name: "short-lived", Permissions: permissionsDefault | PermissionsTokensAdmin, ValidUntil: time.Now().Add(24 * time.Hour)}
+	router := TokenRouter{storage: tokenStore}.Router()
+	request := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), tokenContextKey, shortLived))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := request(http.MethodPost, "/", `{"name":"forever"}`); code != http.StatusForbidden {
+		t.Fatalf("expected a token without expiry to be refused, got %d", code)
+	}
+	if code := request(http.MethodPost, "/", `{"name":"longer","ttl":"2d"}`); code != http.StatusForbidden {
+		t.Fatalf("expected a longer TTL to be refused, got %d", code)
+	}
+	if code := request(http.MethodPost, "/", `{"name":"shorter","ttl":"12h"}`); code != http.StatusCreated {
+		t.Fatalf("expected a shorter TTL to be allowed, got %d", code)
+	}
+	if code := request(http.MethodPost, "/", `{"name":"shorter","ttl":"12h"}`); code != http.StatusConflict {
+		t.Fatalf("expected a duplicate name to conflict, got %d", code)
+	}
+	if code := request(http.MethodPost, "/", `{"name":" ","ttl":"12h"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected an empty name to be refused, got %d", code)
+	}
+	if code := request(http.MethodPost, "/ci/rotate", ""); code != http.StatusForbidden {
+		t.Fatalf("expected rotating a token without expiry to be refused, got %d", code)
+	}
+	if code := request(http.MethodPost, "/shorter/rotate", ""); code != http.StatusOK {
+		t.Fatalf("expected rotating a shorter lived token to be allowed, got %d", code)
+	}
+}
+
+func TestTokenHashing(t *testing.T) {
+	db, err := createOrOpenDb("./testing-hashing.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove("./testing-hashing.db")
+	tokenStore, err := InitTokenStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ci, err := tokenStore.Make("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tokens WHERE token = ? OR token_hash = ? OR token_salt = ?", ci.Token, ci.Token, ci.Token).Scan(&stored); err != nil || stored != 0 {
+		t.Fatalf("expected the secret not to be stored, got %d, %v", stored, err)
+	}
+	found, err := tokenStore.Get(ci.Token)
+	if err != nil || found == nil || found.Name != "ci" || found.Prefix != ci.Token[:tokenPrefixLength] || found.Token != "" {
+		t.Fatalf("expected the token to be found by its secret, got %+v, %v", found, err)
+	}
+	for _, secret := range []string{"", ci.Token[:tokenPrefixLength], ci.Token[:len(ci.Token)-1] + "x"} {
+		if token, err := tokenStore.Get(secret); err != nil || token != nil {
+			t.Fatalf("expected %q not to match, got %+v, %v", secret, token, err)
+		}
+	}
+
+	other, err := tokenStore.Make("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Salt == ci.Salt || other.Hash == ci.Hash {
+		t.Fatal("expected every token to get its own salt")
+	}
+}
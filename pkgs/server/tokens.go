@@ -1,8 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,29 +23,97 @@ type tokenStorage struct {
 }
 
 func InitTokenStorage(db *sql.DB) (*tokenStorage, error) {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS tokens (id integer primary key, token TEXT, name TEXT, created_at TEXT, permissions INTEGER, valid_until TEXT)")
-	db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS uniqtoken ON tokens (token);")
-	db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS uniqname ON tokens (name);")
-	if err != nil {
+	if err := runMigrations(db); err != nil {
 		return nil, err
 	}
 	return &tokenStorage{db: db}, nil
 }
 
 type Token struct {
-	Token       string
+	// Token is the secret itself. Only its hash is stored, so it is only known
+	// right after the token is created or rotated.
+	Token string
+	// Prefix is the start of the secret, kept in plaintext to find the token
+	// and tell tokens apart
+	Prefix      string
+	Salt        string
+	Hash        string
 	Name        string
 	CreatedAt   time.Time
 	Permissions int
 	ValidUntil  time.Time
+	// Scopes are deployment name globs like billing-*, a token without scopes
+	// reaches every deployment
+	Scopes []string
 }
 
 const (
 	PermissionsRead = 1 << iota
 	PermissionsDeploy
 	PermissionsDelete
+	PermissionsRevealSecrets
+	PermissionsSecretsRead
+	PermissionsSecretsWrite
+	PermissionsTokensAdmin
+	PermissionsClusterAdmin
 )
 
+// permissionNames are the names permissions are granted and listed by.
+var permissionNames = []struct {
+	name       string
+	permission int
+}{
+	{"read", PermissionsRead},
+	{"deploy", PermissionsDeploy},
+	{"delete", PermissionsDelete},
+	{"secrets:read", PermissionsSecretsRead},
+	{"secrets:write", PermissionsSecretsWrite},
+	{"secrets:reveal", PermissionsRevealSecrets},
+	{"tokens:admin", PermissionsTokensAdmin},
+	{"cluster:admin", PermissionsClusterAdmin},
+}
+
+// permissionsDefault is what a new token gets when no permissions are asked
+// for. Reading secret values back and administration have to be granted.
+const permissionsDefault = PermissionsRead | PermissionsDeploy | PermissionsDelete | PermissionsSecretsRead | PermissionsSecretsWrite
+
+const permissionsAll = permissionsDefault | PermissionsRevealSecrets | PermissionsTokensAdmin | PermissionsClusterAdmin
+
+// parsePermissions turns permission names into a permission mask.
+func parsePermissions(names []string) (int, error) {
+	permissions := 0
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, entry := range permissionNames {
+			if entry.name == name {
+				permissions |= entry.permission
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+	}
+	return permissions, nil
+}
+
+// permissionList names every permission in a mask.
+func permissionList(permissions int) []string {
+	names := []string{}
+	for _, entry := range permissionNames {
+		if permissions&entry.permission == entry.permission {
+			names = append(names, entry.name)
+		}
+	}
+	return names
+}
+
+// Has reports whether the token holds every permission in the mask.
+func (t *Token) Has(permissions int) bool {
+	return t.Permissions&permissions == permissions
+}
+
 func (t *Token) CanRead() bool {
 	return t.Permissions&PermissionsRead == PermissionsRead
 }
@@ -49,27 +126,248 @@ func (t *Token) CanDelete() bool {
 	return t.Permissions&PermissionsDelete == PermissionsDelete
 }
 
+func (t *Token) CanRevealSecrets() bool {
+	return t.Permissions&PermissionsRevealSecrets == PermissionsRevealSecrets
+}
+
+// CanAccessDeployment reports whether the scopes of the token cover a
+// deployment. Compose services like stack:api are covered by their stack.
+func (t *Token) CanAccessDeployment(name string) bool {
+	if len(t.Scopes) == 0 {
+		return true
+	}
+	stack, _, _ := strings.Cut(name, ":")
+	for _, scope := range t.Scopes {
+		if matched, _ := path.Match(scope, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(scope, stack); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateScopes rejects globs that path.Match can not use.
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if scope == "" {
+			return errors.New("scopes can not be empty")
+		}
+		if _, err := path.Match(scope, ""); err != nil {
+			return fmt.Errorf("invalid scope %q: %w", scope, err)
+		}
+	}
+	return nil
+}
+
+// tokenPrefixLength is how much of a secret is stored in plaintext. Eight hex
+// characters leave 96 bits of a generated secret unknown.
+const tokenPrefixLength = 8
+
+func tokenPrefix(secret string) string {
+	return secret[:min(len(secret), tokenPrefixLength)]
+}
+
+// hashTokenSecret hashes a secret with its salt. Secrets are long and random,
+// so a fast hash is enough, there is no password to brute force.
+func hashTokenSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTokenSalt() string {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		log.Fatalf("Failed to generate token salt: %s", err)
+	}
+	return hex.EncodeToString(salt)
+}
+
+// setSecret gives the token a secret and the prefix, salt and hash that are
+// stored in its place.
+func (t *Token) setSecret(secret string) {
+	t.Token = secret
+	t.Prefix = tokenPrefix(secret)
+	t.Salt = newTokenSalt()
+	t.Hash = hashTokenSecret(t.Salt, secret)
+}
+
+// tokenMatches compares a secret against a stored salt and hash in constant time.
+func tokenMatches(salt, hash, secret string) bool {
+	if hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashTokenSecret(salt, secret)), []byte(hash)) == 1
+}
+
+// hashPlaintextTokens replaces the secrets stored before tokens were hashed,
+// including ones still in a rotation grace period.
+func hashPlaintextTokens(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, token, previous_token FROM tokens")
+	if err != nil {
+		return err
+	}
+	type plaintextToken struct {
+		id       int
+		current  sql.NullString
+		previous sql.NullString
+	}
+	var stored []plaintextToken
+	for rows.Next() {
+		var token plaintextToken
+		if err := rows.Scan(&token.id, &token.current, &token.previous); err != nil {
+			rows.Close()
+			return err
+		}
+		stored = append(stored, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range stored {
+		// A row without a secret can not be used to log in, it stays that way
+		var currentPrefix, currentSalt, currentHash any
+		if token.current.Valid && token.current.String != "" {
+			current := Token{}
+			current.setSecret(token.current.String)
+			currentPrefix, currentSalt, currentHash = current.Prefix, current.Salt, current.Hash
+		}
+		var previousPrefix, previousSalt, previousHash any
+		if token.previous.Valid && token.previous.String != "" {
+			previous := Token{}
+			previous.setSecret(token.previous.String)
+			previousPrefix, previousSalt, previousHash = previous.Prefix, previous.Salt, previous.Hash
+		}
+		if _, err := tx.Exec(
+			"UPDATE tokens SET token = NULL, previous_token = NULL, token_prefix = ?, token_salt = ?, token_hash = ?, previous_token_prefix = ?, previous_token_salt = ?, previous_token_hash = ? WHERE id = ?",
+			currentPrefix, currentSalt, currentHash, previousPrefix, previousSalt, previousHash, token.id,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (t *Token) insert(db *sql.DB) error {
-	_, err := db.Exec(
-		"INSERT INTO tokens (token, name, created_at, permissions) VALUES (?, ?, ?, ?)",
-		t.Token, t.Name, t.CreatedAt.Format(time.RFC3339), t.Permissions,
+	scopes, err := json.Marshal(t.scopeList())
+	if err != nil {
+		return err
+	}
+	var validUntil any
+	if !t.ValidUntil.IsZero() {
+		validUntil = t.ValidUntil.UTC().Format(time.RFC3339)
+	}
+	_, err = db.Exec(
+		"INSERT INTO tokens (token_prefix, token_salt, token_hash, name, created_at, permissions, scopes, valid_until) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		t.Prefix, t.Salt, t.Hash, t.Name, t.CreatedAt.Format(time.RFC3339), t.Permissions, string(scopes), validUntil,
 	)
 	return err
 }
 
+func (t *Token) scopeList() []string {
+	if t.Scopes == nil {
+		return []string{}
+	}
+	return t.Scopes
+}
+
+// Make creates a token with every permission.
 func (t *tokenStorage) Make(name string) (*Token, error) {
-	randomSting := strings.ReplaceAll(uuid.New().String(), "-", "")
-	now := time.Now()
-	token := &Token{Token: randomSting, Name: name, CreatedAt: now, Permissions: PermissionsRead | PermissionsDeploy | PermissionsDelete}
-	err := token.insert(t.db)
-	if err != nil {
+	return t.MakeWithPermissions(name, permissionsAll)
+}
+
+func (t *tokenStorage) MakeWithPermissions(name string, permissions int) (*Token, error) {
+	return t.MakeScoped(name, permissions, nil)
+}
+
+// MakeScoped creates a token that only reaches deployments matching scopes.
+func (t *tokenStorage) MakeScoped(name string, permissions int, scopes []string) (*Token, error) {
+	token := &Token{Name: name, Permissions: permissions, Scopes: scopes}
+	if err := t.Create(token); err != nil {
 		return nil, err
 	}
 	return token, nil
 }
 
+// Create stores a new token, filling in a fresh secret and the creation time.
+func (t *tokenStorage) Create(token *Token) error {
+	token.setSecret(newTokenSecret())
+	token.CreatedAt = time.Now()
+	return token.insert(t.db)
+}
+
+func newTokenSecret() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// Expired reports whether the token is past its valid_until, tokens without
+// one never expire.
+func (t *Token) Expired(now time.Time) bool {
+	return !t.ValidUntil.IsZero() && now.After(t.ValidUntil)
+}
+
+// parseTokenDuration reads a TTL or grace period like 30d, 2w or 12h.
+func parseTokenDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	var duration time.Duration
+	if unit, found := units[value[max(len(value)-1, 0):]]; found {
+		count, err := strconv.Atoi(value[:len(value)-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		duration = time.Duration(count) * unit
+	} else {
+		var err error
+		duration, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q, use something like 30d, 2w or 12h", value)
+		}
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", value)
+	}
+	return duration, nil
+}
+
+// Rotate gives the named token a new secret. The old secret keeps working for
+// grace, a zero grace revokes it right away.
+func (t *tokenStorage) Rotate(name string, grace time.Duration) (*Token, error) {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	token, err := scanToken(tx.QueryRow("SELECT "+tokenColumns+" FROM tokens WHERE name = ?", name))
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, nil
+	}
+	var previousPrefix, previousSalt, previousHash, previousValidUntil any
+	if grace > 0 {
+		previousPrefix, previousSalt, previousHash = token.Prefix, token.Salt, token.Hash
+		previousValidUntil = time.Now().Add(grace).UTC().Format(time.RFC3339)
+	}
+	token.setSecret(newTokenSecret())
+	if _, err := tx.Exec(
+		"UPDATE tokens SET token_prefix = ?, token_salt = ?, token_hash = ?, previous_token_prefix = ?, previous_token_salt = ?, previous_token_hash = ?, previous_valid_until = ? WHERE name = ?",
+		token.Prefix, token.Salt, token.Hash, previousPrefix, previousSalt, previousHash, previousValidUntil, name,
+	); err != nil {
+		return nil, err
+	}
+	return token, tx.Commit()
+}
+
+const tokenColumns = "token_prefix, token_salt, token_hash, name, created_at, permissions, scopes, valid_until"
+
 func (t *tokenStorage) List() ([]Token, error) {
-	rows, err := t.db.Query("SELECT token, name, created_at, permissions FROM tokens")
+	rows, err := t.db.Query("SELECT " + tokenColumns + " FROM tokens")
 	if err != nil {
 		return nil, err
 	}
@@ -78,23 +376,13 @@ func (t *tokenStorage) List() ([]Token, error) {
 	var tokens []Token
 
 	for rows.Next() {
-		var token string
-		var name string
-		var createdAt string
-		var permissions int
-		err = rows.Scan(&token, &name, &createdAt, &permissions)
-		if err != nil {
-			return nil, err
-		}
-		createdAtTime, err := time.Parse(time.RFC3339, createdAt)
+		token, err := scanToken(rows)
 		if err != nil {
-			log.Fatalf("Failed to parse created_at for token %s, check format: %s", name, err)
 			return nil, err
 		}
-
-		tokens = append(tokens, Token{Token: token, Name: name, CreatedAt: createdAtTime, Permissions: permissions})
+		tokens = append(tokens, *token)
 	}
-	return tokens, nil
+	return tokens, rows.Err()
 }
 
 func (t *tokenStorage) Delete(name string) error {
@@ -102,17 +390,63 @@ func (t *tokenStorage) Delete(name string) error {
 	return err
 }
 
-func (t *tokenStorage) Get(token string) (*Token, error) {
-	row := t.db.QueryRow("SELECT token, name, created_at, permissions FROM tokens WHERE token = ?", token)
-	return t.scanToken(row)
+// Get finds a token by its secret, or by the secret it had before a rotation
+// while the grace period lasts. The prefix narrows the lookup down, the hash
+// decides.
+func (t *tokenStorage) Get(secret string) (*Token, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	prefix := tokenPrefix(secret)
+	rows, err := t.db.Query(
+		"SELECT "+tokenColumns+", previous_token_salt, previous_token_hash, previous_valid_until FROM tokens WHERE token_prefix = ? OR previous_token_prefix = ?",
+		prefix, prefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for rows.Next() {
+		var previousSalt, previousHash, previousValidUntil sql.NullString
+		token, err := scanToken(rows, &previousSalt, &previousHash, &previousValidUntil)
+		if err != nil {
+			return nil, err
+		}
+		if tokenMatches(token.Salt, token.Hash, secret) {
+			return token, nil
+		}
+		if previousValidUntil.String > now && tokenMatches(previousSalt.String, previousHash.String, secret) {
+			return token, nil
+		}
+	}
+	return nil, rows.Err()
+}
+
+// GetByName finds a token by its name, for identities that are proven without
+// its secret, like a client certificate.
+func (t *tokenStorage) GetByName(name string) (*Token, error) {
+	return scanToken(t.db.QueryRow("SELECT "+tokenColumns+" FROM tokens WHERE name = ?", name))
+}
+
+// hasHash reports whether a token with this hash is stored.
+func (t *tokenStorage) hasHash(hash string) (bool, error) {
+	var count int
+	err := t.db.QueryRow("SELECT COUNT(*) FROM tokens WHERE token_hash = ?", hash).Scan(&count)
+	return count > 0, err
 }
 
-func (t *tokenStorage) scanToken(row *sql.Row) (*Token, error) {
-	var tokenString string
+// scanToken reads the tokenColumns of a row, extra receives any columns
+// selected after them.
+func scanToken(row rowScanner, extra ...any) (*Token, error) {
+	var prefix, salt, hash sql.NullString
 	var name string
 	var createdAt string
 	var permissions int
-	err := row.Scan(&tokenString, &name, &createdAt, &permissions)
+	var scopes string
+	var validUntil sql.NullString
+	err := row.Scan(append([]any{&prefix, &salt, &hash, &name, &createdAt, &permissions, &scopes, &validUntil}, extra...)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // Token not found
@@ -124,5 +458,24 @@ func (t *tokenStorage) scanToken(row *sql.Row) (*Token, error) {
 		log.Fatalf("Failed to parse created_at for token %s, check format: %s", name, err)
 		return nil, err
 	}
-	return &Token{Token: tokenString, Name: name, CreatedAt: createdAtTime, Permissions: permissions}, nil
+	token := &Token{Prefix: prefix.String, Salt: salt.String, Hash: hash.String, Name: name, CreatedAt: createdAtTime, Permissions: permissions, Scopes: parseScopes(name, scopes)}
+	if validUntil.Valid && validUntil.String != "" {
+		token.ValidUntil, err = time.Parse(time.RFC3339, validUntil.String)
+		if err != nil {
+			// Like unreadable scopes, an unreadable expiry fails closed
+			log.Printf("Failed to parse valid_until for token %s: %s", name, err)
+			token.ValidUntil = time.Unix(0, 0)
+		}
+	}
+	return token, nil
+}
+
+func parseScopes(tokenName, stored string) []string {
+	scopes := []string{}
+	if err := json.Unmarshal([]byte(stored), &scopes); err != nil {
+		// A token whose scopes can not be read reaches nothing rather than everything
+		log.Printf("Failed to parse scopes of token %s: %s", tokenName, err)
+		return []string{"\x00"}
+	}
+	return scopes
 }
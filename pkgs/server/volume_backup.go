@@ -0,0 +1,319 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const volumeHelperImage = "busybox:latest"
+
+// volumeHelperMountPath is where helper containers mount the volume. Backups
+// contain the volume data under this directory name.
+const volumeHelperMountPath = "/volume"
+
+const defaultVolumeBackupDir = "/var/jig/backups"
+const defaultVolumeBackupRetention = 7
+
+func ensureVolumeHelperImage(cli *client.Client) error {
+	if _, _, err := cli.ImageInspectWithRaw(context.Background(), volumeHelperImage); err == nil {
+		return nil
+	}
+	pull, err := cli.ImagePull(context.Background(), volumeHelperImage, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer pull.Close()
+	_, err = io.Copy(io.Discard, pull)
+	return err
+}
+
+// createVolumeHelper creates a stopped container with the volume mounted. The
+// archive API works on stopped containers, so most operations never start it.
+func createVolumeHelper(cli *client.Client, volumeName string, cmd []string) (string, error) {
+	if err := ensureVolumeHelperImage(cli); err != nil {
+		return "", err
+	}
+	created, err := cli.ContainerCreate(context.Background(), &container.Config{
+		Image:  volumeHelperImage,
+		Cmd:    cmd,
+		Labels: map[string]string{"jig.helper": "volume"},
+	}, &container.HostConfig{
+		NetworkMode: "none",
+		Mounts: []mount.Mount{{
+			Type:   mount.TypeVolume,
+			Source: volumeName,
+			Target: volumeHelperMountPath,
+		}},
+	}, &network.NetworkingConfig{}, &v1.Platform{}, "")
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func removeVolumeHelper(cli *client.Client, id string) {
+	if err := cli.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true}); err != nil {
+		log.Println("Failed to remove volume helper container", id, err)
+	}
+}
+
+// backupVolume writes a gzipped tarball of the volume contents to w.
+func backupVolume(cli *client.Client, volumeName string, w io.Writer) error {
+	helperID, err := createVolumeHelper(cli, volumeName, nil)
+	if err != nil {
+		return err
+	}
+	defer removeVolumeHelper(cli, helperID)
+
+	archive, _, err := cli.CopyFromContainer(context.Background(), helperID, volumeHelperMountPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	gzipWriter := gzip.NewWriter(w)
+	if _, err := io.Copy(gzipWriter, archive); err != nil {
+		gzipWriter.Close()
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// restoreVolume replaces the volume contents with a gzipped tarball produced by
+// backupVolume.
+func restoreVolume(cli *client.Client, volumeName string, r io.Reader) error {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("backup is not a gzip archive: %w", err)
+	}
+	defer gzipReader.Close()
+
+	helperID, err := createVolumeHelper(cli, volumeName, []string{"find", volumeHelperMountPath, "-mindepth", "1", "-delete"})
+	if err != nil {
+		return err
+	}
+	defer removeVolumeHelper(cli, helperID)
+
+	if err := cli.ContainerStart(context.Background(), helperID, container.StartOptions{}); err != nil {
+		return err
+	}
+	waitC, errC := cli.ContainerWait(context.Background(), helperID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errC:
+		return err
+	case result := <-waitC:
+		if result.StatusCode != 0 {
+			return fmt.Errorf("failed to clear volume %s, helper exited with %d", volumeName, result.StatusCode)
+		}
+	}
+
+	return cli.CopyToContainer(context.Background(), helperID, "/", gzipReader, types.CopyToContainerOptions{
+		CopyUIDGID: true,
+	})
+}
+
+func runningVolumeUsers(cli *client.Client, volumeName string) ([]string, error) {
+	containers, err := cli.ContainerList(context.Background(), container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("volume", volumeName)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	users := []string{}
+	for _, containerInfo := range containers {
+		users = append(users, deploymentDisplayName(containerInfo))
+	}
+	return users, nil
+}
+
+func (vr VolumeRouter) backupVolume(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, err := vr.cli.VolumeInspect(context.Background(), name); err != nil {
+		if errdefs.IsNotFound(err) {
+			http.Error(w, "Volume not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+	stream := &startedWriter{Writer: w}
+	if err := backupVolume(vr.cli, name, stream); err != nil {
+		log.Println("Failed to back up volume", name, err)
+		if stream.started {
+			// The status and part of the archive are sent, aborting is the only
+			// way left to tell the client that the backup is incomplete
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Del("Content-Disposition")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// startedWriter records whether anything was written, after that a response
+// can no longer be turned into an error.
+type startedWriter struct {
+	io.Writer
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.Writer.Write(p)
+}
+
+func (vr VolumeRouter) restoreVolume(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, err := vr.cli.VolumeInspect(context.Background(), name); err != nil {
+		if errdefs.IsNotFound(err) {
+			http.Error(w, "Volume not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	users, err := runningVolumeUsers(vr.cli, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(users) > 0 {
+		http.Error(w, fmt.Sprintf("Volume %s is mounted by running containers (%s), stop them before restoring", name, strings.Join(users, ", ")), http.StatusConflict)
+		return
+	}
+
+	if err := restoreVolume(vr.cli, name, r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func volumeBackupFilename(volumeName string, at time.Time) string {
+	return volumeName + "-" + at.UTC().Format("20060102T150405Z") + ".tar.gz"
+}
+
+// pruneVolumeBackups removes all but the newest retention backups of a volume
+// from dir.
+func pruneVolumeBackups(dir, volumeName string, retention int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	backups := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, volumeName+"-") || !strings.HasSuffix(name, ".tar.gz") {
+			continue
+		}
+		// Make sure a volume named "app" does not prune the backups of "app-cache"
+		timestamp := strings.TrimSuffix(strings.TrimPrefix(name, volumeName+"-"), ".tar.gz")
+		if _, err := time.Parse("20060102T150405Z", timestamp); err != nil {
+			continue
+		}
+		backups = append(backups, name)
+	}
+	slices.Sort(backups)
+	for len(backups) > retention {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func writeVolumeBackupFile(cli *client.Client, dir, volumeName string) error {
+	path := filepath.Join(dir, volumeBackupFilename(volumeName, time.Now()))
+	file, err := os.Create(path + ".partial")
+	if err != nil {
+		return err
+	}
+	if err := backupVolume(cli, volumeName, file); err != nil {
+		file.Close()
+		os.Remove(path + ".partial")
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".partial", path)
+}
+
+func runVolumeBackups(cli *client.Client, backend deploymentBackend, dir string, retention int) {
+	volumes, err := listJigVolumes(cli, backend, nil)
+	if err != nil {
+		log.Println("Scheduled volume backup failed to list volumes", err)
+		return
+	}
+	for _, volume := range volumes {
+		if err := writeVolumeBackupFile(cli, dir, volume.Name); err != nil {
+			log.Println("Scheduled backup of volume", volume.Name, "failed:", err)
+			continue
+		}
+		if err := pruneVolumeBackups(dir, volume.Name, retention); err != nil {
+			log.Println("Failed to prune backups of volume", volume.Name, err)
+		}
+	}
+}
+
+// startScheduledVolumeBackups backs up every Jig volume to a server-local
+// directory when JIG_VOLUME_BACKUP_INTERVAL is set.
+func startScheduledVolumeBackups(cli *client.Client, backend deploymentBackend) error {
+	intervalString := strings.TrimSpace(os.Getenv("JIG_VOLUME_BACKUP_INTERVAL"))
+	if intervalString == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(intervalString)
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("invalid JIG_VOLUME_BACKUP_INTERVAL %q", intervalString)
+	}
+
+	retention := defaultVolumeBackupRetention
+	if retentionString := strings.TrimSpace(os.Getenv("JIG_VOLUME_BACKUP_RETENTION")); retentionString != "" {
+		retention, err = strconv.Atoi(retentionString)
+		if err != nil || retention < 1 {
+			return errors.New("JIG_VOLUME_BACKUP_RETENTION must be a positive number")
+		}
+	}
+
+	dir := defaultVolumeBackupDir
+	if configured := strings.TrimSpace(os.Getenv("JIG_VOLUME_BACKUP_DIR")); configured != "" {
+		dir = configured
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runVolumeBackups(cli, backend, dir, retention)
+		}
+	}()
+	log.Printf("Backing up volumes to %s every %s, keeping %d backups", dir, interval, retention)
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	jigtypes "askh.at/jig/v2/pkgs/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/go-chi/chi/v5"
+)
+
+// jigVolumeLabel marks volumes created through Jig, either explicitly or by
+// mounting a named volume from a deployment config.
+const jigVolumeLabel = "jig.volume"
+
+type VolumeRouter struct {
+	cli     *client.Client
+	backend deploymentBackend
+}
+
+func (vr VolumeRouter) Router() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", vr.listVolumes)
+	r.Post("/", vr.createVolume)
+	r.Group(func(r chi.Router) {
+		r.Use(vr.requireVolumeScope)
+		r.Get("/{name}", vr.inspectVolume)
+		r.Delete("/{name}", vr.removeVolume)
+		// A backup holds every file of the volume and a restore replaces them,
+		// whichever deployment they belong to
+		r.With(requirePermission(PermissionsClusterAdmin)).Get("/{name}/backup", vr.backupVolume)
+		r.With(requirePermission(PermissionsClusterAdmin)).Post("/{name}/restore", vr.restoreVolume)
+	})
+	return r
+}
+
+// volumeInScope reports whether token may reach a volume. Every deployment
+// that mounts it has to be in the scopes of the token, a volume that nothing
+// mounts is matched by its own name like the deployment it is meant for.
+func volumeInScope(token *Token, name string, usage map[string][]string) bool {
+	if token == nil {
+		return true
+	}
+	users := usage[name]
+	if len(users) == 0 {
+		return token.CanAccessDeployment(name)
+	}
+	for _, user := range users {
+		if !token.CanAccessDeployment(user) {
+			return false
+		}
+	}
+	return true
+}
+
+// requireVolumeScope refuses requests for a {name} volume outside the scopes
+// of the token, see volumeInScope.
+func (vr VolumeRouter) requireVolumeScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := tokenFromContext(r.Context())
+		if token == nil || len(token.Scopes) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		usage, err := volumeUsage(vr.cli, vr.backend)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if name := chi.URLParam(r, "name"); !volumeInScope(token, name, usage) {
+			http.Error(w, "Token is not scoped to volume "+name, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func addVolumeUser(usage map[string][]string, volumeName, deploymentName string) {
+	if volumeName == "" || deploymentName == "" || slices.Contains(usage[volumeName], deploymentName) {
+		return
+	}
+	usage[volumeName] = append(usage[volumeName], deploymentName)
+}
+
+// volumeUsage maps volume names to the deployments that mount them, covering
+// single containers, compose services and swarm services.
+func volumeUsage(cli *client.Client, backend deploymentBackend) (map[string][]string, error) {
+	usage := map[string][]string{}
+
+	containers, err := cli.ContainerList(context.Background(), container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, containerInfo := range containers {
+		if _, isJigDeployment := containerInfo.Labels["jig.name"]; !isJigDeployment {
+			continue
+		}
+		if containerInfo.Labels["jig.deployment-kind"] == "swarm" || containerInfo.Labels["jig.deployment-kind"] == "swarm-stack-service" {
+			continue
+		}
+		for _, mountPoint := range containerInfo.Mounts {
+			if mountPoint.Type == mount.TypeVolume {
+				addVolumeUser(usage, mountPoint.Name, deploymentDisplayName(containerInfo))
+			}
+		}
+	}
+
+	if backend == deploymentBackendSwarm {
+		services, err := cli.ServiceList(context.Background(), types.ServiceListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, service := range services {
+			name := service.Spec.Labels["jig.name"]
+			if name == "" || service.Spec.TaskTemplate.ContainerSpec == nil {
+				continue
+			}
+			if displayName := service.Spec.Labels["jig.display-name"]; displayName != "" {
+				name = displayName
+			}
+			for _, serviceMount := range service.Spec.TaskTemplate.ContainerSpec.Mounts {
+				if serviceMount.Type == mount.TypeVolume {
+					addVolumeUser(usage, serviceMount.Source, name)
+				}
+			}
+		}
+	}
+
+	for _, users := range usage {
+		slices.Sort(users)
+	}
+	return usage, nil
+}
+
+func volumeFromDocker(dockerVolume volume.Volume, usedBy []string) jigtypes.Volume {
+	if usedBy == nil {
+		usedBy = []string{}
+	}
+	return jigtypes.Volume{
+		Name:       dockerVolume.Name,
+		Driver:     dockerVolume.Driver,
+		Mountpoint: dockerVolume.Mountpoint,
+		CreatedAt:  dockerVolume.CreatedAt,
+		Scope:      dockerVolume.Scope,
+		Options:    dockerVolume.Options,
+		Labels:     dockerVolume.Labels,
+		UsedBy:     usedBy,
+	}
+}
+
+// listJigVolumes returns the volumes that Jig created or that a Jig deployment
+// uses, the daemon usually holds plenty of anonymous volumes nobody cares
+// about here.
+func listJigVolumes(cli *client.Client, backend deploymentBackend, token *Token) ([]jigtypes.Volume, error) {
+	volumes, err := cli.VolumeList(context.Background(), volume.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	usage, err := volumeUsage(cli, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []jigtypes.Volume{}
+	for _, dockerVolume := range volumes.Volumes {
+		if dockerVolume == nil {
+			continue
+		}
+		if dockerVolume.Labels[jigVolumeLabel] == "" && len(usage[dockerVolume.Name]) == 0 {
+			continue
+		}
+		if !volumeInScope(token, dockerVolume.Name, usage) {
+			continue
+		}
+		result = append(result, volumeFromDocker(*dockerVolume, usage[dockerVolume.Name]))
+	}
+	slices.SortFunc(result, func(a, b jigtypes.Volume) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return result, nil
+}
+
+func (vr VolumeRouter) listVolumes(w http.ResponseWriter, r *http.Request) {
+	volumes, err := listJigVolumes(vr.cli, vr.backend, tokenFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJson(w, http.StatusOK, volumes)
+}
+
+func (vr VolumeRouter) createVolume(w http.ResponseWriter, r *http.Request) {
+	var request jigtypes.VolumeCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid volume create request", http.StatusBadRequest)
+		return
+	}
+	if request.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	setAuditTarget(r, request.Name)
+	if !canAccessDeployment(r, request.Name) {
+		http.Error(w, "Token is not scoped to volume "+request.Name, http.StatusForbidden)
+		return
+	}
+	if _, err := vr.cli.VolumeInspect(context.Background(), request.Name); err == nil {
+		http.Error(w, fmt.Sprintf("Volume %s already exists", request.Name), http.StatusConflict)
+		return
+	}
+
+	created, err := vr.cli.VolumeCreate(context.Background(), volume.CreateOptions{
+		Name:       request.Name,
+		Driver:     request.Driver,
+		DriverOpts: request.DriverOpts,
+		Labels:     map[string]string{jigVolumeLabel: "true"},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJson(w, http.StatusCreated, volumeFromDocker(created, nil))
+}
+
+func (vr VolumeRouter) inspectVolume(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	dockerVolume, err := vr.cli.VolumeInspect(context.Background(), name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			http.Error(w, "Volume not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	usage, err := volumeUsage(vr.cli, vr.backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondWithJson(w, http.StatusOK, volumeFromDocker(dockerVolume, usage[name]))
+}
+
+func (vr VolumeRouter) removeVolume(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	usage, err := volumeUsage(vr.cli, vr.backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if users := usage[name]; len(users) > 0 {
+		http.Error(w, fmt.Sprintf("Volume %s is used by %s", name, strings.Join(users, ", ")), http.StatusConflict)
+		return
+	}
+
+	if err := vr.cli.VolumeRemove(context.Background(), name, false); err != nil {
+		switch {
+		case errdefs.IsNotFound(err):
+			http.Error(w, "Volume not found", http.StatusNotFound)
+		case errdefs.IsConflict(err):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
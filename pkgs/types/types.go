@@ -11,9 +11,22 @@ type DeploymentConfig struct {
 	ComposeService string               `json:"composeService" yaml:"composeService"`
 	Placement      DeploymentPlacement  `json:"placement" yaml:"placement"`
 	Envs           map[string]string    `json:"envs" yaml:"envs"`
+	SecretFiles    map[string]string    `json:"secretFiles" yaml:"secretFiles"`
 	ExposePorts    map[string]string    `json:"exposePorts" yaml:"exposePorts"`
 	Volumes        []string             `json:"volumes" yaml:"volumes"`
+	NamedVolumes   []DeploymentVolume   `json:"namedVolumes" yaml:"namedVolumes"`
 	Middlewares    DeploymentMiddleares `json:"middlewares" yaml:"middlewares"`
+	// RestartOnSecretChange recreates the deployment whenever a secret it
+	// references gets a new version.
+	RestartOnSecretChange bool `json:"restartOnSecretChange" yaml:"restartOnSecretChange"`
+}
+
+type DeploymentVolume struct {
+	Name       string            `json:"name" yaml:"name"`
+	Target     string            `json:"target" yaml:"target"`
+	Driver     string            `json:"driver,omitempty" yaml:"driver"`
+	DriverOpts map[string]string `json:"driverOpts,omitempty" yaml:"driverOpts"`
+	ReadOnly   bool              `json:"readOnly,omitempty" yaml:"readOnly"`
 }
 
 type DeploymentPlacement struct {
@@ -45,22 +58,86 @@ type Deployment struct {
 	Lifetime    string       `json:"lifetime"`
 	HasRollback bool         `json:"hasRollback"`
 	Replicas    int          `json:"replicas,omitempty"`
+	Drift       string       `json:"drift,omitempty"`
 	Children    []Deployment `json:"children,omitempty"`
 }
 
 type NewSecretBody struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
+	// WriteOnly secrets can be used by deployments but never read back
+	WriteOnly bool `json:"writeOnly,omitempty"`
 }
 
 type SecretList struct {
-	Secrets []string `json:"secrets"`
+	Secrets   []string `json:"secrets"`
+	WriteOnly []string `json:"writeOnly,omitempty"`
 }
 
 type SecretInspect struct {
 	Value string `json:"value"`
 }
 
+type UpdateSecretBody struct {
+	Value string `json:"value"`
+}
+
+type SecretRollbackBody struct {
+	Version int `json:"version"`
+}
+
+type SecretVersionResponse struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	// Restarted lists the deployments recreated because of the new version
+	Restarted []string `json:"restarted,omitempty"`
+	// RestartErrors holds one message per deployment that failed to restart
+	RestartErrors []string `json:"restartErrors,omitempty"`
+}
+
+type SecretBatchRequest struct {
+	Secrets   map[string]string `json:"secrets"`
+	Overwrite bool              `json:"overwrite"`
+}
+
+type SecretBatchResponse struct {
+	Created       int      `json:"created"`
+	Updated       int      `json:"updated"`
+	Skipped       int      `json:"skipped"`
+	Restarted     []string `json:"restarted,omitempty"`
+	RestartErrors []string `json:"restartErrors,omitempty"`
+}
+
+type SecretExport struct {
+	Secrets map[string]string `json:"secrets"`
+	// WriteOnly names the secrets left out because their values can not be read
+	WriteOnly []string `json:"writeOnly,omitempty"`
+}
+
+type SecretUsage struct {
+	Deployment string `json:"deployment"`
+	// Service is set for the managed services of compose deployments and stacks
+	Service string `json:"service,omitempty"`
+	Kind    string `json:"kind"`
+}
+
+type SecretUsageResponse struct {
+	Name   string        `json:"name"`
+	Usages []SecretUsage `json:"usages"`
+}
+
+type SecretVersion struct {
+	Version   int    `json:"version"`
+	CreatedAt string `json:"createdAt"`
+	CreatedBy string `json:"createdBy"`
+}
+
+type SecretVersionList struct {
+	Name     string          `json:"name"`
+	Current  int             `json:"current"`
+	Versions []SecretVersion `json:"versions"`
+}
+
 type Stats struct {
 	Name             string  `json:"name"`
 	CpuPercentage    float64 `json:"cpuPercentage"`
@@ -90,6 +167,32 @@ type DeploymentScaleRequest struct {
 	Replicas int `json:"replicas"`
 }
 
+type DeploymentEnvResponse struct {
+	Envs map[string]string `json:"envs"`
+}
+
+type DeploymentEnvUpdateRequest struct {
+	Set   map[string]string `json:"set,omitempty"`
+	Unset []string          `json:"unset,omitempty"`
+}
+
+type Volume struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Mountpoint string            `json:"mountpoint,omitempty"`
+	CreatedAt  string            `json:"createdAt,omitempty"`
+	Scope      string            `json:"scope,omitempty"`
+	Options    map[string]string `json:"options,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	UsedBy     []string          `json:"usedBy"`
+}
+
+type VolumeCreateRequest struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver,omitempty"`
+	DriverOpts map[string]string `json:"driverOpts,omitempty"`
+}
+
 type ClusterStatusResponse struct {
 	Backend        string           `json:"backend"`
 	Nodes          []SwarmNodeStats `json:"nodes,omitempty"`
@@ -105,12 +208,75 @@ type ClusterJoinTokenResponse struct {
 
 type TokenListResponse struct {
 	TokenNames []string `json:"tokens"`
+	// Permissions lists the permissions of every token by name
+	Permissions map[string][]string `json:"permissions,omitempty"`
+	Scopes      map[string][]string `json:"scopes,omitempty"`
+	// Prefixes holds the start of every secret to tell tokens apart
+	Prefixes map[string]string `json:"prefixes,omitempty"`
+	// Expires holds the RFC3339 expiry of tokens that have one
+	Expires map[string]string `json:"expires,omitempty"`
 }
 
 type TokenCreateRequest struct {
 	Name string `json:"name"`
+	// RevealSecrets lets the token read secret values back
+	RevealSecrets bool `json:"revealSecrets,omitempty"`
+	// Permissions names what the token may do, empty means the defaults
+	Permissions []string `json:"permissions,omitempty"`
+	// Scopes limit the token to deployments matching these globs
+	Scopes []string `json:"scopes,omitempty"`
+	// TTL like 30d, 2w or 12h after which the token stops working
+	TTL string `json:"ttl,omitempty"`
 }
 type TokenCreateResponse struct {
 	Name  string `json:"name"`
 	Token string `json:"token"`
+	// ExpiresAt is the RFC3339 expiry, empty when the token does not expire
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+type TokenRotateRequest struct {
+	// Grace like 1h keeps the old secret working for that long
+	Grace string `json:"grace,omitempty"`
+}
+
+type AuditEntry struct {
+	// Time is RFC3339
+	Time   string `json:"time"`
+	Actor  string `json:"actor"`
+	Method string `json:"method"`
+	Route  string `json:"route"`
+	// Target is the deployment, secret, volume or token the request was about
+	Target string `json:"target,omitempty"`
+	Status int    `json:"status"`
+}
+
+type AuditLogResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+type AdminImportResult struct {
+	Secrets     int      `json:"secrets"`
+	Tokens      int      `json:"tokens"`
+	Deployments int      `json:"deployments"`
+	Images      int      `json:"images"`
+	Volumes     int      `json:"volumes"`
+	Errors      []string `json:"errors"`
+}
+
+type SchemaMigration struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Applied   bool   `json:"applied"`
+	AppliedAt string `json:"appliedAt,omitempty"`
+}
+
+type SchemaStatus struct {
+	Version    int               `json:"version"`
+	Latest     int               `json:"latest"`
+	Migrations []SchemaMigration `json:"migrations"`
+}
+
+type RotateMasterKeyResponse struct {
+	Secrets int `json:"secrets"`
 }
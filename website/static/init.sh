@@ -188,6 +188,9 @@ remove_existing_jig() {
 
 install_swarm() {
   mkdir -p /var/jig
+  # The master key stays out of /var/jig, which holds the database
+  mkdir -p /etc/jig
+  chmod 700 /etc/jig
 
   ensure_swarm_network
   ensure_swarm_ingress_label
@@ -203,6 +206,8 @@ install_swarm() {
       --network jig
       --mount type=bind,src=/var/run/docker.sock,dst=/var/run/docker.sock
       --mount type=bind,src=/var/jig,dst=/var/jig
+      --mount type=bind,src=/etc/jig,dst=/etc/jig
+      --env "JIG_MASTER_KEY_FILE=/etc/jig/master.key"
       --env "JIG_SSL_EMAIL=$JIG_SSL_EMAIL"
       --env "JIG_VERCEL_APIKEY=$JIG_VERCEL_APIKEY"
       --env "JIG_ADVERTISE_URL=$JIG_ADVERTISE_URL"
@@ -239,6 +244,8 @@ install_swarm() {
       -e "JIG_ADVERTISE_URL=$JIG_ADVERTISE_URL"
       -v /var/run/docker.sock:/var/run/docker.sock
       -v /var/jig:/var/jig
+      -v /etc/jig:/etc/jig
+      -e "JIG_MASTER_KEY_FILE=/etc/jig/master.key"
     )
 
     if [[ -n "${JIG_DOMAIN:-}" ]]; then
@@ -271,6 +278,13 @@ install_swarm() {
 
 install_standalone() {
   mkdir -p /var/jig
+  # The master key stays out of /var/jig, which holds the database
+  mkdir -p /etc/jig
+  chmod 700 /etc/jig
+  # Secret files are bind mounted into deployments from the host, so the
+  # directory has to have the same path inside the jig container
+  mkdir -p /run/jig/secrets
+  chmod 700 /run/jig/secrets
 
   docker stop traefik 2>/dev/null || true
   docker rm traefik 2>/dev/null || true
@@ -287,6 +301,9 @@ install_standalone() {
     -e "JIG_ADVERTISE_URL=$JIG_ADVERTISE_URL"
     -v /var/run/docker.sock:/var/run/docker.sock
     -v /var/jig:/var/jig
+    -v /etc/jig:/etc/jig
+    -e "JIG_MASTER_KEY_FILE=/etc/jig/master.key"
+    -v /run/jig/secrets:/run/jig/secrets
   )
 
   if [[ -n "${JIG_DOMAIN:-}" ]]; then